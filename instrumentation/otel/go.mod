@@ -0,0 +1,27 @@
+module github.com/ubirch/ubirch-protocol-go/instrumentation/otel
+
+go 1.19
+
+require (
+	github.com/stretchr/testify v1.8.3
+	github.com/ubirch/ubirch-protocol-go/ubirch/v2 v2.0.4
+	go.opentelemetry.io/otel v1.16.0
+	go.opentelemetry.io/otel/metric v1.16.0
+	go.opentelemetry.io/otel/sdk v1.16.0
+	go.opentelemetry.io/otel/sdk/metric v0.39.0
+	go.opentelemetry.io/otel/trace v1.16.0
+)
+
+require (
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/go-logr/logr v1.2.4 // indirect
+	github.com/go-logr/stdr v1.2.2 // indirect
+	github.com/google/uuid v1.1.1 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/ubirch/go.crypto v0.1.2 // indirect
+	github.com/ugorji/go/codec v1.1.7 // indirect
+	golang.org/x/sys v0.8.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
+)
+
+replace github.com/ubirch/ubirch-protocol-go/ubirch/v2 => ../../ubirch
@@ -0,0 +1,146 @@
+/*
+ * Copyright (c) 2019 ubirch GmbH.
+ *
+ * ```
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * ```
+ */
+
+// Package ubirchotel reports the metrics and traces of the ubirch protocol to OpenTelemetry.
+//
+// Usage:
+//	metrics, err := ubirchotel.NewMetrics(otel.Meter("ubirch"))
+//	tracer := ubirchotel.NewTracer(otel.Tracer("ubirch"))
+//	protocol.Instrumentation = &ubirch.Instrumentation{Metrics: metrics, Tracer: tracer}
+package ubirchotel
+
+import (
+	"context"
+
+	"github.com/ubirch/ubirch-protocol-go/ubirch/v2"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Metrics implements ubirch.Metrics using OpenTelemetry counters and histograms
+type Metrics struct {
+	counters   map[string]metric.Int64Counter
+	histograms map[string]metric.Float64Histogram
+}
+
+// Ensure Metrics implements the ubirch.Metrics interface
+var _ ubirch.Metrics = (*Metrics)(nil)
+
+// NewMetrics creates the instruments for all metrics of the ubirch protocol
+func NewMetrics(meter metric.Meter) (*Metrics, error) {
+	m := &Metrics{
+		counters:   map[string]metric.Int64Counter{},
+		histograms: map[string]metric.Float64Histogram{},
+	}
+
+	counters := map[string]string{
+		ubirch.MetricSignTotal:          "Number of signing operations.",
+		ubirch.MetricVerifyTotal:        "Number of verifications.",
+		ubirch.MetricKeystoreErrorTotal: "Number of failed keystore operations.",
+	}
+	for name, description := range counters {
+		counter, err := meter.Int64Counter(name, metric.WithDescription(description))
+		if err != nil {
+			return nil, err
+		}
+		m.counters[name] = counter
+	}
+
+	histograms := map[string]string{
+		ubirch.MetricSignDuration:   "Duration of signing operations in seconds.",
+		ubirch.MetricVerifyDuration: "Duration of verifications in seconds.",
+	}
+	for name, description := range histograms {
+		histogram, err := meter.Float64Histogram(name, metric.WithDescription(description), metric.WithUnit("s"))
+		if err != nil {
+			return nil, err
+		}
+		m.histograms[name] = histogram
+	}
+
+	return m, nil
+}
+
+// IncCounter increments the counter with the given name. Unknown metrics are ignored.
+func (m *Metrics) IncCounter(name string, labels ...ubirch.Label) {
+	counter, found := m.counters[name]
+	if !found {
+		return
+	}
+	counter.Add(context.Background(), 1, metric.WithAttributes(toAttributes(labels)...))
+}
+
+// ObserveHistogram records a value in the histogram with the given name. Unknown metrics are ignored.
+func (m *Metrics) ObserveHistogram(name string, value float64, labels ...ubirch.Label) {
+	histogram, found := m.histograms[name]
+	if !found {
+		return
+	}
+	histogram.Record(context.Background(), value, metric.WithAttributes(toAttributes(labels)...))
+}
+
+// Tracer implements ubirch.Tracer using an OpenTelemetry tracer
+type Tracer struct {
+	tracer trace.Tracer
+	ctx    context.Context
+}
+
+// Ensure Tracer implements the ubirch.Tracer interface
+var _ ubirch.Tracer = (*Tracer)(nil)
+
+// NewTracer returns a Tracer which starts root spans with the given OpenTelemetry tracer
+func NewTracer(tracer trace.Tracer) *Tracer {
+	return NewTracerWithContext(context.Background(), tracer)
+}
+
+// NewTracerWithContext returns a Tracer which starts spans as children of the span in the given context
+func NewTracerWithContext(ctx context.Context, tracer trace.Tracer) *Tracer {
+	return &Tracer{tracer: tracer, ctx: ctx}
+}
+
+// StartSpan starts a new span
+func (t *Tracer) StartSpan(name string, attributes ...ubirch.Label) ubirch.Span {
+	_, span := t.tracer.Start(t.ctx, name, trace.WithAttributes(toAttributes(attributes)...))
+	return &Span{span: span}
+}
+
+// Span implements ubirch.Span using an OpenTelemetry span
+type Span struct {
+	span trace.Span
+}
+
+// SetError records the error and sets the status of the span to error
+func (s *Span) SetError(err error) {
+	s.span.RecordError(err)
+	s.span.SetStatus(codes.Error, err.Error())
+}
+
+// End finishes the span
+func (s *Span) End() {
+	s.span.End()
+}
+
+func toAttributes(labels []ubirch.Label) []attribute.KeyValue {
+	attributes := make([]attribute.KeyValue, len(labels))
+	for i, label := range labels {
+		attributes[i] = attribute.String(label.Key, label.Value)
+	}
+	return attributes
+}
@@ -0,0 +1,92 @@
+/*
+ * Copyright (c) 2019 ubirch GmbH.
+ *
+ * ```
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * ```
+ */
+
+package ubirchotel
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/ubirch/ubirch-protocol-go/ubirch/v2"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestMetrics(t *testing.T) {
+	asserter := assert.New(t)
+	requirer := require.New(t)
+
+	reader := sdkmetric.NewManualReader()
+	provider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	metrics, err := NewMetrics(provider.Meter("test"))
+	requirer.NoError(err)
+
+	metrics.IncCounter(ubirch.MetricSignTotal, ubirch.Label{Key: "name", Value: "A"}, ubirch.Label{Key: "result", Value: ubirch.ResultOK})
+	metrics.IncCounter(ubirch.MetricSignTotal, ubirch.Label{Key: "name", Value: "A"}, ubirch.Label{Key: "result", Value: ubirch.ResultOK})
+	metrics.ObserveHistogram(ubirch.MetricSignDuration, 0.5, ubirch.Label{Key: "name", Value: "A"})
+	metrics.IncCounter("unknown")
+
+	var rm metricdata.ResourceMetrics
+	requirer.NoError(reader.Collect(context.Background(), &rm))
+	requirer.Len(rm.ScopeMetrics, 1)
+
+	found := map[string]bool{}
+	for _, m := range rm.ScopeMetrics[0].Metrics {
+		found[m.Name] = true
+		switch data := m.Data.(type) {
+		case metricdata.Sum[int64]:
+			requirer.Len(data.DataPoints, 1)
+			asserter.Equal(int64(2), data.DataPoints[0].Value)
+			value, _ := data.DataPoints[0].Attributes.Value("name")
+			asserter.Equal(attribute.StringValue("A"), value)
+		case metricdata.Histogram[float64]:
+			requirer.Len(data.DataPoints, 1)
+			asserter.Equal(uint64(1), data.DataPoints[0].Count)
+		}
+	}
+	asserter.Equal(map[string]bool{ubirch.MetricSignTotal: true, ubirch.MetricSignDuration: true}, found)
+}
+
+func TestTracer(t *testing.T) {
+	asserter := assert.New(t)
+	requirer := require.New(t)
+
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	tracer := NewTracer(provider.Tracer("test"))
+
+	span := tracer.StartSpan("ubirch.SignHash", ubirch.Label{Key: "name", Value: "A"})
+	span.SetError(errors.New("signing failed"))
+	span.End()
+	tracer.StartSpan("ubirch.Verify").End()
+
+	spans := recorder.Ended()
+	requirer.Len(spans, 2)
+	asserter.Equal("ubirch.SignHash", spans[0].Name())
+	asserter.Equal(codes.Error, spans[0].Status().Code)
+	asserter.Equal([]attribute.KeyValue{attribute.String("name", "A")}, spans[0].Attributes())
+	asserter.Equal("ubirch.Verify", spans[1].Name())
+	asserter.Equal(codes.Unset, spans[1].Status().Code)
+}
@@ -0,0 +1,11 @@
+module github.com/ubirch/ubirch-protocol-go/instrumentation/prometheus
+
+go 1.16
+
+require (
+	github.com/prometheus/client_golang v1.11.1
+	github.com/stretchr/testify v1.5.1
+	github.com/ubirch/ubirch-protocol-go/ubirch/v2 v2.0.4
+)
+
+replace github.com/ubirch/ubirch-protocol-go/ubirch/v2 => ../../ubirch
@@ -0,0 +1,116 @@
+/*
+ * Copyright (c) 2019 ubirch GmbH.
+ *
+ * ```
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * ```
+ */
+
+// Package ubirchprom reports the metrics of the ubirch protocol to Prometheus.
+//
+// Usage:
+//	metrics, err := ubirchprom.NewMetrics(prometheus.DefaultRegisterer)
+//	protocol.Instrumentation = &ubirch.Instrumentation{Metrics: metrics}
+package ubirchprom
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/ubirch/ubirch-protocol-go/ubirch/v2"
+)
+
+// Metrics implements ubirch.Metrics using Prometheus counters and histograms
+type Metrics struct {
+	counters   map[string]*prometheus.CounterVec
+	histograms map[string]*prometheus.HistogramVec
+}
+
+// Ensure Metrics implements the ubirch.Metrics interface
+var _ ubirch.Metrics = (*Metrics)(nil)
+
+// NewMetrics creates the collectors for all metrics of the ubirch protocol and registers them
+func NewMetrics(registerer prometheus.Registerer) (*Metrics, error) {
+	m := &Metrics{
+		counters: map[string]*prometheus.CounterVec{
+			ubirch.MetricSignTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+				Name: ubirch.MetricSignTotal,
+				Help: "Number of signing operations.",
+			}, []string{"name", "version", "result"}),
+			ubirch.MetricVerifyTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+				Name: ubirch.MetricVerifyTotal,
+				Help: "Number of verifications.",
+			}, []string{"name", "result"}),
+			ubirch.MetricKeystoreErrorTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+				Name: ubirch.MetricKeystoreErrorTotal,
+				Help: "Number of failed keystore operations.",
+			}, []string{"uuid", "operation"}),
+		},
+		histograms: map[string]*prometheus.HistogramVec{
+			ubirch.MetricSignDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+				Name:    ubirch.MetricSignDuration,
+				Help:    "Duration of signing operations in seconds.",
+				Buckets: prometheus.ExponentialBuckets(0.0001, 2, 14),
+			}, []string{"name", "version"}),
+			ubirch.MetricVerifyDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+				Name:    ubirch.MetricVerifyDuration,
+				Help:    "Duration of verifications in seconds.",
+				Buckets: prometheus.ExponentialBuckets(0.0001, 2, 14),
+			}, []string{"name"}),
+		},
+	}
+
+	for _, counter := range m.counters {
+		if err := registerer.Register(counter); err != nil {
+			return nil, err
+		}
+	}
+	for _, histogram := range m.histograms {
+		if err := registerer.Register(histogram); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// IncCounter increments the counter with the given name. Unknown metrics are ignored.
+func (m *Metrics) IncCounter(name string, labels ...ubirch.Label) {
+	counter, found := m.counters[name]
+	if !found {
+		return
+	}
+	c, err := counter.GetMetricWith(toPrometheusLabels(labels))
+	if err != nil {
+		return
+	}
+	c.Inc()
+}
+
+// ObserveHistogram adds a value to the histogram with the given name. Unknown metrics are ignored.
+func (m *Metrics) ObserveHistogram(name string, value float64, labels ...ubirch.Label) {
+	histogram, found := m.histograms[name]
+	if !found {
+		return
+	}
+	h, err := histogram.GetMetricWith(toPrometheusLabels(labels))
+	if err != nil {
+		return
+	}
+	h.Observe(value)
+}
+
+func toPrometheusLabels(labels []ubirch.Label) prometheus.Labels {
+	l := make(prometheus.Labels, len(labels))
+	for _, label := range labels {
+		l[label.Key] = label.Value
+	}
+	return l
+}
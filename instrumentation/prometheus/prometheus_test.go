@@ -0,0 +1,52 @@
+/*
+ * Copyright (c) 2019 ubirch GmbH.
+ *
+ * ```
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * ```
+ */
+
+package ubirchprom
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/ubirch/ubirch-protocol-go/ubirch/v2"
+)
+
+func TestMetrics(t *testing.T) {
+	asserter := assert.New(t)
+	requirer := require.New(t)
+
+	registry := prometheus.NewRegistry()
+	metrics, err := NewMetrics(registry)
+	requirer.NoError(err)
+
+	metrics.IncCounter(ubirch.MetricSignTotal, ubirch.Label{Key: "name", Value: "A"}, ubirch.Label{Key: "version", Value: "0x22"}, ubirch.Label{Key: "result", Value: ubirch.ResultOK})
+	metrics.IncCounter(ubirch.MetricSignTotal, ubirch.Label{Key: "name", Value: "A"}, ubirch.Label{Key: "version", Value: "0x22"}, ubirch.Label{Key: "result", Value: ubirch.ResultOK})
+	metrics.ObserveHistogram(ubirch.MetricVerifyDuration, 0.5, ubirch.Label{Key: "name", Value: "A"})
+	metrics.IncCounter("unknown")
+	metrics.IncCounter(ubirch.MetricVerifyTotal, ubirch.Label{Key: "wrong", Value: "label"})
+
+	asserter.Equal(2.0, testutil.ToFloat64(metrics.counters[ubirch.MetricSignTotal].WithLabelValues("A", "0x22", ubirch.ResultOK)))
+	asserter.Equal(1, testutil.CollectAndCount(metrics.histograms[ubirch.MetricVerifyDuration]))
+	asserter.Equal(0, testutil.CollectAndCount(metrics.counters[ubirch.MetricVerifyTotal]))
+
+	//registering twice fails
+	_, err = NewMetrics(registry)
+	asserter.Error(err)
+}
@@ -0,0 +1,377 @@
+/*
+ * Copyright (c) 2019 ubirch GmbH.
+ *
+ * ```
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * ```
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/ubirch/ubirch-protocol-go/ubirch/v2"
+)
+
+const (
+	authTokenHeader        = "X-Auth-Token"
+	maxRequestBodySize     = 1 << 20 // 1 MiB
+	shutdownTimeout        = 10 * time.Second
+	defaultCSRCountry      = "DE"
+	defaultCSROrganization = "ubirch GmbH"
+)
+
+// daemon serves the signing functionality of a protocol context via HTTP. Every request concerns the
+// identity given by the first path element and has to be authenticated with the auth token of the identity:
+//
+//	POST /<name>/hash?version=signed|chained    sign a SHA256 hash (binary, or base64 with Content-Type text/plain)
+//	POST /<name>/data?version=signed|chained    sign the SHA256 hash of the request body
+//	POST /<name>/verify                         verify a UPP (binary, or base64 with Content-Type text/plain)
+//	GET  /<name>/publickey?format=pem|der|raw|jwk
+//	GET  /<name>/csr?country=<c>&organization=<o>
+//
+// The chain state is persisted after every chained signature.
+type daemon struct {
+	mutex    sync.Mutex // the protocol context is not safe for concurrent use
+	protocol *ubirch.Protocol
+	tokens   map[string]string // auth tokens by identity name
+	persist  func(p *ubirch.Protocol) error
+}
+
+// signResponse is the response of the signing endpoints
+type signResponse struct {
+	Hash []byte `json:"hash"`
+	UPP  []byte `json:"upp"`
+}
+
+// verifyResponse is the response of the verification endpoint
+type verifyResponse struct {
+	Verified bool `json:"verified"`
+}
+
+// loadTokens loads the auth tokens of the identities from a JSON file mapping names to tokens
+func loadTokens(filename string) (map[string]string, error) {
+	tokenBytes, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var tokens map[string]string
+	err = json.Unmarshal(tokenBytes, &tokens)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode auth tokens: %v", err)
+	}
+	for name, token := range tokens {
+		if token == "" {
+			return nil, fmt.Errorf("empty auth token for '%s'", name)
+		}
+	}
+	return tokens, nil
+}
+
+// runDaemon serves the protocol context at the given address until SIGTERM or an interrupt is received.
+// The protocol context is saved to the context file after every chained signature and before returning.
+func runDaemon(p *ubirch.Protocol, addr string, tokens map[string]string, contextFile string) error {
+	d := &daemon{
+		protocol: p,
+		tokens:   tokens,
+		persist:  func(p *ubirch.Protocol) error { return saveProtocolContext(p, contextFile) },
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	stop := make(chan struct{})
+	go func() {
+		log.Println("Listening signals...")
+		c := make(chan os.Signal, 1) // we need to reserve to buffer size 1, so the notifier are not blocked
+		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+		sig := <-c
+		signal.Stop(c)
+		log.Printf("received %v, shutting down", sig)
+		close(stop)
+	}()
+
+	log.Printf("daemon listening on %s", listener.Addr())
+	return d.serve(listener, stop)
+}
+
+// serve serves requests on the listener until stop is closed, then shuts down gracefully, waiting for
+// active requests, and persists the protocol context
+func (d *daemon) serve(listener net.Listener, stop <-chan struct{}) error {
+	server := &http.Server{Handler: d}
+
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		<-stop
+
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		err := server.Shutdown(ctx)
+		if err != nil {
+			log.Printf("graceful shutdown failed: %v", err)
+		}
+	}()
+
+	err := server.Serve(listener)
+	if err != http.ErrServerClosed {
+		return err
+	}
+	<-shutdownDone
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.persist(d.protocol)
+}
+
+// ServeHTTP implements the http.Handler interface
+func (d *daemon) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	pathElements := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(pathElements) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+	name, endpoint := pathElements[0], pathElements[1]
+
+	if !d.authenticate(name, r.Header.Get(authTokenHeader)) {
+		http.Error(w, "invalid auth token", http.StatusUnauthorized)
+		return
+	}
+
+	switch {
+	case endpoint == "hash" && r.Method == http.MethodPost:
+		d.handleSign(w, r, name, false)
+	case endpoint == "data" && r.Method == http.MethodPost:
+		d.handleSign(w, r, name, true)
+	case endpoint == "verify" && r.Method == http.MethodPost:
+		d.handleVerify(w, r, name)
+	case endpoint == "publickey" && r.Method == http.MethodGet:
+		d.handlePublicKey(w, r, name)
+	case endpoint == "csr" && r.Method == http.MethodGet:
+		d.handleCSR(w, r, name)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// authenticate checks the auth token of the identity in constant time
+func (d *daemon) authenticate(name string, token string) bool {
+	expected, found := d.tokens[name]
+	if !found {
+		expected = "\x00" // compare anyway, so unknown names take the same time
+	}
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(token)) == 1 && found
+}
+
+// readBody reads the request body, which is base64 decoded if the content type is text/plain
+func readBody(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestBodySize))
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "text/plain") {
+		return base64.StdEncoding.DecodeString(strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
+
+// writeJSON writes the JSON encoding of the value as response
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(value)
+	if err != nil {
+		log.Printf("unable to write response: %v", err)
+	}
+}
+
+// statusOf returns the HTTP status for an error of the protocol
+func statusOf(err error) int {
+	var hashErr *ubirch.HashSizeError
+	switch {
+	case errors.Is(err, ubirch.ErrUnknownName), errors.Is(err, ubirch.ErrKeyNotFound):
+		return http.StatusNotFound
+	case errors.As(err, &hashErr), errors.Is(err, ubirch.ErrInvalidProtocolVersion):
+		return http.StatusBadRequest
+	case errors.Is(err, ubirch.ErrKeystoreLocked):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// writeError writes the error of the protocol as response. A locked keystore is reported distinctly,
+// so an operator or secret manager can unlock it.
+func writeError(w http.ResponseWriter, err error) {
+	if errors.Is(err, ubirch.ErrKeystoreLocked) {
+		http.Error(w, "keystore is locked, it has to be unlocked with the keystore secret", statusOf(err))
+		return
+	}
+	http.Error(w, err.Error(), statusOf(err))
+}
+
+// handleSign signs a hash or the hash of data and persists the chain state for chained UPPs. If the
+// chain state can't be persisted, the chain head is reset and no UPP is returned.
+func (d *daemon) handleSign(w http.ResponseWriter, r *http.Request, name string, isData bool) {
+	var version ubirch.ProtocolVersion
+	switch r.URL.Query().Get("version") {
+	case "signed":
+		version = ubirch.Signed
+	case "chained", "":
+		version = ubirch.Chained
+	default:
+		http.Error(w, "invalid version, must be 'signed' or 'chained'", http.StatusBadRequest)
+		return
+	}
+
+	hash, err := readBody(w, r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("unable to read request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if isData {
+		if len(hash) == 0 {
+			http.Error(w, "empty data", http.StatusBadRequest)
+			return
+		}
+		sum := sha256.Sum256(hash)
+		hash = sum[:]
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	var prevSignature []byte
+	if version == ubirch.Chained {
+		prevSignature, err = d.protocol.GetLastSignature(name)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+
+	upp, err := d.protocol.SignHash(name, hash, version)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if version == ubirch.Chained {
+		err = d.persist(d.protocol)
+		if err != nil {
+			log.Printf("%s: unable to persist chain state, resetting chain head: %v", name, err)
+			if resetErr := d.protocol.SetLastSignature(name, prevSignature); resetErr != nil {
+				log.Printf("%s: resetting chain head failed: %v", name, resetErr)
+			}
+			http.Error(w, "unable to persist chain state", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	writeJSON(w, signResponse{Hash: hash, UPP: upp})
+}
+
+// handleVerify verifies a UPP with the public key of the identity
+func (d *daemon) handleVerify(w http.ResponseWriter, r *http.Request, name string) {
+	upp, err := readBody(w, r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("unable to read request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if _, err := d.protocol.GetUUID(name); err != nil {
+		writeError(w, err)
+		return
+	}
+	verified, err := d.protocol.Verify(name, upp)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, verifyResponse{Verified: verified})
+}
+
+// handlePublicKey returns the public key of the identity in the requested format
+func (d *daemon) handlePublicKey(w http.ResponseWriter, r *http.Request, name string) {
+	formats := map[string]struct {
+		format      ubirch.KeyFormat
+		contentType string
+	}{
+		"pem": {ubirch.FormatPEM, "application/x-pem-file"},
+		"der": {ubirch.FormatDER, "application/octet-stream"},
+		"raw": {ubirch.FormatRaw, "application/octet-stream"},
+		"jwk": {ubirch.FormatJWK, "application/jwk+json"},
+	}
+	formatName := r.URL.Query().Get("format")
+	if formatName == "" {
+		formatName = "pem"
+	}
+	format, found := formats[formatName]
+	if !found {
+		http.Error(w, "invalid format, must be 'pem', 'der', 'raw' or 'jwk'", http.StatusBadRequest)
+		return
+	}
+
+	d.mutex.Lock()
+	pubKey, err := d.protocol.ExportPublicKey(name, format.format)
+	d.mutex.Unlock()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", format.contentType)
+	_, _ = w.Write(pubKey)
+}
+
+// handleCSR returns a DER encoded certificate signing request of the identity
+func (d *daemon) handleCSR(w http.ResponseWriter, r *http.Request, name string) {
+	country := r.URL.Query().Get("country")
+	if country == "" {
+		country = defaultCSRCountry
+	}
+	organization := r.URL.Query().Get("organization")
+	if organization == "" {
+		organization = defaultCSROrganization
+	}
+
+	d.mutex.Lock()
+	csr, err := d.protocol.GetCSR(name, country, organization)
+	d.mutex.Unlock()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/pkcs10")
+	_, _ = w.Write(csr)
+}
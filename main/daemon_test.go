@@ -0,0 +1,302 @@
+/*
+ * Copyright (c) 2019 ubirch GmbH.
+ *
+ * ```
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * ```
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/ubirch/ubirch-protocol-go/ubirch/v2"
+)
+
+const (
+	testName   = "A"
+	testToken  = "token of A"
+	testSecret = "0123456789abcdef"
+)
+
+// newTestDaemon creates a daemon serving a new identity, the persisted protocol contexts are counted
+func newTestDaemon(t *testing.T) (*daemon, *int) {
+	p := &ubirch.Protocol{
+		Crypto: &ubirch.CryptoContext{
+			Keystore: ubirch.NewEncryptedKeystore([]byte(testSecret)),
+			Names:    map[string]uuid.UUID{},
+		},
+		Signatures: map[uuid.UUID][]byte{},
+	}
+	require.NoError(t, p.GenerateKey(testName, uuid.New()))
+	require.NoError(t, p.GenerateKey("B", uuid.New()))
+
+	persisted := 0
+	d := &daemon{
+		protocol: p,
+		tokens:   map[string]string{testName: testToken, "B": "token of B"},
+		persist:  func(p *ubirch.Protocol) error { persisted++; return nil },
+	}
+	return d, &persisted
+}
+
+// request sends a request to the daemon and returns the response
+func request(d *daemon, method string, path string, token string, contentType string, body []byte) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, bytes.NewReader(body))
+	if token != "" {
+		r.Header.Set(authTokenHeader, token)
+	}
+	if contentType != "" {
+		r.Header.Set("Content-Type", contentType)
+	}
+	w := httptest.NewRecorder()
+	d.ServeHTTP(w, r)
+	return w
+}
+
+func TestDaemon_Auth(t *testing.T) {
+	d, persisted := newTestDaemon(t)
+	hash := sha256.Sum256([]byte("data"))
+
+	var tests = []struct {
+		testName string
+		path     string
+		token    string
+	}{
+		{"no token", "/A/hash", ""},
+		{"wrong token", "/A/hash", "wrong token"},
+		{"token of other identity", "/A/hash", "token of B"},
+		{"unknown identity", "/C/hash", testToken},
+		{"token with suffix", "/A/hash", testToken + "x"},
+	}
+
+	for _, currTest := range tests {
+		t.Run(currTest.testName, func(t *testing.T) {
+			w := request(d, http.MethodPost, currTest.path, currTest.token, "", hash[:])
+			assert.Equal(t, http.StatusUnauthorized, w.Code)
+		})
+	}
+	assert.Equal(t, 0, *persisted, "rejected request persisted")
+
+	w := request(d, http.MethodPost, "/A/hash", testToken, "", hash[:])
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+}
+
+func TestDaemon_SignVerify(t *testing.T) {
+	asserter := assert.New(t)
+	requirer := require.New(t)
+	d, persisted := newTestDaemon(t)
+
+	//sign a hash
+	hash := sha256.Sum256([]byte("data"))
+	w := request(d, http.MethodPost, "/A/hash?version=chained", testToken, "", hash[:])
+	requirer.Equal(http.StatusOK, w.Code, w.Body.String())
+	var signed signResponse
+	requirer.NoError(json.Unmarshal(w.Body.Bytes(), &signed))
+	asserter.Equal(hash[:], signed.Hash)
+	asserter.Equal(1, *persisted, "chain state not persisted")
+
+	//sign base64 encoded data, signed UPPs don't change the chain state
+	w = request(d, http.MethodPost, "/A/data?version=signed", testToken, "text/plain", []byte(base64.StdEncoding.EncodeToString([]byte("data"))))
+	requirer.Equal(http.StatusOK, w.Code, w.Body.String())
+	var signedData signResponse
+	requirer.NoError(json.Unmarshal(w.Body.Bytes(), &signedData))
+	asserter.Equal(hash[:], signedData.Hash)
+	asserter.Equal(1, *persisted, "signed UPP persisted chain state")
+
+	//verify the UPPs, binary and base64 encoded
+	for _, upp := range [][]byte{signed.UPP, signedData.UPP} {
+		w = request(d, http.MethodPost, "/A/verify", testToken, "", upp)
+		requirer.Equal(http.StatusOK, w.Code, w.Body.String())
+		asserter.JSONEq(`{"verified": true}`, w.Body.String())
+		w = request(d, http.MethodPost, "/A/verify", testToken, "text/plain", []byte(base64.StdEncoding.EncodeToString(upp)))
+		requirer.Equal(http.StatusOK, w.Code, w.Body.String())
+		asserter.JSONEq(`{"verified": true}`, w.Body.String())
+	}
+
+	//UPPs of other identities are not verified
+	w = request(d, http.MethodPost, "/B/verify", "token of B", "", signed.UPP)
+	asserter.NotContains(w.Body.String(), `"verified":true`)
+
+	//invalid requests
+	w = request(d, http.MethodPost, "/A/hash", testToken, "", []byte("short"))
+	asserter.Equal(http.StatusBadRequest, w.Code)
+	w = request(d, http.MethodPost, "/A/hash?version=other", testToken, "", hash[:])
+	asserter.Equal(http.StatusBadRequest, w.Code)
+	w = request(d, http.MethodPost, "/A/data", testToken, "", make([]byte, maxRequestBodySize+1))
+	asserter.Equal(http.StatusBadRequest, w.Code)
+	w = request(d, http.MethodGet, "/A/hash", testToken, "", nil)
+	asserter.Equal(http.StatusNotFound, w.Code)
+	asserter.Equal(1, *persisted)
+}
+
+func TestDaemon_PersistFailure(t *testing.T) {
+	asserter := assert.New(t)
+	requirer := require.New(t)
+	d, _ := newTestDaemon(t)
+	hash := sha256.Sum256([]byte("data"))
+
+	w := request(d, http.MethodPost, "/A/hash", testToken, "", hash[:])
+	requirer.Equal(http.StatusOK, w.Code, w.Body.String())
+	chainHead, err := d.protocol.GetLastSignature(testName)
+	requirer.NoError(err)
+
+	//the UPP is not returned and the chain head is reset if the chain state can't be persisted
+	d.persist = func(p *ubirch.Protocol) error { return errors.New("disk full") }
+	w = request(d, http.MethodPost, "/A/hash", testToken, "", hash[:])
+	asserter.Equal(http.StatusInternalServerError, w.Code)
+	asserter.NotContains(w.Body.String(), "upp")
+	lastSignature, err := d.protocol.GetLastSignature(testName)
+	requirer.NoError(err)
+	asserter.Equal(chainHead, lastSignature, "chain head not reset")
+}
+
+func TestDaemon_KeystoreLocked(t *testing.T) {
+	asserter := assert.New(t)
+	d, persisted := newTestDaemon(t)
+	hash := sha256.Sum256([]byte("data"))
+
+	d.protocol.Crypto.(*ubirch.CryptoContext).Keystore.(*ubirch.EncryptedKeystore).Lock()
+	w := request(d, http.MethodPost, "/A/hash", testToken, "", hash[:])
+	asserter.Equal(http.StatusServiceUnavailable, w.Code)
+	asserter.Contains(w.Body.String(), "keystore is locked")
+	asserter.Equal(0, *persisted)
+}
+
+func TestDaemon_GracefulShutdown(t *testing.T) {
+	asserter := assert.New(t)
+	requirer := require.New(t)
+	d, _ := newTestDaemon(t)
+
+	//the first persist blocks the request until the shutdown started
+	persistCalls := 0
+	entered, release := make(chan struct{}), make(chan struct{})
+	d.persist = func(p *ubirch.Protocol) error {
+		persistCalls++
+		if persistCalls == 1 {
+			close(entered)
+			<-release
+		}
+		return nil
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	requirer.NoError(err)
+	stop := make(chan struct{})
+	served := make(chan error, 1)
+	go func() { served <- d.serve(listener, stop) }()
+
+	hash := sha256.Sum256([]byte("data"))
+	responses := make(chan *http.Response, 1)
+	go func() {
+		r, err := http.NewRequest(http.MethodPost, "http://"+listener.Addr().String()+"/A/hash", bytes.NewReader(hash[:]))
+		if err == nil {
+			r.Header.Set(authTokenHeader, testToken)
+			var resp *http.Response
+			resp, err = http.DefaultClient.Do(r)
+			if err == nil {
+				responses <- resp
+				return
+			}
+		}
+		t.Errorf("request failed: %v", err)
+		close(responses)
+	}()
+
+	<-entered
+	close(stop)
+	select {
+	case err = <-served:
+		t.Fatalf("daemon stopped before the active request was done: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+
+	resp, ok := <-responses
+	requirer.True(ok)
+	defer resp.Body.Close()
+	asserter.Equal(http.StatusOK, resp.StatusCode, "active request not completed")
+	select {
+	case err = <-served:
+		asserter.NoError(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("daemon did not stop")
+	}
+	asserter.Equal(2, persistCalls, "protocol context not persisted on shutdown")
+
+	//the daemon does not accept new requests
+	_, err = http.Post("http://"+listener.Addr().String()+"/A/hash", "", bytes.NewReader(hash[:]))
+	asserter.Error(err)
+}
+
+func TestSaveProtocolContext(t *testing.T) {
+	asserter := assert.New(t)
+	requirer := require.New(t)
+	d, _ := newTestDaemon(t)
+
+	dir, err := ioutil.TempDir("", "daemon_test")
+	requirer.NoError(err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, contextFile)
+
+	requirer.NoError(saveProtocolContext(d.protocol, filename))
+	info, err := os.Stat(filename)
+	requirer.NoError(err)
+	asserter.Equal(os.FileMode(0600), info.Mode().Perm())
+	saved, err := ioutil.ReadFile(filename)
+	requirer.NoError(err)
+
+	loaded := &ubirch.Protocol{
+		Crypto: &ubirch.CryptoContext{
+			Keystore: ubirch.NewEncryptedKeystore([]byte(testSecret)),
+			Names:    map[string]uuid.UUID{},
+		},
+		Signatures: map[uuid.UUID][]byte{},
+	}
+	requirer.NoError(loadProtocolContext(loaded, filename))
+	_, err = loaded.GetUUID(testName)
+	asserter.NoError(err)
+
+	//no temporary files are left behind
+	requirer.NoError(saveProtocolContext(d.protocol, filename))
+	files, err := ioutil.ReadDir(dir)
+	requirer.NoError(err)
+	requirer.Len(files, 1)
+	asserter.Equal(contextFile, files[0].Name(), "temporary file left behind")
+
+	//a failed save leaves the saved context untouched
+	requirer.NoError(os.Chmod(dir, 0500))
+	defer os.Chmod(dir, 0700)
+	if saveProtocolContext(d.protocol, filename) == nil {
+		t.Skip("directory is writable anyway, e.g. when running as root")
+	}
+	unchanged, err := ioutil.ReadFile(filename)
+	requirer.NoError(err)
+	asserter.Equal(saved, unchanged)
+}
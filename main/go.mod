@@ -1,9 +1,10 @@
-module main
+module github.com/ubirch/ubirch-protocol-go/main
 
 go 1.13
 
 require (
 	github.com/google/uuid v1.1.1
+	github.com/stretchr/testify v1.5.1
 	github.com/ubirch/go.crypto v0.1.2
 	github.com/ubirch/ubirch-protocol-go/ubirch/v2 v2.0.4
 )
@@ -21,19 +21,27 @@ package main
 import (
 	"encoding/hex"
 	"encoding/json"
+	"flag"
 	"io/ioutil"
 	"log"
 	"os"
-	"os/signal"
-	"syscall"
+	"path/filepath"
 
 	"github.com/google/uuid"
 	"github.com/ubirch/ubirch-protocol-go/ubirch/v2"
 )
 
-func saveProtocolContext(p *ubirch.Protocol) error {
-	contextBytes, _ := json.Marshal(p)
-	err := ioutil.WriteFile("protocol.json", contextBytes, 444)
+const (
+	contextFile = "protocol.json"
+	secretEnv   = "UBIRCH_SECRET" // the environment variable holding the keystore secret of the daemon
+	demoSecret  = "2234567890123456"
+)
+
+func saveProtocolContext(p *ubirch.Protocol, filename string) error {
+	contextBytes, err := json.Marshal(p)
+	if err == nil {
+		err = writeFileAtomic(filename, contextBytes, 0600)
+	}
 	if err != nil {
 		log.Printf("unable to store protocol context: %v", err)
 		return err
@@ -43,8 +51,34 @@ func saveProtocolContext(p *ubirch.Protocol) error {
 	}
 }
 
-func loadProtocolContext(p *ubirch.Protocol) error {
-	contextBytes, err := ioutil.ReadFile("protocol.json")
+// writeFileAtomic writes the data to a temporary file in the directory of the file and renames it,
+// so the file is either replaced completely or left untouched if writing fails
+func writeFileAtomic(filename string, data []byte, perm os.FileMode) error {
+	tmpFile, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmpName := tmpFile.Name()
+	defer os.Remove(tmpName) // fails after the rename
+
+	_, err = tmpFile.Write(data)
+	if err == nil {
+		err = tmpFile.Chmod(perm)
+	}
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpName, filename)
+}
+
+func loadProtocolContext(p *ubirch.Protocol, filename string) error {
+	contextBytes, err := ioutil.ReadFile(filename)
 	if err != nil {
 		return err
 	}
@@ -60,10 +94,23 @@ func loadProtocolContext(p *ubirch.Protocol) error {
 }
 
 func main() {
+	daemonMode := flag.Bool("daemon", false, "serve the identities of the protocol context via HTTP, the keystore secret is read from "+secretEnv)
+	addr := flag.String("addr", "localhost:10000", "address the daemon listens on")
+	tokensFile := flag.String("tokens", "tokens.json", "JSON file with the auth tokens of the identities for the daemon")
+	flag.Parse()
+
 	name := "A"
 
+	secret := demoSecret //this is only a demo code secret, the daemon requires a real secret
+	if *daemonMode {
+		secret = os.Getenv(secretEnv)
+		if len(secret) != 16 {
+			log.Fatalf("the daemon requires the 16 byte keystore secret in %s", secretEnv)
+		}
+	}
+
 	var context = &ubirch.CryptoContext{
-		Keystore: ubirch.NewEncryptedKeystore([]byte("2234567890123456")), //this is only a demo code secret, use a real secret here in your code
+		Keystore: ubirch.NewEncryptedKeystore([]byte(secret)),
 		Names:    map[string]uuid.UUID{},
 	}
 	p := ubirch.Protocol{
@@ -71,8 +118,11 @@ func main() {
 		Signatures: map[uuid.UUID][]byte{},
 	}
 
-	err := loadProtocolContext(&p)
+	err := loadProtocolContext(&p, contextFile)
 	if err != nil {
+		if *daemonMode {
+			log.Fatalf("unable to load protocol context: %v", err)
+		}
 		log.Printf("keystore not found, or unable to load: %v", err)
 		uid, _ := uuid.NewRandom()
 		err = p.GenerateKey(name, uid)
@@ -81,6 +131,18 @@ func main() {
 		}
 	}
 
+	if *daemonMode {
+		tokens, err := loadTokens(*tokensFile)
+		if err != nil {
+			log.Fatalf("unable to load auth tokens: %v", err)
+		}
+		err = runDaemon(&p, *addr, tokens, contextFile)
+		if err != nil {
+			log.Fatalf("daemon failed: %v", err)
+		}
+		return
+	}
+
 	data, _ := hex.DecodeString("010203040506070809FF")
 	encoded, err := p.SignData(name, data, ubirch.Chained)
 	if err != nil {
@@ -88,11 +150,5 @@ func main() {
 	}
 	log.Print(hex.EncodeToString(encoded))
 
-	go func() {
-		log.Println("Listening signals...")
-		c := make(chan os.Signal, 1) // we need to reserve to buffer size 1, so the notifier are not blocked
-		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-	}()
-
-	_ = saveProtocolContext(&p)
+	_ = saveProtocolContext(&p, contextFile)
 }
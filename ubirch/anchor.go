@@ -0,0 +1,180 @@
+/*
+ * Copyright (c) 2019 ubirch GmbH.
+ *
+ * ```
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * ```
+ */
+
+package ubirch
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+)
+
+// labels of the nodes of anchor paths returned by the verification service
+const (
+	AnchorLabelUPP         = "UPP"
+	AnchorLabelSlaveTree   = "SLAVE_TREE"
+	AnchorLabelMasterTree  = "MASTER_TREE"
+	AnchorLabelPublicChain = "PUBLIC_CHAIN"
+)
+
+// anchorLabelLevel orders the labels from the UPP up to the blockchain transaction
+var anchorLabelLevel = map[string]int{
+	AnchorLabelUPP:         0,
+	AnchorLabelSlaveTree:   1,
+	AnchorLabelMasterTree:  2,
+	AnchorLabelPublicChain: 3,
+}
+
+// AnchorNodeProperties are the properties of a node of an anchor path. Hashes of UPPs are base64 encoded,
+// hashes of trees and transactions usually hex encoded.
+type AnchorNodeProperties struct {
+	Hash      string `json:"hash"`                // the UPP payload, the tree hash or the transaction ID
+	NextHash  string `json:"next_hash,omitempty"` // the hash of the next node, if reported
+	PrevHash  string `json:"prev_hash,omitempty"` // the hash of the previous UPP or tree of the chain, if reported
+	Signature string `json:"signature,omitempty"` // the signature of a UPP
+	Timestamp string `json:"timestamp,omitempty"`
+
+	// properties of blockchain transactions (PUBLIC_CHAIN)
+	PublicChain string `json:"public_chain,omitempty"` // e.g. "ETHEREUM_MAINNET_ETHEREUM_MAINNET_NETWORK"
+	Message     string `json:"message,omitempty"`      // the anchored tree hash contained in the transaction
+	NetworkInfo string `json:"network_info,omitempty"`
+	NetworkType string `json:"network_type,omitempty"`
+}
+
+// AnchorNode is a node of an anchor path, e.g. a UPP, a foundation tree or a blockchain transaction
+type AnchorNode struct {
+	Label      string               `json:"label"`
+	Properties AnchorNodeProperties `json:"properties"`
+}
+
+// Anchors are the anchors of a UPP as returned by the verification service. The upper path leads from the
+// UPP through the foundation trees (SLAVE_TREE, MASTER_TREE) to the trees anchored in the blockchain
+// transactions of the upper blockchains.
+type Anchors struct {
+	UpperPath        []AnchorNode `json:"upper_path"`
+	UpperBlockchains []AnchorNode `json:"upper_blockchains"`
+}
+
+// ParseAnchors decodes the anchors of a verification response from JSON
+func ParseAnchors(data []byte) (*Anchors, error) {
+	var anchors Anchors
+	err := json.Unmarshal(data, &anchors)
+	if err != nil {
+		return nil, fmt.Errorf("decoding anchors failed: %v", err)
+	}
+	return &anchors, nil
+}
+
+// decodeAnchorHash decodes a hash of an anchor path, which is either hex or base64 encoded
+func decodeAnchorHash(s string) []byte {
+	if decoded, err := hex.DecodeString(s); err == nil {
+		return decoded
+	}
+	if decoded, err := base64.StdEncoding.DecodeString(s); err == nil {
+		return decoded
+	}
+	return []byte(s)
+}
+
+// anchorHashEqual compares two hashes of an anchor path independent of their encoding
+func anchorHashEqual(a, b string) bool {
+	return a != "" && (a == b || bytes.Equal(decodeAnchorHash(a), decodeAnchorHash(b)))
+}
+
+// nodeName returns the name of the node at the index of the path used in errors
+func nodeName(i int, node AnchorNode) string {
+	return fmt.Sprintf("%s %d", node.Label, i)
+}
+
+// CheckConsistency checks offline that the anchors reported for the UPP are consistent. The path has to
+// start with the UPP, its nodes have to lead up from the UPP through the foundation trees and every
+// reported next hash has to be the hash of the following node. Every blockchain transaction has to
+// anchor a tree of the path. Returns an AnchorLinkError for the first inconsistent link.
+//
+// This is a consistency check only, not a verification of the anchoring: the verification service does
+// not return the sibling hashes of the trees, so no hash link above the UPP can be recomputed, and a
+// consistent path made up by the service passes the check. Whether the transactions really are part of
+// the blockchains has to be checked separately as well.
+func (a *Anchors) CheckConsistency(upp []byte) error {
+	decoded, err := Decode(upp)
+	if err != nil {
+		return fmt.Errorf("decoding UPP failed: %w", err)
+	}
+	if len(a.UpperPath) == 0 {
+		return &AnchorLinkError{Link: 0, From: "UPP", To: "path", Reason: "empty path"}
+	}
+
+	first := a.UpperPath[0]
+	if first.Label != AnchorLabelUPP {
+		return &AnchorLinkError{Link: 0, From: "UPP", To: nodeName(0, first), Reason: "path does not start with the UPP"}
+	}
+	if !bytes.Equal(decodeAnchorHash(first.Properties.Hash), decoded.GetPayload()) {
+		return &AnchorLinkError{Link: 0, From: "UPP", To: nodeName(0, first), Reason: "hash is not the payload of the UPP"}
+	}
+	if first.Properties.Signature != "" && !bytes.Equal(decodeAnchorHash(first.Properties.Signature), decoded.GetSignature()) {
+		return &AnchorLinkError{Link: 0, From: "UPP", To: nodeName(0, first), Reason: "signature is not the signature of the UPP"}
+	}
+
+	trees := map[string]bool{}
+	for i := 1; i < len(a.UpperPath); i++ {
+		previous, node := a.UpperPath[i-1], a.UpperPath[i]
+		from, to := nodeName(i-1, previous), nodeName(i, node)
+		level, known := anchorLabelLevel[node.Label]
+		switch {
+		case !known:
+			return &AnchorLinkError{Link: i, From: from, To: to, Reason: "unknown node label"}
+		case level == 0 || level < anchorLabelLevel[previous.Label]:
+			return &AnchorLinkError{Link: i, From: from, To: to, Reason: "path does not lead up to the blockchain"}
+		case node.Properties.Hash == "":
+			return &AnchorLinkError{Link: i, From: from, To: to, Reason: "node without hash"}
+		case previous.Properties.NextHash != "" && !anchorHashEqual(previous.Properties.NextHash, node.Properties.Hash):
+			return &AnchorLinkError{Link: i, From: from, To: to, Reason: fmt.Sprintf("next hash %s != hash %s", previous.Properties.NextHash, node.Properties.Hash)}
+		}
+		if node.Label == AnchorLabelSlaveTree || node.Label == AnchorLabelMasterTree {
+			trees[string(decodeAnchorHash(node.Properties.Hash))] = true
+		}
+	}
+
+	last := nodeName(len(a.UpperPath)-1, a.UpperPath[len(a.UpperPath)-1])
+	if len(a.UpperBlockchains) == 0 {
+		return &AnchorLinkError{Link: len(a.UpperPath), From: last, To: AnchorLabelPublicChain, Reason: "not anchored in a blockchain"}
+	}
+	for _, tx := range a.UpperBlockchains {
+		to := fmt.Sprintf("%s %s", AnchorLabelPublicChain, tx.Properties.Hash)
+		if tx.Label != AnchorLabelPublicChain {
+			return &AnchorLinkError{Link: len(a.UpperPath), From: last, To: to, Reason: fmt.Sprintf("unexpected label %s", tx.Label)}
+		}
+		if !trees[string(decodeAnchorHash(tx.Properties.Message))] {
+			return &AnchorLinkError{Link: len(a.UpperPath), From: last, To: to, Reason: fmt.Sprintf("message %s is no tree of the path", tx.Properties.Message)}
+		}
+	}
+	return nil
+}
+
+// CheckAnchorConsistency decodes the anchors of a verification response from JSON and checks that they are
+// consistent for the UPP, see Anchors.CheckConsistency. The decoded anchors are returned even if they are
+// inconsistent.
+func CheckAnchorConsistency(upp []byte, anchorsJSON []byte) (*Anchors, error) {
+	anchors, err := ParseAnchors(anchorsJSON)
+	if err != nil {
+		return nil, err
+	}
+	return anchors, anchors.CheckConsistency(upp)
+}
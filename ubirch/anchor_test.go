@@ -0,0 +1,142 @@
+/*
+ * Copyright (c) 2019 ubirch GmbH.
+ *
+ * ```
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * ```
+ */
+
+package ubirch
+
+import (
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+//createAnchorsTestHelper creates valid anchors of the UPP with the given number of slave and master trees,
+//the last master tree is anchored in a blockchain transaction
+func createAnchorsTestHelper(t *testing.T, upp []byte, slaveTrees int, masterTrees int) *Anchors {
+	decoded, err := Decode(upp)
+	require.NoError(t, err)
+
+	anchors := &Anchors{UpperPath: []AnchorNode{{
+		Label: AnchorLabelUPP,
+		Properties: AnchorNodeProperties{
+			Hash:      base64.StdEncoding.EncodeToString(decoded.GetPayload()),
+			Signature: base64.StdEncoding.EncodeToString(decoded.GetSignature()),
+			Timestamp: "2021-03-18T11:54:12.341Z",
+		},
+	}}}
+	for i := 0; i < slaveTrees+masterTrees; i++ {
+		label := AnchorLabelSlaveTree
+		if i >= slaveTrees {
+			label = AnchorLabelMasterTree
+		}
+		hash := sha512.Sum512([]byte(fmt.Sprintf("tree %d", i)))
+		anchors.UpperPath[i].Properties.NextHash = hex.EncodeToString(hash[:])
+		anchors.UpperPath = append(anchors.UpperPath, AnchorNode{
+			Label:      label,
+			Properties: AnchorNodeProperties{Hash: hex.EncodeToString(hash[:])},
+		})
+	}
+	anchors.UpperBlockchains = []AnchorNode{{
+		Label: AnchorLabelPublicChain,
+		Properties: AnchorNodeProperties{
+			Hash:        "0x1234",
+			Message:     anchors.UpperPath[len(anchors.UpperPath)-1].Properties.Hash,
+			PublicChain: "ETHEREUM_MAINNET_ETHEREUM_MAINNET_NETWORK",
+			NetworkType: "mainnet",
+		},
+	}}
+	return anchors
+}
+
+func TestAnchors_CheckConsistency(t *testing.T) {
+	upp := mustDecodeHex(t, "9522c4106eac4d0b16e645088c4622e7451ea5a100c420"+defaultHash+"c440"+defaultLastSig)
+
+	for _, trees := range [][2]int{{0, 1}, {1, 1}, {2, 1}, {1, 3}} {
+		t.Run(fmt.Sprintf("%d slave trees, %d master trees", trees[0], trees[1]), func(t *testing.T) {
+			anchors := createAnchorsTestHelper(t, upp, trees[0], trees[1])
+			assert.NoError(t, anchors.CheckConsistency(upp))
+
+			//JSON round trip
+			anchorsJSON, err := json.Marshal(anchors)
+			require.NoError(t, err)
+			parsed, err := CheckAnchorConsistency(upp, anchorsJSON)
+			require.NoError(t, err)
+			assert.Equal(t, anchors, parsed)
+
+			//next hashes are optional
+			for i := range anchors.UpperPath {
+				anchors.UpperPath[i].Properties.NextHash = ""
+			}
+			assert.NoError(t, anchors.CheckConsistency(upp))
+		})
+	}
+}
+
+func TestAnchors_CheckConsistency_Fails(t *testing.T) {
+	upp := mustDecodeHex(t, "9522c4106eac4d0b16e645088c4622e7451ea5a100c420"+defaultHash+"c440"+defaultLastSig)
+	otherHash := sha512.Sum512([]byte("other"))
+
+	var tests = []struct {
+		testName string
+		modify   func(anchors *Anchors)
+		link     int
+		from     string
+		to       string
+	}{
+		{"empty path", func(a *Anchors) { a.UpperPath = nil }, 0, "UPP", "path"},
+		{"path without UPP", func(a *Anchors) { a.UpperPath = a.UpperPath[1:] }, 0, "UPP", "SLAVE_TREE 0"},
+		{"other UPP", func(a *Anchors) { a.UpperPath[0].Properties.Hash = base64.StdEncoding.EncodeToString(otherHash[:]) }, 0, "UPP", "UPP 0"},
+		{"other signature", func(a *Anchors) { a.UpperPath[0].Properties.Signature = hex.EncodeToString(otherHash[:]) }, 0, "UPP", "UPP 0"},
+		{"wrong next hash", func(a *Anchors) { a.UpperPath[1].Properties.NextHash = hex.EncodeToString(otherHash[:]) }, 2, "SLAVE_TREE 1", "MASTER_TREE 2"},
+		{"missing tree", func(a *Anchors) { a.UpperPath = append(a.UpperPath[:1], a.UpperPath[2:]...) }, 1, "UPP 0", "MASTER_TREE 1"},
+		{"tree without hash", func(a *Anchors) { a.UpperPath[2].Properties.Hash = "" }, 2, "SLAVE_TREE 1", "MASTER_TREE 2"},
+		{"unknown label", func(a *Anchors) { a.UpperPath[1].Label = "OTHER_TREE" }, 1, "UPP 0", "OTHER_TREE 1"},
+		{"trees in wrong order", func(a *Anchors) { a.UpperPath[1].Label, a.UpperPath[2].Label = AnchorLabelMasterTree, AnchorLabelSlaveTree }, 2, "MASTER_TREE 1", "SLAVE_TREE 2"},
+		{"second UPP", func(a *Anchors) { a.UpperPath[1].Label = AnchorLabelUPP }, 1, "UPP 0", "UPP 1"},
+		{"not anchored", func(a *Anchors) { a.UpperBlockchains = nil }, 3, "MASTER_TREE 2", "PUBLIC_CHAIN"},
+		{"wrong transaction message", func(a *Anchors) { a.UpperBlockchains[0].Properties.Message = hex.EncodeToString(otherHash[:]) }, 3, "MASTER_TREE 2", "PUBLIC_CHAIN 0x1234"},
+		{"wrong transaction label", func(a *Anchors) { a.UpperBlockchains[0].Label = AnchorLabelMasterTree }, 3, "MASTER_TREE 2", "PUBLIC_CHAIN 0x1234"},
+	}
+
+	for _, currTest := range tests {
+		t.Run(currTest.testName, func(t *testing.T) {
+			anchors := createAnchorsTestHelper(t, upp, 1, 1)
+			currTest.modify(anchors)
+
+			err := anchors.CheckConsistency(upp)
+			assert.True(t, errors.Is(err, ErrBrokenAnchorPath))
+			var linkErr *AnchorLinkError
+			require.True(t, errors.As(err, &linkErr), "unexpected error: %v", err)
+			assert.Equal(t, currTest.link, linkErr.Link)
+			assert.Equal(t, currTest.from, linkErr.From)
+			assert.Equal(t, currTest.to, linkErr.To)
+		})
+	}
+
+	assert.Error(t, createAnchorsTestHelper(t, upp, 1, 1).CheckConsistency(nil))
+	_, err := CheckAnchorConsistency(upp, []byte(`{"upper_path": "no path"}`))
+	assert.Error(t, err)
+	_, err = CheckAnchorConsistency(upp, []byte(`{`))
+	assert.Error(t, err)
+}
@@ -0,0 +1,111 @@
+/*
+ * Copyright (c) 2019 ubirch GmbH.
+ *
+ * ```
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * ```
+ */
+
+// Package backend implements clients for the ubirch backend services: the key service, which manages
+// the public keys of identities, the ingestion endpoint (niomon), which accepts UPPs, and the
+// verification endpoint, which looks up anchored hashes.
+package backend
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// Environment is a ubirch backend environment
+type Environment string
+
+const (
+	Dev  Environment = "dev"
+	Demo Environment = "demo"
+	Prod Environment = "prod"
+)
+
+const (
+	keyServiceURLTemplate = "https://identity.%s.ubirch.com/api/keyService/v1/pubkey"
+	niomonURLTemplate     = "https://niomon.%s.ubirch.com/"
+	verifyURLTemplate     = "https://verify.%s.ubirch.com/api/upp/verify/anchor"
+)
+
+// URLs contains the base URLs of the backend services of an environment
+type URLs struct {
+	KeyService string
+	Niomon     string
+	Verify     string
+}
+
+// EnvironmentURLs returns the base URLs of the backend services of the given environment
+func EnvironmentURLs(env Environment) (URLs, error) {
+	switch env {
+	case Dev, Demo, Prod:
+		return URLs{
+			KeyService: fmt.Sprintf(keyServiceURLTemplate, env),
+			Niomon:     fmt.Sprintf(niomonURLTemplate, env),
+			Verify:     fmt.Sprintf(verifyURLTemplate, env),
+		}, nil
+	default:
+		return URLs{}, fmt.Errorf("%w: %q", ErrUnknownEnvironment, env)
+	}
+}
+
+// response is the status and body of an HTTP response
+type response struct {
+	StatusCode int
+	Body       []byte
+}
+
+// doRequest sends a request with the given method, headers and body and reads the response.
+// The request is canceled, when the context is done.
+func doRequest(ctx context.Context, client *http.Client, method string, url string, header map[string]string, body []byte) (*response, error) {
+	var bodyReader io.Reader
+	if body != nil {
+		bodyReader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, bodyReader)
+	if err != nil {
+		return nil, fmt.Errorf("can't create %s request to %s: %v", method, url, err)
+	}
+	for key, value := range header {
+		req.Header.Set(key, value)
+	}
+
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%s request to %s failed: %w", method, url, err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading response of %s request to %s failed: %w", method, url, err)
+	}
+	return &response{StatusCode: resp.StatusCode, Body: respBody}, nil
+}
+
+// checkStatus returns an HTTPError, if the status code of the response is not 2xx
+func (r *response) checkStatus(method string, url string) error {
+	if r.StatusCode >= 200 && r.StatusCode < 300 {
+		return nil
+	}
+	return &HTTPError{Method: method, URL: url, StatusCode: r.StatusCode, Body: r.Body}
+}
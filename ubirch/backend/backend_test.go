@@ -0,0 +1,140 @@
+/*
+ * Copyright (c) 2019 ubirch GmbH.
+ *
+ * ```
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * ```
+ */
+
+package backend
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/ubirch/ubirch-protocol-go/ubirch/v2"
+)
+
+const testSecret = "2234567890123456"
+
+//newTestProtocol creates a protocol with a freshly generated key for the given name and UUID
+func newTestProtocol(t *testing.T, name string, id uuid.UUID) *ubirch.Protocol {
+	p := &ubirch.Protocol{
+		Crypto: &ubirch.CryptoContext{
+			Keystore: ubirch.NewEncryptedKeystore([]byte(testSecret)),
+			Names:    map[string]uuid.UUID{},
+		},
+		Signatures: map[uuid.UUID][]byte{},
+	}
+	require.NoError(t, p.GenerateKey(name, id))
+	return p
+}
+
+//verifyRaw verifies a raw ECDSA P-256 signature (R||S) of the data with a raw public key (X||Y)
+func verifyRaw(pubKey []byte, data []byte, signature []byte) bool {
+	if len(pubKey) != 64 || len(signature) != 64 {
+		return false
+	}
+	pub := &ecdsa.PublicKey{
+		Curve: elliptic.P256(),
+		X:     new(big.Int).SetBytes(pubKey[:32]),
+		Y:     new(big.Int).SetBytes(pubKey[32:]),
+	}
+	hash := sha256.Sum256(data)
+	return ecdsa.Verify(pub, hash[:], new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:]))
+}
+
+//mustHash returns the SHA256 hash of the data
+func mustHash(data string) []byte {
+	hash := sha256.Sum256([]byte(data))
+	return hash[:]
+}
+
+func TestEnvironmentURLs(t *testing.T) {
+	asserter := assert.New(t)
+
+	for _, env := range []Environment{Dev, Demo, Prod} {
+		urls, err := EnvironmentURLs(env)
+		require.NoError(t, err)
+		asserter.Equal("https://identity."+string(env)+".ubirch.com/api/keyService/v1/pubkey", urls.KeyService)
+		asserter.Equal("https://niomon."+string(env)+".ubirch.com/", urls.Niomon)
+		asserter.Equal("https://verify."+string(env)+".ubirch.com/api/upp/verify/anchor", urls.Verify)
+	}
+
+	_, err := EnvironmentURLs("staging")
+	asserter.True(errors.Is(err, ErrUnknownEnvironment))
+	_, err = NewKeyServiceClient("")
+	asserter.True(errors.Is(err, ErrUnknownEnvironment))
+}
+
+func TestHTTPError(t *testing.T) {
+	var tests = []struct {
+		statusCode int
+		sentinel   error
+	}{
+		{http.StatusNotFound, ErrNotFound},
+		{http.StatusUnauthorized, ErrUnauthorized},
+		{http.StatusForbidden, ErrUnauthorized},
+		{http.StatusConflict, ErrConflict},
+		{http.StatusBadRequest, ErrBadRequest},
+		{http.StatusInternalServerError, ErrServer},
+		{http.StatusServiceUnavailable, ErrServer},
+	}
+	sentinels := []error{ErrNotFound, ErrUnauthorized, ErrConflict, ErrBadRequest, ErrServer}
+
+	for _, currTest := range tests {
+		t.Run(http.StatusText(currTest.statusCode), func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "error message", currTest.statusCode)
+			}))
+			defer server.Close()
+
+			client := &KeyServiceClient{URL: server.URL}
+			_, err := client.GetPublicKeys(context.Background(), uuid.New())
+			var httpErr *HTTPError
+			require.True(t, errors.As(err, &httpErr))
+			assert.Equal(t, currTest.statusCode, httpErr.StatusCode)
+			assert.Contains(t, err.Error(), "error message")
+			for _, sentinel := range sentinels {
+				assert.Equal(t, sentinel == currTest.sentinel, errors.Is(err, sentinel), "errors.Is(%v)", sentinel)
+			}
+		})
+	}
+}
+
+func TestDoRequest_ContextTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	client := &KeyServiceClient{URL: server.URL}
+	_, err := client.GetPublicKeys(ctx, uuid.New())
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "unexpected error: %v", err)
+}
@@ -0,0 +1,73 @@
+/*
+ * Copyright (c) 2019 ubirch GmbH.
+ *
+ * ```
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * ```
+ */
+
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Sentinel errors of the backend package, HTTPErrors can be checked against them with errors.Is
+var (
+	ErrUnknownEnvironment = errors.New("unknown environment")
+	ErrNotFound           = errors.New("not found")
+	ErrUnauthorized       = errors.New("unauthorized")
+	ErrConflict           = errors.New("conflict")
+	ErrBadRequest         = errors.New("bad request")
+	ErrServer             = errors.New("server error")
+	ErrInvalidResponse    = errors.New("invalid response")
+	ErrUnverifiedResponse = errors.New("response UPP not verifiable")
+)
+
+// maxErrorBodyLength is the maximum number of bytes of the response body included in the error message
+const maxErrorBodyLength = 256
+
+// HTTPError is returned if a backend service responds with an unexpected HTTP status
+type HTTPError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Body       []byte
+}
+
+func (e *HTTPError) Error() string {
+	body := e.Body
+	if len(body) > maxErrorBodyLength {
+		body = body[:maxErrorBodyLength]
+	}
+	return fmt.Sprintf("%s request to %s failed: %d %s: %q", e.Method, e.URL, e.StatusCode, http.StatusText(e.StatusCode), body)
+}
+
+// Is reports whether the target is the sentinel error matching the status code
+func (e *HTTPError) Is(target error) bool {
+	switch target {
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound
+	case ErrUnauthorized:
+		return e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden
+	case ErrConflict:
+		return e.StatusCode == http.StatusConflict
+	case ErrBadRequest:
+		return e.StatusCode == http.StatusBadRequest
+	case ErrServer:
+		return e.StatusCode >= 500
+	}
+	return false
+}
@@ -0,0 +1,286 @@
+/*
+ * Copyright (c) 2019 ubirch GmbH.
+ *
+ * ```
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * ```
+ */
+
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ubirch/ubirch-protocol-go/ubirch/v2"
+)
+
+// DefaultKeyValidity is the validity period of keys registered with NewKeyRegistration
+const DefaultKeyValidity = 10 * 365 * 24 * time.Hour
+
+const contentTypeJSON = "application/json"
+
+// PublicKeyInfo describes a public key of an identity registered at the key service
+type PublicKeyInfo struct {
+	Algorithm      string    `json:"algorithm"`
+	Created        time.Time `json:"created"`
+	HwDeviceId     uuid.UUID `json:"hwDeviceId"`
+	PubKey         []byte    `json:"pubKey"`
+	PubKeyId       []byte    `json:"pubKeyId"`
+	PrevPubKeyId   []byte    `json:"prevPubKeyId,omitempty"`
+	ValidNotAfter  time.Time `json:"validNotAfter"`
+	ValidNotBefore time.Time `json:"validNotBefore"`
+}
+
+// KeyRegistration is a public key info signed with the private key of the public key. A key update
+// additionally contains the previous public key and is signed with the previous private key as well.
+type KeyRegistration struct {
+	PubKeyInfo    PublicKeyInfo `json:"pubKeyInfo"`
+	Signature     []byte        `json:"signature"`
+	PrevSignature []byte        `json:"prevSignature,omitempty"`
+}
+
+// KeyDeletion is a public key signed with its private key, which requests the deletion of the key
+type KeyDeletion struct {
+	PublicKey []byte `json:"publicKey"`
+	Signature []byte `json:"signature"`
+}
+
+// newPublicKeyInfo creates the public key info of the identity with the given name
+func newPublicKeyInfo(p *ubirch.Protocol, name string) (id uuid.UUID, info PublicKeyInfo, err error) {
+	id, err = p.GetUUID(name)
+	if err != nil {
+		return uuid.Nil, PublicKeyInfo{}, err
+	}
+	pubKey, err := p.GetPublicKey(name)
+	if err != nil {
+		return uuid.Nil, PublicKeyInfo{}, err
+	}
+
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	return id, PublicKeyInfo{
+		Algorithm:      string(ubirch.ECDSAP256),
+		Created:        now,
+		HwDeviceId:     id,
+		PubKey:         pubKey,
+		PubKeyId:       pubKey,
+		ValidNotAfter:  now.Add(DefaultKeyValidity),
+		ValidNotBefore: now,
+	}, nil
+}
+
+// NewKeyRegistration creates a key registration of the public key of the identity with the given name,
+// signed with its private key. The key is valid for DefaultKeyValidity from now on.
+func NewKeyRegistration(p *ubirch.Protocol, name string) (*KeyRegistration, error) {
+	id, info, err := newPublicKeyInfo(p, name)
+	if err != nil {
+		return nil, err
+	}
+	infoBytes, err := json.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := p.Crypto.Sign(id, infoBytes)
+	if err != nil {
+		return nil, fmt.Errorf("signing key registration failed: %w", err)
+	}
+	return &KeyRegistration{PubKeyInfo: info, Signature: signature}, nil
+}
+
+// NewKeyUpdate creates a key update, which replaces the previous public key of the identity with the
+// current public key of the identity with the given name. The update is signed with the current private
+// key and, using signPrevious, with the private key of the previous public key.
+func NewKeyUpdate(p *ubirch.Protocol, name string, prevPubKey []byte, signPrevious func(data []byte) ([]byte, error)) (*KeyRegistration, error) {
+	id, info, err := newPublicKeyInfo(p, name)
+	if err != nil {
+		return nil, err
+	}
+	info.PrevPubKeyId = prevPubKey
+	infoBytes, err := json.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := p.Crypto.Sign(id, infoBytes)
+	if err != nil {
+		return nil, fmt.Errorf("signing key update failed: %w", err)
+	}
+	prevSignature, err := signPrevious(infoBytes)
+	if err != nil {
+		return nil, fmt.Errorf("signing key update with previous key failed: %w", err)
+	}
+	return &KeyRegistration{PubKeyInfo: info, Signature: signature, PrevSignature: prevSignature}, nil
+}
+
+// NewKeyDeletion creates a request to delete the public key of the identity with the given name,
+// signed with its private key
+func NewKeyDeletion(p *ubirch.Protocol, name string) (*KeyDeletion, error) {
+	id, err := p.GetUUID(name)
+	if err != nil {
+		return nil, err
+	}
+	pubKey, err := p.GetPublicKey(name)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := p.Crypto.Sign(id, pubKey)
+	if err != nil {
+		return nil, fmt.Errorf("signing key deletion failed: %w", err)
+	}
+	return &KeyDeletion{PublicKey: pubKey, Signature: signature}, nil
+}
+
+// KeyServiceClient is a client of the ubirch key service
+type KeyServiceClient struct {
+	URL        string       // the base URL of the key service, e.g. "https://identity.prod.ubirch.com/api/keyService/v1/pubkey"
+	HTTPClient *http.Client // the HTTP client used for the requests, http.DefaultClient if nil
+}
+
+// NewKeyServiceClient returns a client of the key service of the given environment
+func NewKeyServiceClient(env Environment) (*KeyServiceClient, error) {
+	urls, err := EnvironmentURLs(env)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyServiceClient{URL: urls.KeyService}, nil
+}
+
+// sendJSON sends the JSON encoding of the value and returns the response, if its status is 2xx
+func (c *KeyServiceClient) sendJSON(ctx context.Context, method string, url string, value interface{}) (*response, error) {
+	body, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	header := map[string]string{"Content-Type": contentTypeJSON, "Accept": contentTypeJSON}
+	resp, err := doRequest(ctx, c.HTTPClient, method, url, header, body)
+	if err != nil {
+		return nil, err
+	}
+	return resp, resp.checkStatus(method, url)
+}
+
+// RegisterKey uploads a key registration to the key service
+func (c *KeyServiceClient) RegisterKey(ctx context.Context, registration *KeyRegistration) error {
+	if registration == nil || len(registration.Signature) == 0 {
+		return fmt.Errorf("key registration is not signed")
+	}
+	_, err := c.sendJSON(ctx, http.MethodPost, c.URL, registration)
+	return err
+}
+
+// UpdateKey uploads a key update to the key service
+func (c *KeyServiceClient) UpdateKey(ctx context.Context, update *KeyRegistration) error {
+	if update == nil || len(update.Signature) == 0 || len(update.PrevSignature) == 0 {
+		return fmt.Errorf("key update is not signed with the current and the previous key")
+	}
+	if len(update.PubKeyInfo.PrevPubKeyId) == 0 {
+		return fmt.Errorf("key update does not contain the previous public key")
+	}
+	_, err := c.sendJSON(ctx, http.MethodPost, c.URL, update)
+	return err
+}
+
+// GetPublicKeys returns the current public keys of the UUID. Only keys of registrations, which are
+// signed with the private key of the public key, are returned. Returns an error wrapping ErrNotFound,
+// if there is no public key for the UUID, or ErrInvalidResponse, if none of the keys is valid.
+func (c *KeyServiceClient) GetPublicKeys(ctx context.Context, id uuid.UUID) ([]PublicKeyInfo, error) {
+	url := fmt.Sprintf("%s/current/hardwareId/%s", c.URL, id)
+	resp, err := doRequest(ctx, c.HTTPClient, http.MethodGet, url, map[string]string{"Accept": contentTypeJSON}, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = resp.checkStatus(http.MethodGet, url)
+	if err != nil {
+		return nil, err
+	}
+
+	var registrations []signedPublicKeyInfo
+	err = json.Unmarshal(resp.Body, &registrations)
+	if err != nil {
+		return nil, fmt.Errorf("decoding public keys of %s failed: %v", id, err)
+	}
+	if len(registrations) == 0 {
+		return nil, fmt.Errorf("%w: no public key for %s", ErrNotFound, id)
+	}
+
+	// only return keys which are self-signed registrations of the UUID
+	infos := make([]PublicKeyInfo, 0, len(registrations))
+	var invalid []string
+	for i, registration := range registrations {
+		info, err := registration.verify(id)
+		if err != nil {
+			invalid = append(invalid, fmt.Sprintf("key %d: %v", i, err))
+			continue
+		}
+		infos = append(infos, info)
+	}
+	if len(infos) == 0 {
+		return nil, fmt.Errorf("%w: no valid public key for %s: %s", ErrInvalidResponse, id, strings.Join(invalid, "; "))
+	}
+	return infos, nil
+}
+
+// signedPublicKeyInfo is a key registration as returned by the key service. The public key info is kept
+// as received, as the signature was created over its JSON encoding.
+type signedPublicKeyInfo struct {
+	PubKeyInfo json.RawMessage `json:"pubKeyInfo"`
+	Signature  []byte          `json:"signature"`
+}
+
+// verify decodes the public key info and checks that it belongs to the UUID and is signed with the
+// private key of its public key. The signature is checked over the public key info as received and as
+// encoded by this package.
+func (r signedPublicKeyInfo) verify(id uuid.UUID) (PublicKeyInfo, error) {
+	var info PublicKeyInfo
+	err := json.Unmarshal(r.PubKeyInfo, &info)
+	if err != nil {
+		return PublicKeyInfo{}, fmt.Errorf("decoding public key info failed: %v", err)
+	}
+	if info.HwDeviceId != id {
+		return PublicKeyInfo{}, fmt.Errorf("public key of %s", info.HwDeviceId)
+	}
+
+	var received bytes.Buffer
+	err = json.Compact(&received, r.PubKeyInfo)
+	if err != nil {
+		return PublicKeyInfo{}, err
+	}
+	encoded, err := json.Marshal(info)
+	if err != nil {
+		return PublicKeyInfo{}, err
+	}
+	for _, data := range [][]byte{received.Bytes(), encoded} {
+		verified, err := ubirch.VerifySignatureWithPublicKey(info.PubKey, ubirch.FormatRaw, data, r.Signature)
+		if err != nil {
+			return PublicKeyInfo{}, err
+		}
+		if verified {
+			return info, nil
+		}
+	}
+	return PublicKeyInfo{}, fmt.Errorf("self-signature not verifiable")
+}
+
+// DeleteKey requests the deletion of a public key from the key service
+func (c *KeyServiceClient) DeleteKey(ctx context.Context, deletion *KeyDeletion) error {
+	if deletion == nil || len(deletion.Signature) == 0 {
+		return fmt.Errorf("key deletion is not signed")
+	}
+	_, err := c.sendJSON(ctx, http.MethodDelete, c.URL, deletion)
+	return err
+}
@@ -0,0 +1,242 @@
+/*
+ * Copyright (c) 2019 ubirch GmbH.
+ *
+ * ```
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * ```
+ */
+
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+//fakeKeyService is a stand-in of the key service API, which checks the signatures of the requests
+type fakeKeyService struct {
+	sync.Mutex
+	keys map[uuid.UUID][]KeyRegistration
+}
+
+func (s *fakeKeyService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/pubkey":
+		var registration KeyRegistration
+		if json.NewDecoder(r.Body).Decode(&registration) != nil {
+			http.Error(w, "invalid registration", http.StatusBadRequest)
+			return
+		}
+		info, _ := json.Marshal(registration.PubKeyInfo)
+		if !verifyRaw(registration.PubKeyInfo.PubKey, info, registration.Signature) {
+			http.Error(w, "invalid signature", http.StatusBadRequest)
+			return
+		}
+		id := registration.PubKeyInfo.HwDeviceId
+		current := s.keys[id]
+		if registration.PubKeyInfo.PrevPubKeyId != nil {
+			if len(current) == 0 || !bytes.Equal(current[0].PubKeyInfo.PubKey, registration.PubKeyInfo.PrevPubKeyId) ||
+				!verifyRaw(registration.PubKeyInfo.PrevPubKeyId, info, registration.PrevSignature) {
+				http.Error(w, "invalid key update", http.StatusBadRequest)
+				return
+			}
+		} else if len(current) != 0 {
+			http.Error(w, "key exists", http.StatusConflict)
+			return
+		}
+		s.keys[id] = []KeyRegistration{registration}
+		w.WriteHeader(http.StatusOK)
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/pubkey/current/hardwareId/"):
+		id, err := uuid.Parse(strings.TrimPrefix(r.URL.Path, "/pubkey/current/hardwareId/"))
+		if err != nil {
+			http.Error(w, "invalid uuid", http.StatusBadRequest)
+			return
+		}
+		registrations := s.keys[id]
+		if registrations == nil {
+			registrations = []KeyRegistration{}
+		}
+		_ = json.NewEncoder(w).Encode(registrations)
+	case r.Method == http.MethodDelete && r.URL.Path == "/pubkey":
+		var deletion KeyDeletion
+		if json.NewDecoder(r.Body).Decode(&deletion) != nil || !verifyRaw(deletion.PublicKey, deletion.PublicKey, deletion.Signature) {
+			http.Error(w, "invalid deletion", http.StatusBadRequest)
+			return
+		}
+		for id, registrations := range s.keys {
+			if bytes.Equal(registrations[0].PubKeyInfo.PubKey, deletion.PublicKey) {
+				delete(s.keys, id)
+				return
+			}
+		}
+		http.Error(w, "key not found", http.StatusNotFound)
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+func newFakeKeyService(t *testing.T) *KeyServiceClient {
+	server := httptest.NewServer(&fakeKeyService{keys: map[uuid.UUID][]KeyRegistration{}})
+	t.Cleanup(server.Close)
+	return &KeyServiceClient{URL: server.URL + "/pubkey", HTTPClient: server.Client()}
+}
+
+func TestKeyServiceClient(t *testing.T) {
+	asserter := assert.New(t)
+	requirer := require.New(t)
+	ctx := context.Background()
+
+	client := newFakeKeyService(t)
+	id := uuid.New()
+	p := newTestProtocol(t, "A", id)
+	pubKey, err := p.GetPublicKey("A")
+	requirer.NoError(err)
+
+	_, err = client.GetPublicKeys(ctx, id)
+	asserter.True(errors.Is(err, ErrNotFound))
+
+	registration, err := NewKeyRegistration(p, "A")
+	requirer.NoError(err)
+	requirer.NoError(client.RegisterKey(ctx, registration))
+	err = client.RegisterKey(ctx, registration)
+	asserter.True(errors.Is(err, ErrConflict), "registering a key twice: %v", err)
+
+	keys, err := client.GetPublicKeys(ctx, id)
+	requirer.NoError(err)
+	requirer.Len(keys, 1)
+	asserter.Equal(pubKey, keys[0].PubKey)
+	asserter.Equal(id, keys[0].HwDeviceId)
+	asserter.True(keys[0].ValidNotAfter.After(keys[0].ValidNotBefore))
+
+	//replace the key with a new key of the same UUID
+	newP := newTestProtocol(t, "A", id)
+	newPubKey, err := newP.GetPublicKey("A")
+	requirer.NoError(err)
+	signPrevious := func(data []byte) ([]byte, error) { return p.Crypto.Sign(id, data) }
+	update, err := NewKeyUpdate(newP, "A", pubKey, signPrevious)
+	requirer.NoError(err)
+	requirer.NoError(client.UpdateKey(ctx, update))
+	keys, err = client.GetPublicKeys(ctx, id)
+	requirer.NoError(err)
+	requirer.Len(keys, 1)
+	asserter.Equal(newPubKey, keys[0].PubKey)
+	asserter.Equal(pubKey, keys[0].PrevPubKeyId)
+
+	//the previous key can't be used anymore
+	update, err = NewKeyUpdate(p, "A", pubKey, signPrevious)
+	requirer.NoError(err)
+	err = client.UpdateKey(ctx, update)
+	asserter.True(errors.Is(err, ErrBadRequest), "update with replaced key: %v", err)
+	update.PrevSignature = nil
+	asserter.Error(client.UpdateKey(ctx, update))
+
+	deletion, err := NewKeyDeletion(p, "A")
+	requirer.NoError(err)
+	err = client.DeleteKey(ctx, deletion)
+	asserter.True(errors.Is(err, ErrNotFound), "deleting replaced key: %v", err)
+	deletion, err = NewKeyDeletion(newP, "A")
+	requirer.NoError(err)
+	requirer.NoError(client.DeleteKey(ctx, deletion))
+	_, err = client.GetPublicKeys(ctx, id)
+	asserter.True(errors.Is(err, ErrNotFound))
+}
+
+//TestKeyServiceClient_GetPublicKeysVerifies tests that only self-signed keys of the UUID are returned
+func TestKeyServiceClient_GetPublicKeysVerifies(t *testing.T) {
+	asserter := assert.New(t)
+	requirer := require.New(t)
+	ctx := context.Background()
+
+	id := uuid.New()
+	valid, err := NewKeyRegistration(newTestProtocol(t, "A", id), "A")
+	requirer.NoError(err)
+	other, err := NewKeyRegistration(newTestProtocol(t, "A", uuid.New()), "A")
+	requirer.NoError(err)
+	tampered, err := NewKeyRegistration(newTestProtocol(t, "A", id), "A")
+	requirer.NoError(err)
+	tampered.PubKeyInfo.PubKey = valid.PubKeyInfo.PubKey
+	unsigned, err := NewKeyRegistration(newTestProtocol(t, "A", id), "A")
+	requirer.NoError(err)
+	unsigned.Signature = nil
+
+	var registrations []*KeyRegistration
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(registrations)
+	}))
+	defer server.Close()
+	client := &KeyServiceClient{URL: server.URL, HTTPClient: server.Client()}
+
+	registrations = []*KeyRegistration{tampered, other, unsigned, valid}
+	keys, err := client.GetPublicKeys(ctx, id)
+	requirer.NoError(err)
+	requirer.Len(keys, 1, "invalid keys returned")
+	asserter.Equal(valid.PubKeyInfo.PubKey, keys[0].PubKey)
+
+	registrations = []*KeyRegistration{tampered, other, unsigned}
+	_, err = client.GetPublicKeys(ctx, id)
+	asserter.True(errors.Is(err, ErrInvalidResponse), "unexpected error: %v", err)
+}
+
+func TestKeyServiceClient_Fails(t *testing.T) {
+	asserter := assert.New(t)
+	requirer := require.New(t)
+	ctx := context.Background()
+
+	client := newFakeKeyService(t)
+	p := newTestProtocol(t, "A", uuid.New())
+
+	_, err := NewKeyRegistration(p, "unknown")
+	asserter.Error(err)
+	_, err = NewKeyDeletion(p, "unknown")
+	asserter.Error(err)
+	_, err = NewKeyUpdate(p, "A", make([]byte, 64), func([]byte) ([]byte, error) { return nil, errors.New("no key") })
+	asserter.Error(err)
+
+	asserter.Error(client.RegisterKey(ctx, nil))
+	asserter.Error(client.RegisterKey(ctx, &KeyRegistration{}))
+	asserter.Error(client.UpdateKey(ctx, &KeyRegistration{Signature: []byte{1}}))
+	asserter.Error(client.DeleteKey(ctx, &KeyDeletion{}))
+
+	//manipulated registration
+	registration, err := NewKeyRegistration(p, "A")
+	requirer.NoError(err)
+	registration.PubKeyInfo.ValidNotAfter = registration.PubKeyInfo.ValidNotAfter.Add(1)
+	err = client.RegisterKey(ctx, registration)
+	asserter.True(errors.Is(err, ErrBadRequest), "manipulated registration accepted: %v", err)
+
+	//invalid response
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("no json"))
+	}))
+	defer server.Close()
+	_, err = (&KeyServiceClient{URL: server.URL}).GetPublicKeys(ctx, uuid.New())
+	asserter.Error(err)
+
+	//connection refused
+	server.Close()
+	asserter.Error((&KeyServiceClient{URL: server.URL}).RegisterKey(ctx, registration))
+}
@@ -0,0 +1,486 @@
+/*
+ * Copyright (c) 2019 ubirch GmbH.
+ *
+ * ```
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * ```
+ */
+
+// Package mock implements an in-process mock of the ubirch backend for integration tests. It offers the
+// key service, the ingestion endpoint (niomon) and the verification endpoint with the API expected by the
+// clients of the backend package. Failures can be injected per endpoint.
+//
+// In tests, the backend is served with httptest:
+//
+//	b, _ := mock.New()
+//	server := httptest.NewServer(b)
+//	urls := b.URLs(server.URL)
+package mock
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ubirch/ubirch-protocol-go/ubirch/v2"
+	"github.com/ubirch/ubirch-protocol-go/ubirch/v2/backend"
+)
+
+const (
+	KeyServicePath = "/api/keyService/v1/pubkey"
+	NiomonPath     = "/"
+	VerifyPath     = "/api/upp/verify/anchor"
+
+	currentKeyPathPrefix = KeyServicePath + "/current/hardwareId/"
+	backendName          = "backend"
+)
+
+const (
+	headerHardwareId = "X-Ubirch-Hardware-Id"
+	headerCredential = "X-Ubirch-Credential"
+)
+
+// DefaultTimeoutDelay is the maximum time requests hang with FaultTimeout, if Backend.TimeoutDelay is not set
+const DefaultTimeoutDelay = time.Minute
+
+// Endpoint is an endpoint of the mock backend
+type Endpoint int
+
+const (
+	KeyService Endpoint = iota + 1
+	Niomon
+	Verify
+)
+
+// Fault is a failure which can be injected into the requests to an endpoint
+type Fault int
+
+const (
+	FaultConflict     Fault = iota + 1 // respond with 409 Conflict, e.g. a chain conflict at the ingestion endpoint
+	FaultUnauthorized                  // respond with 401 Unauthorized
+	FaultServerError                   // respond with 503 Service Unavailable
+	FaultTimeout                       // don't respond until the client gives up or TimeoutDelay passed
+)
+
+// storedUPP is a UPP accepted by the ingestion endpoint
+type storedUPP struct {
+	upp    []byte
+	prev   []byte
+	anchor *ubirch.Anchors
+}
+
+// Backend is a mock of the ubirch backend. It implements http.Handler.
+type Backend struct {
+	// AllowAnyToken disables the check of the auth tokens at the ingestion endpoint
+	AllowAnyToken bool
+	// TimeoutDelay is the maximum time requests hang with FaultTimeout, DefaultTimeoutDelay if zero
+	TimeoutDelay time.Duration
+
+	mutex     sync.Mutex
+	protocol  *ubirch.Protocol // signs the response UPPs and contains the registered public keys
+	backendID uuid.UUID
+	keys      map[uuid.UUID]backend.KeyRegistration
+	tokens    map[uuid.UUID]string
+	lastUPPs  map[uuid.UUID][]byte // the last accepted chained UPP per UUID
+	upps      map[string]*storedUPP
+	faults    map[Endpoint][]Fault
+}
+
+// ensure Backend implements the http.Handler interface
+var _ http.Handler = (*Backend)(nil)
+
+// newProtocol creates a protocol with a keystore encrypted with a random secret
+func newProtocol() (*ubirch.Protocol, error) {
+	secret := make([]byte, 16)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return nil, err
+	}
+	return &ubirch.Protocol{
+		Crypto: &ubirch.CryptoContext{
+			Keystore: ubirch.NewEncryptedKeystore(secret),
+			Names:    map[string]uuid.UUID{},
+		},
+		Signatures: map[uuid.UUID][]byte{},
+	}, nil
+}
+
+// New creates a mock backend with a freshly generated key for signing response UPPs
+func New() (*Backend, error) {
+	p, err := newProtocol()
+	if err != nil {
+		return nil, err
+	}
+	backendID := uuid.New()
+	err = p.GenerateKey(backendName, backendID)
+	if err != nil {
+		return nil, err
+	}
+	return &Backend{
+		protocol:  p,
+		backendID: backendID,
+		keys:      map[uuid.UUID]backend.KeyRegistration{},
+		tokens:    map[uuid.UUID]string{},
+		lastUPPs:  map[uuid.UUID][]byte{},
+		upps:      map[string]*storedUPP{},
+		faults:    map[Endpoint][]Fault{},
+	}, nil
+}
+
+// PublicKey returns the public key of the backend, which signs the response UPPs
+func (b *Backend) PublicKey() []byte {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	pubKey, _ := b.protocol.GetPublicKey(backendName)
+	return pubKey
+}
+
+// URLs returns the URLs of the endpoints, if the backend is served at the given base URL
+func (b *Backend) URLs(baseURL string) backend.URLs {
+	baseURL = strings.TrimSuffix(baseURL, "/")
+	return backend.URLs{
+		KeyService: baseURL + KeyServicePath,
+		Niomon:     baseURL + NiomonPath,
+		Verify:     baseURL + VerifyPath,
+	}
+}
+
+// SetAuthToken sets the auth token of the UUID, which is required to submit UPPs
+func (b *Backend) SetAuthToken(id uuid.UUID, authToken string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.tokens[id] = authToken
+}
+
+// InjectFault injects a fault into the next count requests to the endpoint. Faults are applied in the
+// order they were injected.
+func (b *Backend) InjectFault(endpoint Endpoint, fault Fault, count int) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for i := 0; i < count; i++ {
+		b.faults[endpoint] = append(b.faults[endpoint], fault)
+	}
+}
+
+// applyFault applies the next injected fault of the endpoint, returns true if the request was answered
+func (b *Backend) applyFault(w http.ResponseWriter, r *http.Request, endpoint Endpoint) bool {
+	b.mutex.Lock()
+	faults := b.faults[endpoint]
+	if len(faults) == 0 {
+		b.mutex.Unlock()
+		return false
+	}
+	fault := faults[0]
+	b.faults[endpoint] = faults[1:]
+	delay := b.TimeoutDelay
+	b.mutex.Unlock()
+
+	switch fault {
+	case FaultConflict:
+		http.Error(w, "injected conflict", http.StatusConflict)
+	case FaultUnauthorized:
+		http.Error(w, "injected unauthorized", http.StatusUnauthorized)
+	case FaultServerError:
+		http.Error(w, "injected server error", http.StatusServiceUnavailable)
+	case FaultTimeout:
+		if delay == 0 {
+			delay = DefaultTimeoutDelay
+		}
+		// the server only notices that the client gave up, after the request body was read
+		_, _ = io.Copy(io.Discard, r.Body)
+		select {
+		case <-r.Context().Done():
+		case <-time.After(delay):
+			http.Error(w, "injected timeout", http.StatusGatewayTimeout)
+		}
+	}
+	return true
+}
+
+// ServeHTTP implements the http.Handler interface
+func (b *Backend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == KeyServicePath && (r.Method == http.MethodPost || r.Method == http.MethodDelete):
+		if !b.applyFault(w, r, KeyService) {
+			b.handleKeyService(w, r)
+		}
+	case strings.HasPrefix(r.URL.Path, currentKeyPathPrefix) && r.Method == http.MethodGet:
+		if !b.applyFault(w, r, KeyService) {
+			b.handleGetKeys(w, r)
+		}
+	case r.URL.Path == NiomonPath && r.Method == http.MethodPost:
+		if !b.applyFault(w, r, Niomon) {
+			b.handleNiomon(w, r)
+		}
+	case r.URL.Path == VerifyPath && r.Method == http.MethodPost:
+		if !b.applyFault(w, r, Verify) {
+			b.handleVerify(w, r)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// verifySignature verifies a signature of the data with a raw public key
+func verifySignature(pubKey []byte, data []byte, signature []byte) bool {
+	verified, err := ubirch.VerifySignatureWithPublicKey(pubKey, ubirch.FormatRaw, data, signature)
+	return err == nil && verified
+}
+
+// handleKeyService registers, updates (POST) and deletes (DELETE) public keys
+func (b *Backend) handleKeyService(w http.ResponseWriter, r *http.Request) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if r.Method == http.MethodDelete {
+		var deletion backend.KeyDeletion
+		if json.NewDecoder(r.Body).Decode(&deletion) != nil {
+			http.Error(w, "invalid key deletion", http.StatusBadRequest)
+			return
+		}
+		for id, registration := range b.keys {
+			if bytes.Equal(registration.PubKeyInfo.PubKey, deletion.PublicKey) {
+				if !verifySignature(deletion.PublicKey, deletion.PublicKey, deletion.Signature) {
+					http.Error(w, "invalid signature", http.StatusBadRequest)
+					return
+				}
+				delete(b.keys, id)
+				_ = b.protocol.DeleteIdentity(id.String())
+				return
+			}
+		}
+		http.Error(w, "public key not found", http.StatusNotFound)
+		return
+	}
+
+	var registration backend.KeyRegistration
+	if json.NewDecoder(r.Body).Decode(&registration) != nil {
+		http.Error(w, "invalid key registration", http.StatusBadRequest)
+		return
+	}
+	info, err := json.Marshal(registration.PubKeyInfo)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	id := registration.PubKeyInfo.HwDeviceId
+	if !verifySignature(registration.PubKeyInfo.PubKey, info, registration.Signature) {
+		http.Error(w, "invalid signature", http.StatusBadRequest)
+		return
+	}
+
+	current, found := b.keys[id]
+	if registration.PubKeyInfo.PrevPubKeyId != nil {
+		if !found || !bytes.Equal(current.PubKeyInfo.PubKey, registration.PubKeyInfo.PrevPubKeyId) {
+			http.Error(w, "previous public key is not the current public key", http.StatusBadRequest)
+			return
+		}
+		if !verifySignature(registration.PubKeyInfo.PrevPubKeyId, info, registration.PrevSignature) {
+			http.Error(w, "invalid signature of previous key", http.StatusBadRequest)
+			return
+		}
+	} else if found {
+		http.Error(w, "public key already registered", http.StatusConflict)
+		return
+	}
+
+	err = b.protocol.SetPublicKey(id.String(), id, registration.PubKeyInfo.PubKey)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	b.keys[id] = registration
+}
+
+// handleGetKeys returns the current public key of a UUID
+func (b *Backend) handleGetKeys(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(strings.TrimPrefix(r.URL.Path, currentKeyPathPrefix))
+	if err != nil {
+		http.Error(w, "invalid UUID", http.StatusBadRequest)
+		return
+	}
+
+	b.mutex.Lock()
+	registrations := []backend.KeyRegistration{}
+	if registration, found := b.keys[id]; found {
+		registrations = append(registrations, registration)
+	}
+	b.mutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(registrations)
+}
+
+// handleNiomon verifies a submitted UPP, enforces the chaining of chained UPPs and answers with a
+// chained UPP of the backend, which is linked to the submitted UPP
+func (b *Backend) handleNiomon(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(r.Header.Get(headerHardwareId))
+	if err != nil {
+		http.Error(w, "invalid hardware ID", http.StatusBadRequest)
+		return
+	}
+	upp, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	token, err := base64.StdEncoding.DecodeString(r.Header.Get(headerCredential))
+	expectedToken, found := b.tokens[id]
+	if !b.AllowAnyToken && (err != nil || !found || string(token) != expectedToken) {
+		http.Error(w, "invalid auth token", http.StatusUnauthorized)
+		return
+	}
+
+	decoded, err := ubirch.Decode(upp)
+	if err != nil || decoded.GetUuid() != id {
+		http.Error(w, "invalid UPP", http.StatusBadRequest)
+		return
+	}
+	if _, found := b.keys[id]; !found {
+		http.Error(w, "no public key for UUID", http.StatusBadRequest)
+		return
+	}
+	verified, err := b.protocol.Verify(id.String(), upp)
+	if err != nil || !verified {
+		http.Error(w, "invalid signature", http.StatusBadRequest)
+		return
+	}
+	if _, found := b.upps[string(decoded.GetPayload())]; found {
+		http.Error(w, "hash already exists", http.StatusConflict)
+		return
+	}
+
+	var prev []byte
+	if decoded.GetVersion() == ubirch.Chained {
+		prev = b.lastUPPs[id]
+		expectedPrevSignature := make([]byte, len(decoded.GetPrevSignature()))
+		if prev != nil {
+			prevDecoded, err := ubirch.Decode(prev)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			expectedPrevSignature = prevDecoded.GetSignature()
+		}
+		if !bytes.Equal(decoded.GetPrevSignature(), expectedPrevSignature) {
+			http.Error(w, "chain conflict: previous signature is not the signature of the last UPP", http.StatusConflict)
+			return
+		}
+	}
+
+	err = b.protocol.SetLastSignatureByUUID(b.backendID, decoded.GetSignature())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	uppHash := sha256.Sum256(upp)
+	response, err := b.protocol.SignHash(backendName, uppHash[:], ubirch.Chained)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	b.upps[string(decoded.GetPayload())] = &storedUPP{upp: upp, prev: prev, anchor: anchor(upp)}
+	if decoded.GetVersion() == ubirch.Chained {
+		b.lastUPPs[id] = upp
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	_, _ = w.Write(response)
+}
+
+// anchor creates the anchors of a UPP in a fake blockchain transaction, in the format of the verification service
+func anchor(upp []byte) *ubirch.Anchors {
+	decoded, err := ubirch.Decode(upp)
+	if err != nil {
+		return nil
+	}
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	treeHash := func() string {
+		hash := make([]byte, sha512.Size)
+		_, _ = rand.Read(hash)
+		return hex.EncodeToString(hash)
+	}
+	slaveTree, masterTree := treeHash(), treeHash()
+	txID := make([]byte, 32)
+	_, _ = rand.Read(txID)
+
+	return &ubirch.Anchors{
+		UpperPath: []ubirch.AnchorNode{
+			{Label: ubirch.AnchorLabelUPP, Properties: ubirch.AnchorNodeProperties{
+				Hash:      base64.StdEncoding.EncodeToString(decoded.GetPayload()),
+				Signature: base64.StdEncoding.EncodeToString(decoded.GetSignature()),
+				NextHash:  slaveTree,
+				Timestamp: now,
+			}},
+			{Label: ubirch.AnchorLabelSlaveTree, Properties: ubirch.AnchorNodeProperties{Hash: slaveTree, NextHash: masterTree, Timestamp: now}},
+			{Label: ubirch.AnchorLabelMasterTree, Properties: ubirch.AnchorNodeProperties{Hash: masterTree, Timestamp: now}},
+		},
+		UpperBlockchains: []ubirch.AnchorNode{
+			{Label: ubirch.AnchorLabelPublicChain, Properties: ubirch.AnchorNodeProperties{
+				Hash:        fmt.Sprintf("0x%x", txID),
+				Message:     masterTree,
+				PublicChain: "MOCK_MOCKNET_MOCK_NETWORK",
+				NetworkInfo: "Mock Network",
+				NetworkType: "mocknet",
+				Timestamp:   now,
+			}},
+		},
+	}
+}
+
+// verificationResponse is the response of the verification endpoint
+type verificationResponse struct {
+	UPP     []byte          `json:"upp"`
+	Prev    []byte          `json:"prev,omitempty"`
+	Anchors *ubirch.Anchors `json:"anchors"`
+}
+
+// handleVerify looks up the UPP of a hash
+func (b *Backend) handleVerify(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	hash, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(body)))
+	if err != nil {
+		http.Error(w, "invalid hash", http.StatusBadRequest)
+		return
+	}
+
+	b.mutex.Lock()
+	stored, found := b.upps[string(hash)]
+	b.mutex.Unlock()
+	if !found {
+		http.Error(w, "hash not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(verificationResponse{UPP: stored.upp, Prev: stored.prev, Anchors: stored.anchor})
+}
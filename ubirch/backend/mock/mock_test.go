@@ -0,0 +1,274 @@
+/*
+ * Copyright (c) 2019 ubirch GmbH.
+ *
+ * ```
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * ```
+ */
+
+package mock
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/ubirch/ubirch-protocol-go/ubirch/v2"
+	"github.com/ubirch/ubirch-protocol-go/ubirch/v2/backend"
+)
+
+const testAuthToken = "2b2c7e0a-4f0d-4c8e-8a3c-6a7b5f3e2d1c"
+
+//clients contains the clients of all endpoints of a mock backend
+type clients struct {
+	keys   *backend.KeyServiceClient
+	niomon *backend.UPPClient
+	verify *backend.VerificationClient
+}
+
+//newMockTestHelper starts a mock backend and returns it together with clients of its endpoints
+func newMockTestHelper(t *testing.T) (*Backend, *clients) {
+	b, err := New()
+	require.NoError(t, err)
+	server := httptest.NewServer(b)
+	t.Cleanup(server.Close)
+
+	urls := b.URLs(server.URL)
+	keys := &backend.KeyServiceClient{URL: urls.KeyService}
+	return b, &clients{
+		keys:   keys,
+		niomon: &backend.UPPClient{URL: urls.Niomon, BackendPublicKey: b.PublicKey(), Backoff: time.Millisecond},
+		verify: &backend.VerificationClient{URL: urls.Verify, Keys: keys},
+	}
+}
+
+//newDeviceTestHelper creates a protocol with a registered identity "device"
+func newDeviceTestHelper(t *testing.T, b *Backend, c *clients) (*ubirch.Protocol, uuid.UUID) {
+	p, err := newProtocol()
+	require.NoError(t, err)
+	id := uuid.New()
+	require.NoError(t, p.GenerateKey("device", id))
+	registration, err := backend.NewKeyRegistration(p, "device")
+	require.NoError(t, err)
+	require.NoError(t, c.keys.RegisterKey(context.Background(), registration))
+	b.SetAuthToken(id, testAuthToken)
+	return p, id
+}
+
+func TestBackend(t *testing.T) {
+	asserter := assert.New(t)
+	requirer := require.New(t)
+	ctx := context.Background()
+
+	b, c := newMockTestHelper(t)
+	device, id := newDeviceTestHelper(t, b, c)
+
+	keys, err := c.keys.GetPublicKeys(ctx, id)
+	requirer.NoError(err)
+	requirer.Len(keys, 1)
+
+	var upps [][]byte
+	for i := 0; i < 3; i++ {
+		hash := sha256.Sum256([]byte{byte(i)})
+		submission, err := c.niomon.SignAndSubmit(ctx, device, "device", hash[:], testAuthToken)
+		requirer.NoError(err)
+		requirer.Equal(backend.Accepted, submission.Result)
+
+		result, err := c.verify.VerifyHash(ctx, hash[:])
+		requirer.NoError(err)
+		asserter.Equal(id, result.UUID)
+		if i > 0 {
+			asserter.Equal(upps[i-1], result.PreviousUPP)
+		}
+		_, err = result.CheckAnchorConsistency()
+		asserter.NoError(err, "invalid anchors")
+		upps = append(upps, result.UPP)
+	}
+	requirer.NoError(device.VerifyChain("device", upps))
+
+	//signed UPPs are not part of the chain
+	hash := sha256.Sum256([]byte("signed"))
+	upp, err := device.SignHash("device", hash[:], ubirch.Signed)
+	requirer.NoError(err)
+	submission, err := c.niomon.Submit(ctx, id, testAuthToken, upp)
+	requirer.NoError(err)
+	asserter.Equal(backend.Accepted, submission.Result)
+	result, err := c.verify.VerifyHash(ctx, hash[:])
+	requirer.NoError(err)
+	asserter.Nil(result.PreviousUPP)
+
+	_, err = c.verify.VerifyHash(ctx, make([]byte, sha256.Size))
+	asserter.True(errors.Is(err, backend.ErrNotFound))
+
+	//deleted keys can't be used anymore
+	deletion, err := backend.NewKeyDeletion(device, "device")
+	requirer.NoError(err)
+	requirer.NoError(c.keys.DeleteKey(ctx, deletion))
+	_, err = c.keys.GetPublicKeys(ctx, id)
+	asserter.True(errors.Is(err, backend.ErrNotFound))
+	asserter.True(errors.Is(c.keys.DeleteKey(ctx, deletion), backend.ErrNotFound))
+	submission, err = c.niomon.SignAndSubmit(ctx, device, "device", hash[:], testAuthToken)
+	requirer.NoError(err)
+	asserter.Equal(backend.Rejected, submission.Result)
+}
+
+func TestBackend_KeyUpdate(t *testing.T) {
+	requirer := require.New(t)
+	ctx := context.Background()
+
+	b, c := newMockTestHelper(t)
+	device, id := newDeviceTestHelper(t, b, c)
+	registration, err := backend.NewKeyRegistration(device, "device")
+	requirer.NoError(err)
+	requirer.True(errors.Is(c.keys.RegisterKey(ctx, registration), backend.ErrConflict))
+
+	//replace the key, UPPs of the old key are rejected afterwards
+	newDevice, err := newProtocol()
+	requirer.NoError(err)
+	requirer.NoError(newDevice.GenerateKey("device", id))
+	update, err := backend.NewKeyUpdate(newDevice, "device", registration.PubKeyInfo.PubKey,
+		func(data []byte) ([]byte, error) { return device.Crypto.Sign(id, data) })
+	requirer.NoError(err)
+	requirer.NoError(c.keys.UpdateKey(ctx, update))
+	requirer.True(errors.Is(c.keys.UpdateKey(ctx, update), backend.ErrBadRequest), "update of replaced key accepted")
+
+	submission, err := c.niomon.SignAndSubmit(ctx, device, "device", make([]byte, sha256.Size), testAuthToken)
+	requirer.NoError(err)
+	requirer.Equal(backend.Rejected, submission.Result)
+	submission, err = c.niomon.SignAndSubmit(ctx, newDevice, "device", make([]byte, sha256.Size), testAuthToken)
+	requirer.NoError(err)
+	requirer.Equal(backend.Accepted, submission.Result)
+}
+
+func TestBackend_Niomon_Fails(t *testing.T) {
+	asserter := assert.New(t)
+	requirer := require.New(t)
+	ctx := context.Background()
+
+	b, c := newMockTestHelper(t)
+	device, id := newDeviceTestHelper(t, b, c)
+	hash := sha256.Sum256([]byte("data"))
+
+	submission, err := c.niomon.SignAndSubmit(ctx, device, "device", hash[:], "wrong token")
+	requirer.NoError(err)
+	asserter.Equal(backend.Unauthorized, submission.Result)
+
+	submission, err = c.niomon.SignAndSubmit(ctx, device, "device", hash[:], testAuthToken)
+	requirer.NoError(err)
+	asserter.Equal(backend.Accepted, submission.Result)
+	submission, err = c.niomon.SignAndSubmit(ctx, device, "device", hash[:], testAuthToken)
+	requirer.NoError(err)
+	asserter.Equal(backend.Duplicate, submission.Result)
+	asserter.Equal(http.StatusConflict, submission.StatusCode)
+
+	//the local chain head advanced without submitting the UPP: chain conflict
+	_, err = device.SignHash("device", make([]byte, sha256.Size), ubirch.Chained)
+	requirer.NoError(err)
+	otherHash := sha256.Sum256([]byte("other data"))
+	upp, err := device.SignHash("device", otherHash[:], ubirch.Chained)
+	requirer.NoError(err)
+	submission, err = c.niomon.Submit(ctx, id, testAuthToken, upp)
+	requirer.NoError(err)
+	asserter.Equal(http.StatusConflict, submission.StatusCode)
+	asserter.Contains(string(submission.Body), "chain conflict")
+
+	//unregistered identity
+	unknown, err := newProtocol()
+	requirer.NoError(err)
+	unknownID := uuid.New()
+	requirer.NoError(unknown.GenerateKey("unknown", unknownID))
+	b.AllowAnyToken = true
+	submission, err = c.niomon.SignAndSubmit(ctx, unknown, "unknown", hash[:], "any token")
+	requirer.NoError(err)
+	asserter.Equal(backend.Rejected, submission.Result)
+}
+
+func TestBackend_InjectFault(t *testing.T) {
+	ctx := context.Background()
+
+	var tests = []struct {
+		testName string
+		endpoint Endpoint
+		fault    Fault
+		count    int
+		check    func(t *testing.T, c *clients, device *ubirch.Protocol, id uuid.UUID)
+	}{
+		{"niomon conflict", Niomon, FaultConflict, 1, func(t *testing.T, c *clients, device *ubirch.Protocol, id uuid.UUID) {
+			submission, err := c.niomon.SignAndSubmit(ctx, device, "device", make([]byte, sha256.Size), testAuthToken)
+			require.NoError(t, err)
+			assert.Equal(t, backend.Duplicate, submission.Result)
+		}},
+		{"niomon unauthorized", Niomon, FaultUnauthorized, 1, func(t *testing.T, c *clients, device *ubirch.Protocol, id uuid.UUID) {
+			submission, err := c.niomon.SignAndSubmit(ctx, device, "device", make([]byte, sha256.Size), testAuthToken)
+			require.NoError(t, err)
+			assert.Equal(t, backend.Unauthorized, submission.Result)
+		}},
+		{"niomon server errors", Niomon, FaultServerError, 2, func(t *testing.T, c *clients, device *ubirch.Protocol, id uuid.UUID) {
+			_, err := c.niomon.SignAndSubmit(ctx, device, "device", make([]byte, sha256.Size), testAuthToken)
+			assert.True(t, errors.Is(err, backend.ErrServer), "unexpected error: %v", err)
+			c.niomon.Retries = 2
+			submission, err := c.niomon.SignAndSubmit(ctx, device, "device", make([]byte, sha256.Size), testAuthToken)
+			require.NoError(t, err)
+			assert.Equal(t, backend.Accepted, submission.Result)
+		}},
+		{"niomon timeout", Niomon, FaultTimeout, 1, func(t *testing.T, c *clients, device *ubirch.Protocol, id uuid.UUID) {
+			ctxTimeout, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+			defer cancel()
+			_, err := c.niomon.SignAndSubmit(ctxTimeout, device, "device", make([]byte, sha256.Size), testAuthToken)
+			assert.True(t, errors.Is(err, context.DeadlineExceeded), "unexpected error: %v", err)
+		}},
+		{"key service unauthorized", KeyService, FaultUnauthorized, 1, func(t *testing.T, c *clients, device *ubirch.Protocol, id uuid.UUID) {
+			_, err := c.keys.GetPublicKeys(ctx, id)
+			assert.True(t, errors.Is(err, backend.ErrUnauthorized), "unexpected error: %v", err)
+		}},
+		{"verify server error", Verify, FaultServerError, 1, func(t *testing.T, c *clients, device *ubirch.Protocol, id uuid.UUID) {
+			_, err := c.verify.VerifyHash(ctx, make([]byte, sha256.Size))
+			assert.True(t, errors.Is(err, backend.ErrServer), "unexpected error: %v", err)
+		}},
+	}
+
+	for _, currTest := range tests {
+		t.Run(currTest.testName, func(t *testing.T) {
+			b, c := newMockTestHelper(t)
+			device, id := newDeviceTestHelper(t, b, c)
+			lastSignature, err := device.GetLastSignature("device")
+			require.NoError(t, err)
+
+			b.InjectFault(currTest.endpoint, currTest.fault, currTest.count)
+			currTest.check(t, c, device, id)
+
+			//the faults are used up, the chain head only advanced if the UPP was accepted
+			currentSignature, err := device.GetLastSignature("device")
+			require.NoError(t, err)
+			submission, err := c.niomon.SignAndSubmit(ctx, device, "device", mustHash(currTest.testName), testAuthToken)
+			require.NoError(t, err)
+			assert.Equal(t, backend.Accepted, submission.Result)
+			if currTest.testName != "niomon server errors" {
+				assert.Equal(t, lastSignature, currentSignature)
+			}
+		})
+	}
+}
+
+//mustHash returns the SHA256 hash of the data
+func mustHash(data string) []byte {
+	hash := sha256.Sum256([]byte(data))
+	return hash[:]
+}
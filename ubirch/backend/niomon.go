@@ -0,0 +1,240 @@
+/*
+ * Copyright (c) 2019 ubirch GmbH.
+ *
+ * ```
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * ```
+ */
+
+package backend
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ubirch/ubirch-protocol-go/ubirch/v2"
+)
+
+const (
+	DefaultRetries = 3           // default number of retries of a failed UPP submission
+	DefaultBackoff = time.Second // default delay before the first retry, doubled with every retry
+)
+
+const (
+	headerHardwareId   = "X-Ubirch-Hardware-Id"
+	headerAuthType     = "X-Ubirch-Auth-Type"
+	headerCredential   = "X-Ubirch-Credential"
+	authTypeUbirch     = "ubirch"
+	contentTypeMsgpack = "application/msgpack"
+)
+
+// SubmissionResult is the outcome of a UPP submission
+type SubmissionResult int
+
+const (
+	Accepted     SubmissionResult = iota + 1 // the UPP was accepted by the backend
+	Duplicate                                // the backend already knows the hash of the UPP
+	Rejected                                 // the UPP was rejected as invalid
+	Unauthorized                             // the authentication of the identity failed
+)
+
+// String returns the name of the submission result
+func (r SubmissionResult) String() string {
+	switch r {
+	case Accepted:
+		return "accepted"
+	case Duplicate:
+		return "duplicate"
+	case Rejected:
+		return "rejected"
+	case Unauthorized:
+		return "unauthorized"
+	default:
+		return fmt.Sprintf("SubmissionResult(%d)", int(r))
+	}
+}
+
+// SubmissionResponse is the response of the backend to a UPP submission
+type SubmissionResponse struct {
+	Result      SubmissionResult
+	StatusCode  int
+	Body        []byte     // the response body, the response UPP if the UPP was accepted
+	ResponseUPP ubirch.UPP // the verified response UPP, only set if the UPP was accepted and the response verified
+	Retried     bool       // true if the UPP was sent more than once, a Duplicate then may be the UPP itself
+}
+
+// Stored returns true, if the submitted UPP is known to be stored by the backend. This is the case if
+// it was accepted, or if it is reported as duplicate after a retry, as a previous attempt may have been
+// stored although its response was lost.
+func (s *SubmissionResponse) Stored() bool {
+	return s != nil && (s.Result == Accepted || s.Result == Duplicate && s.Retried)
+}
+
+// UPPClient is a client of the ubirch ingestion endpoint (niomon)
+type UPPClient struct {
+	URL              string        // the URL of the ingestion endpoint, e.g. "https://niomon.prod.ubirch.com/"
+	HTTPClient       *http.Client  // the HTTP client used for the requests, http.DefaultClient if nil
+	BackendPublicKey []byte        // the public key of the backend to verify response UPPs (raw, PEM or DER)
+	Retries          int           // number of retries after network errors and server errors
+	Backoff          time.Duration // delay before the first retry, doubled with every retry
+}
+
+// NewUPPClient returns a client of the ingestion endpoint of the given environment. Response UPPs
+// are verified with the given public key of the backend, which is required.
+func NewUPPClient(env Environment, backendPublicKey []byte) (*UPPClient, error) {
+	urls, err := EnvironmentURLs(env)
+	if err != nil {
+		return nil, err
+	}
+	if len(backendPublicKey) == 0 {
+		return nil, fmt.Errorf("no backend public key to verify response UPPs")
+	}
+	return &UPPClient{
+		URL:              urls.Niomon,
+		BackendPublicKey: backendPublicKey,
+		Retries:          DefaultRetries,
+		Backoff:          DefaultBackoff,
+	}, nil
+}
+
+// retryable returns true, if a request with the given response status should be retried
+func retryable(statusCode int) bool {
+	return statusCode >= 500 || statusCode == http.StatusTooManyRequests
+}
+
+// Submit sends the UPP of the given UUID to the backend, authenticated with the auth token of the identity.
+// Requests which fail due to network or server errors are retried with exponential backoff. If the UPP is
+// accepted, the signature of the response UPP is verified with the public key of the backend. If this
+// fails, the submission response is returned together with an error wrapping ErrUnverifiedResponse, as
+// the UPP has been stored by the backend nevertheless.
+func (c *UPPClient) Submit(ctx context.Context, id uuid.UUID, authToken string, upp []byte) (*SubmissionResponse, error) {
+	header := map[string]string{
+		headerHardwareId: id.String(),
+		headerAuthType:   authTypeUbirch,
+		headerCredential: base64.StdEncoding.EncodeToString([]byte(authToken)),
+		"Content-Type":   contentTypeMsgpack,
+	}
+
+	backoff := c.Backoff
+	var resp *response
+	var err error
+	attempt := 0
+	for ; ; attempt++ {
+		resp, err = doRequest(ctx, c.HTTPClient, http.MethodPost, c.URL, header, upp)
+		if err == nil && !retryable(resp.StatusCode) {
+			break
+		}
+		if err == nil {
+			err = resp.checkStatus(http.MethodPost, c.URL)
+		}
+		if attempt >= c.Retries || ctx.Err() != nil {
+			return nil, fmt.Errorf("submitting UPP of %s failed after %d attempts: %w", id, attempt+1, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("submitting UPP of %s failed: %w", id, ctx.Err())
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+
+	submission := &SubmissionResponse{StatusCode: resp.StatusCode, Body: resp.Body, Retried: attempt > 0}
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		submission.Result = Accepted
+	case resp.StatusCode == http.StatusConflict:
+		submission.Result = Duplicate
+		return submission, nil
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		submission.Result = Unauthorized
+		return submission, nil
+	case resp.StatusCode >= 400 && resp.StatusCode < 500:
+		submission.Result = Rejected
+		return submission, nil
+	default:
+		return nil, resp.checkStatus(http.MethodPost, c.URL)
+	}
+
+	submission.ResponseUPP, err = c.verifyResponse(upp, resp.Body)
+	if err != nil {
+		return submission, fmt.Errorf("%w for UPP of %s: %v", ErrUnverifiedResponse, id, err)
+	}
+	return submission, nil
+}
+
+// verifyResponse verifies the signature of the response UPP with the public key of the backend. A chained
+// response UPP must be linked to the submitted UPP.
+func (c *UPPClient) verifyResponse(upp []byte, responseUPP []byte) (ubirch.UPP, error) {
+	if len(c.BackendPublicKey) == 0 {
+		return nil, fmt.Errorf("no backend public key to verify the response UPP")
+	}
+	verified, err := ubirch.VerifyUPPWithPublicKey(responseUPP, c.BackendPublicKey, ubirch.FormatAuto)
+	if err != nil {
+		return nil, err
+	}
+	if !verified {
+		return nil, fmt.Errorf("signature of response UPP not verifiable with backend public key")
+	}
+
+	decodedResponse, err := ubirch.Decode(responseUPP)
+	if err != nil {
+		return nil, err
+	}
+	if decodedResponse.GetVersion() == ubirch.Chained {
+		decodedRequest, err := ubirch.Decode(upp)
+		if err != nil {
+			return nil, err
+		}
+		linked, err := ubirch.CheckChainLink(decodedRequest, decodedResponse)
+		if err != nil {
+			return nil, err
+		}
+		if !linked {
+			return nil, fmt.Errorf("response UPP not linked to submitted UPP")
+		}
+	}
+	return decodedResponse, nil
+}
+
+// SubmitPending submits a UPP prepared with Protocol.PrepareSignHash. The chain head advances, if the UPP
+// was stored by the backend (see SubmissionResponse.Stored), also if the response UPP is not verifiable.
+// Otherwise the UPP is rolled back.
+func (c *UPPClient) SubmitPending(ctx context.Context, p *ubirch.Protocol, pending *ubirch.PendingUPP, authToken string) (*SubmissionResponse, error) {
+	submission, err := c.Submit(ctx, pending.UUID, authToken, pending.UPP)
+	if !submission.Stored() {
+		if rollbackErr := p.Rollback(pending); rollbackErr != nil && err == nil {
+			err = rollbackErr
+		}
+		return submission, err
+	}
+	commitErr := p.Commit(pending)
+	if commitErr != nil {
+		return submission, fmt.Errorf("committing stored UPP of %s failed: %w", pending.UUID, commitErr)
+	}
+	return submission, err
+}
+
+// SignAndSubmit creates a chained UPP of the hash for the identity with the given name and submits it.
+// The chain head only advances, if the UPP was stored by the backend, see SubmitPending.
+func (c *UPPClient) SignAndSubmit(ctx context.Context, p *ubirch.Protocol, name string, hash []byte, authToken string) (*SubmissionResponse, error) {
+	pending, err := p.PrepareSignHash(name, hash, ubirch.Binary)
+	if err != nil {
+		return nil, err
+	}
+	return c.SubmitPending(ctx, p, pending, authToken)
+}
@@ -0,0 +1,261 @@
+/*
+ * Copyright (c) 2019 ubirch GmbH.
+ *
+ * ```
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * ```
+ */
+
+package backend
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/ubirch/ubirch-protocol-go/ubirch/v2"
+)
+
+const testAuthToken = "8f4b3a0c-5a1b-4a5e-9c44-1b0c4d7c1e3a"
+
+//fakeNiomon is a stand-in of the ingestion endpoint. It verifies the submitted UPPs with the public key
+//of the identity and answers with a chained UPP signed by the backend identity.
+type fakeNiomon struct {
+	sync.Mutex
+	t          *testing.T
+	device     *ubirch.Protocol
+	backend    *ubirch.Protocol
+	backendID  uuid.UUID
+	failures   int // number of requests to answer with a server error
+	lost       int // number of accepted UPPs to answer with a server error, as if the response was lost
+	requests   int
+	hashes     map[string]bool
+	manipulate bool // manipulate the signature of the response UPP
+}
+
+func (s *fakeNiomon) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+	s.requests++
+
+	if s.failures > 0 {
+		s.failures--
+		http.Error(w, "try again later", http.StatusServiceUnavailable)
+		return
+	}
+	assert.Equal(s.t, contentTypeMsgpack, r.Header.Get("Content-Type"))
+	assert.Equal(s.t, authTypeUbirch, r.Header.Get(headerAuthType))
+	if r.Header.Get(headerCredential) != base64.StdEncoding.EncodeToString([]byte(testAuthToken)) {
+		http.Error(w, "invalid credential", http.StatusUnauthorized)
+		return
+	}
+
+	upp, _ := io.ReadAll(r.Body)
+	decoded, err := ubirch.Decode(upp)
+	if err != nil || decoded.GetUuid().String() != r.Header.Get(headerHardwareId) {
+		http.Error(w, "invalid UPP", http.StatusBadRequest)
+		return
+	}
+	verified, err := s.device.Verify("device", upp)
+	if err != nil || !verified {
+		http.Error(w, "invalid signature", http.StatusBadRequest)
+		return
+	}
+	if s.hashes[string(decoded.GetPayload())] {
+		http.Error(w, "hash already exists", http.StatusConflict)
+		return
+	}
+	s.hashes[string(decoded.GetPayload())] = true
+	if s.lost > 0 {
+		s.lost--
+		http.Error(w, "gateway timeout", http.StatusGatewayTimeout)
+		return
+	}
+
+	_ = s.backend.SetLastSignatureByUUID(s.backendID, decoded.GetSignature())
+	requestHash := sha256.Sum256(upp)
+	response, err := s.backend.SignHash("backend", requestHash[:], ubirch.Chained)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if s.manipulate {
+		response[len(response)-1] ^= 0xff
+	}
+	_, _ = w.Write(response)
+}
+
+//newFakeNiomon creates a protocol with the identity "device", a stand-in of the ingestion endpoint
+//and a client of it
+func newFakeNiomon(t *testing.T) (*ubirch.Protocol, *fakeNiomon, *UPPClient) {
+	id := uuid.New()
+	device := newTestProtocol(t, "device", id)
+	backendID := uuid.New()
+	backend := newTestProtocol(t, "backend", backendID)
+	backendPubKey, err := backend.GetPublicKey("backend")
+	require.NoError(t, err)
+
+	niomon := &fakeNiomon{t: t, device: device, backend: backend, backendID: backendID, hashes: map[string]bool{}}
+	server := httptest.NewServer(niomon)
+	t.Cleanup(server.Close)
+	client := &UPPClient{
+		URL:              server.URL,
+		HTTPClient:       server.Client(),
+		BackendPublicKey: backendPubKey,
+		Retries:          2,
+		Backoff:          time.Millisecond,
+	}
+	return device, niomon, client
+}
+
+func TestUPPClient_SignAndSubmit(t *testing.T) {
+	asserter := assert.New(t)
+	requirer := require.New(t)
+	ctx := context.Background()
+
+	device, niomon, client := newFakeNiomon(t)
+	hash := mustHash("data")
+
+	submission, err := client.SignAndSubmit(ctx, device, "device", hash, testAuthToken)
+	requirer.NoError(err)
+	asserter.Equal(Accepted, submission.Result)
+	asserter.Equal(http.StatusOK, submission.StatusCode)
+	requirer.NotNil(submission.ResponseUPP)
+	lastSignature, err := device.GetLastSignature("device")
+	requirer.NoError(err)
+	asserter.Equal(submission.ResponseUPP.GetPrevSignature(), lastSignature, "chain head not advanced to the accepted UPP")
+
+	var tests = []struct {
+		testName   string
+		hash       []byte
+		authToken  string
+		failures   int
+		manipulate bool
+		result     SubmissionResult
+		err        error
+	}{
+		{"duplicate", hash, testAuthToken, 0, false, Duplicate, nil},
+		{"unauthorized", mustHash("data 1"), "wrong token", 0, false, Unauthorized, nil},
+		{"server errors", mustHash("data 2"), testAuthToken, 3, false, 0, ErrServer},
+	}
+
+	for _, currTest := range tests {
+		t.Run(currTest.testName, func(t *testing.T) {
+			niomon.failures, niomon.manipulate = currTest.failures, currTest.manipulate
+			defer func() { niomon.failures, niomon.manipulate = 0, false }()
+
+			submission, err := client.SignAndSubmit(ctx, device, "device", currTest.hash, currTest.authToken)
+			if currTest.err != nil {
+				assert.True(t, errors.Is(err, currTest.err), "unexpected error: %v", err)
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, currTest.result, submission.Result)
+			}
+
+			//the chain head did not advance, the next UPP is chained to the last accepted one
+			currentSignature, err := device.GetLastSignature("device")
+			require.NoError(t, err)
+			assert.Equal(t, lastSignature, currentSignature)
+		})
+	}
+
+	//retry after server errors
+	niomon.failures, niomon.requests = 2, 0
+	submission, err = client.SignAndSubmit(ctx, device, "device", mustHash("data 4"), testAuthToken)
+	requirer.NoError(err)
+	asserter.Equal(Accepted, submission.Result)
+	asserter.Equal(3, niomon.requests)
+	lastSignature, err = device.GetLastSignature("device")
+	requirer.NoError(err)
+
+	//the UPP was stored, but the response is not verifiable: the chain head advances nevertheless
+	niomon.manipulate = true
+	submission, err = client.SignAndSubmit(ctx, device, "device", mustHash("data 5"), testAuthToken)
+	niomon.manipulate = false
+	asserter.True(errors.Is(err, ErrUnverifiedResponse), "unexpected error: %v", err)
+	requirer.NotNil(submission)
+	asserter.Equal(Accepted, submission.Result)
+	asserter.Nil(submission.ResponseUPP)
+	currentSignature, err := device.GetLastSignature("device")
+	requirer.NoError(err)
+	asserter.NotEqual(lastSignature, currentSignature, "chain head not advanced to the stored UPP")
+	lastSignature = currentSignature
+
+	//the response of the stored UPP was lost, the retry is a duplicate: the chain head advances
+	niomon.lost = 1
+	submission, err = client.SignAndSubmit(ctx, device, "device", mustHash("data 6"), testAuthToken)
+	requirer.NoError(err)
+	asserter.Equal(Duplicate, submission.Result)
+	asserter.True(submission.Retried)
+	asserter.True(submission.Stored())
+	currentSignature, err = device.GetLastSignature("device")
+	requirer.NoError(err)
+	asserter.NotEqual(lastSignature, currentSignature, "chain head not advanced to the stored UPP")
+}
+
+func TestUPPClient_Submit(t *testing.T) {
+	asserter := assert.New(t)
+	requirer := require.New(t)
+	ctx := context.Background()
+
+	device, niomon, client := newFakeNiomon(t)
+	id, err := device.GetUUID("device")
+	requirer.NoError(err)
+	upp, err := device.SignHash("device", mustHash("data"), ubirch.Signed)
+	requirer.NoError(err)
+
+	//signed UPPs are submitted without pending state
+	submission, err := client.Submit(ctx, id, testAuthToken, upp)
+	requirer.NoError(err)
+	asserter.Equal(Accepted, submission.Result)
+
+	upp[len(upp)-1] ^= 0xff
+	submission, err = client.Submit(ctx, id, testAuthToken, upp)
+	requirer.NoError(err)
+	asserter.Equal(Rejected, submission.Result)
+	asserter.Equal(http.StatusBadRequest, submission.StatusCode)
+
+	//no backend public key: the UPP is accepted, but the response can't be verified
+	upp, err = device.SignHash("device", mustHash("no key"), ubirch.Signed)
+	requirer.NoError(err)
+	submission, err = (&UPPClient{URL: client.URL}).Submit(ctx, id, testAuthToken, upp)
+	asserter.True(errors.Is(err, ErrUnverifiedResponse))
+	requirer.NotNil(submission)
+	asserter.Equal(Accepted, submission.Result)
+
+	//context canceled during backoff
+	niomon.failures = 10
+	client.Backoff = time.Second
+	ctxTimeout, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = client.Submit(ctxTimeout, id, testAuthToken, upp)
+	asserter.True(errors.Is(err, context.DeadlineExceeded), "unexpected error: %v", err)
+	asserter.Less(int64(time.Since(start)), int64(time.Second))
+
+	_, err = NewUPPClient("", nil)
+	asserter.True(errors.Is(err, ErrUnknownEnvironment))
+	_, err = NewUPPClient(Prod, nil)
+	asserter.Error(err, "client without backend public key created")
+	asserter.Equal("duplicate", Duplicate.String())
+}
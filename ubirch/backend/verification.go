@@ -0,0 +1,191 @@
+/*
+ * Copyright (c) 2019 ubirch GmbH.
+ *
+ * ```
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * ```
+ */
+
+package backend
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/ubirch/ubirch-protocol-go/ubirch/v2"
+)
+
+const contentTypeText = "text/plain"
+
+// PublicKeyResolver resolves the current public keys of a UUID, e.g. KeyServiceClient
+type PublicKeyResolver interface {
+	GetPublicKeys(ctx context.Context, id uuid.UUID) ([]PublicKeyInfo, error)
+}
+
+// verificationResponse is the response of the verification endpoint
+type verificationResponse struct {
+	UPP     []byte          `json:"upp"`
+	Prev    []byte          `json:"prev"`
+	Anchors json.RawMessage `json:"anchors"`
+}
+
+// VerificationResult is the locally verified result of a hash lookup
+type VerificationResult struct {
+	UUID        uuid.UUID       // the UUID of the identity which anchored the hash
+	UPP         []byte          // the UPP containing the hash
+	PreviousUPP []byte          // the predecessor of the UPP in its chain, nil if the backend returned none
+	Anchors     json.RawMessage // the anchors (upper path and blockchain transactions) as returned by the backend, see CheckAnchorConsistency
+	PublicKey   []byte          // the public key which verified the signature of the UPP
+}
+
+// CheckAnchorConsistency checks offline that the anchors of the UPP are consistent, see
+// ubirch.Anchors.CheckConsistency. This does not verify the anchoring itself. The decoded anchors are
+// returned even if they are inconsistent.
+func (r *VerificationResult) CheckAnchorConsistency() (*ubirch.Anchors, error) {
+	if len(r.Anchors) == 0 || string(r.Anchors) == "null" {
+		return nil, fmt.Errorf("%w: no anchors for UPP of %s", ubirch.ErrBrokenAnchorPath, r.UUID)
+	}
+	return ubirch.CheckAnchorConsistency(r.UPP, r.Anchors)
+}
+
+// VerificationClient is a client of the ubirch verification endpoint. The UPPs returned by the backend
+// are verified locally with the public keys resolved by Keys.
+type VerificationClient struct {
+	URL        string       // the URL of the verification endpoint, e.g. "https://verify.prod.ubirch.com/api/upp/verify/anchor"
+	HTTPClient *http.Client // the HTTP client used for the requests, http.DefaultClient if nil
+	Keys       PublicKeyResolver
+}
+
+// NewVerificationClient returns a client of the verification endpoint of the given environment
+func NewVerificationClient(env Environment, keys PublicKeyResolver) (*VerificationClient, error) {
+	urls, err := EnvironmentURLs(env)
+	if err != nil {
+		return nil, err
+	}
+	return &VerificationClient{URL: urls.Verify, Keys: keys}, nil
+}
+
+// VerifyHash looks up the UPP containing the hash and returns it together with the previous UPP and the
+// anchoring information. The signatures of the returned UPPs are verified with the resolved public keys of
+// their UUID and the previous UPP must be linked to the UPP, an error wrapping ErrInvalidResponse is
+// returned otherwise. Returns an error wrapping ErrNotFound, if the hash is unknown.
+func (c *VerificationClient) VerifyHash(ctx context.Context, hash []byte) (*VerificationResult, error) {
+	if len(hash) != sha256.Size {
+		return nil, fmt.Errorf("invalid hash size: expected %d, got %d", sha256.Size, len(hash))
+	}
+	if c.Keys == nil {
+		return nil, fmt.Errorf("no public key resolver to verify UPPs")
+	}
+
+	header := map[string]string{"Content-Type": contentTypeText, "Accept": contentTypeJSON}
+	body := []byte(base64.StdEncoding.EncodeToString(hash))
+	resp, err := doRequest(ctx, c.HTTPClient, http.MethodPost, c.URL, header, body)
+	if err != nil {
+		return nil, err
+	}
+	err = resp.checkStatus(http.MethodPost, c.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	var verification verificationResponse
+	err = json.Unmarshal(resp.Body, &verification)
+	if err != nil {
+		return nil, fmt.Errorf("%w: decoding verification response failed: %v", ErrInvalidResponse, err)
+	}
+
+	upp, err := ubirch.Decode(verification.UPP)
+	if err != nil {
+		return nil, fmt.Errorf("%w: decoding UPP failed: %v", ErrInvalidResponse, err)
+	}
+	if !bytes.Equal(upp.GetPayload(), hash) {
+		return nil, fmt.Errorf("%w: UPP does not contain the hash", ErrInvalidResponse)
+	}
+
+	keys, err := c.Keys.GetPublicKeys(ctx, upp.GetUuid())
+	if err != nil {
+		return nil, fmt.Errorf("resolving public keys of %s failed: %w", upp.GetUuid(), err)
+	}
+	pubKey, err := verifyWithKeys(verification.UPP, keys)
+	if err != nil {
+		return nil, fmt.Errorf("%w: UPP: %v", ErrInvalidResponse, err)
+	}
+
+	if len(verification.Prev) != 0 {
+		prev, err := ubirch.Decode(verification.Prev)
+		if err != nil {
+			return nil, fmt.Errorf("%w: decoding previous UPP failed: %v", ErrInvalidResponse, err)
+		}
+		if prev.GetUuid() != upp.GetUuid() {
+			return nil, fmt.Errorf("%w: UUID of previous UPP %s != %s", ErrInvalidResponse, prev.GetUuid(), upp.GetUuid())
+		}
+		_, err = verifyWithKeys(verification.Prev, keys)
+		if err != nil {
+			return nil, fmt.Errorf("%w: previous UPP: %v", ErrInvalidResponse, err)
+		}
+		linked, err := ubirch.CheckChainLink(prev, upp)
+		if err != nil {
+			return nil, fmt.Errorf("%w: checking chain link failed: %v", ErrInvalidResponse, err)
+		}
+		if !linked {
+			return nil, fmt.Errorf("%w: previous UPP not linked to UPP", ErrInvalidResponse)
+		}
+	}
+
+	return &VerificationResult{
+		UUID:        upp.GetUuid(),
+		UPP:         verification.UPP,
+		PreviousUPP: verification.Prev,
+		Anchors:     verification.Anchors,
+		PublicKey:   pubKey,
+	}, nil
+}
+
+// verifyWithKeys verifies the signature of the UPP with the given public keys and returns the key which
+// verified it. Keys which can't be used are skipped, their errors are only reported if no key verified
+// the signature.
+func verifyWithKeys(upp []byte, keys []PublicKeyInfo) ([]byte, error) {
+	var keyErrors []string
+	for i, key := range keys {
+		pubKey, format := key.PubKey, ubirch.FormatRaw
+		if len(pubKey) == ed25519.PublicKeySize {
+			der, err := x509.MarshalPKIXPublicKey(ed25519.PublicKey(pubKey))
+			if err != nil {
+				keyErrors = append(keyErrors, fmt.Sprintf("key %d: %v", i, err))
+				continue
+			}
+			pubKey, format = der, ubirch.FormatDER
+		}
+		verified, err := ubirch.VerifyUPPWithPublicKey(upp, pubKey, format)
+		if err != nil {
+			keyErrors = append(keyErrors, fmt.Sprintf("key %d: %v", i, err))
+			continue
+		}
+		if verified {
+			return key.PubKey, nil
+		}
+	}
+	if len(keyErrors) != 0 {
+		return nil, fmt.Errorf("signature not verifiable with the public keys of the UUID (%s)", strings.Join(keyErrors, "; "))
+	}
+	return nil, fmt.Errorf("signature not verifiable with the public keys of the UUID")
+}
@@ -0,0 +1,251 @@
+/*
+ * Copyright (c) 2019 ubirch GmbH.
+ *
+ * ```
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * ```
+ */
+
+package backend
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/ubirch/ubirch-protocol-go/ubirch/v2"
+)
+
+//fakeVerification is a stand-in of the verification endpoint, which answers with the stored response
+//for a hash
+type fakeVerification map[string]verificationResponse
+
+func (s fakeVerification) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	hash, err := base64.StdEncoding.DecodeString(string(body))
+	if err != nil || r.Header.Get("Content-Type") != contentTypeText {
+		http.Error(w, "invalid hash", http.StatusBadRequest)
+		return
+	}
+	response, found := s[string(hash)]
+	if !found {
+		http.Error(w, "hash not found", http.StatusNotFound)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(response)
+}
+
+func TestVerificationClient_VerifyHash(t *testing.T) {
+	requirer := require.New(t)
+	ctx := context.Background()
+
+	//a chain of three UPPs of a registered identity
+	keyService := newFakeKeyService(t)
+	id := uuid.New()
+	device := newTestProtocol(t, "device", id)
+	registration, err := NewKeyRegistration(device, "device")
+	requirer.NoError(err)
+	requirer.NoError(keyService.RegisterKey(ctx, registration))
+
+	var upps [][]byte
+	for _, data := range []string{"first", "second", "third"} {
+		upp, err := device.SignHash("device", mustHash(data), ubirch.Chained)
+		requirer.NoError(err)
+		upps = append(upps, upp)
+	}
+	//a UPP of an identity with an unregistered key, claiming the UUID of the registered identity
+	forger := newTestProtocol(t, "device", id)
+	forged, err := forger.SignHash("device", mustHash("forged"), ubirch.Chained)
+	requirer.NoError(err)
+	anchors := json.RawMessage(`[{"label":"PUBLIC_CHAIN","txid":"abc"}]`)
+
+	stored := fakeVerification{
+		string(mustHash("first")):         {UPP: upps[0], Anchors: anchors},
+		string(mustHash("second")):        {UPP: upps[1], Prev: upps[0], Anchors: anchors},
+		string(mustHash("third")):         {UPP: upps[2], Prev: upps[0]},
+		string(mustHash("forged")):        {UPP: forged},
+		string(mustHash("forged prev")):   {UPP: upps[1], Prev: forged},
+		string(mustHash("wrong payload")): {UPP: upps[1], Prev: upps[0]},
+		string(mustHash("invalid UPP")):   {UPP: []byte{0x96, 0x23}},
+	}
+	server := httptest.NewServer(stored)
+	defer server.Close()
+	client := &VerificationClient{URL: server.URL, HTTPClient: server.Client(), Keys: keyService}
+
+	var tests = []struct {
+		testName string
+		hash     []byte
+		prev     []byte
+		err      error
+	}{
+		{"first UPP", mustHash("first"), nil, nil},
+		{"UPP with predecessor", mustHash("second"), upps[0], nil},
+		{"unknown hash", mustHash("unknown"), nil, ErrNotFound},
+		{"predecessor not linked", mustHash("third"), nil, ErrInvalidResponse},
+		{"UPP signed with other key", mustHash("forged"), nil, ErrInvalidResponse},
+		{"predecessor signed with other key", mustHash("forged prev"), nil, ErrInvalidResponse},
+		{"UPP of other hash", mustHash("wrong payload"), nil, ErrInvalidResponse},
+		{"invalid UPP", mustHash("invalid UPP"), nil, ErrInvalidResponse},
+	}
+
+	for _, currTest := range tests {
+		t.Run(currTest.testName, func(t *testing.T) {
+			result, err := client.VerifyHash(ctx, currTest.hash)
+			if currTest.err != nil {
+				assert.True(t, errors.Is(err, currTest.err), "unexpected error: %v", err)
+				assert.Nil(t, result)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, id, result.UUID)
+			assert.Equal(t, stored[string(currTest.hash)].UPP, result.UPP)
+			assert.Equal(t, currTest.prev, result.PreviousUPP)
+			assert.JSONEq(t, string(anchors), string(result.Anchors))
+			assert.Equal(t, registration.PubKeyInfo.PubKey, result.PublicKey)
+		})
+	}
+}
+
+func TestVerificationClient_VerifyHash_Fails(t *testing.T) {
+	asserter := assert.New(t)
+	ctx := context.Background()
+
+	keyService := newFakeKeyService(t)
+	device := newTestProtocol(t, "device", uuid.New())
+	upp, err := device.SignHash("device", mustHash("data"), ubirch.Signed)
+	require.NoError(t, err)
+	server := httptest.NewServer(fakeVerification{string(mustHash("data")): {UPP: upp}})
+	defer server.Close()
+
+	//key of the identity is not registered
+	client := &VerificationClient{URL: server.URL, Keys: keyService}
+	_, err = client.VerifyHash(ctx, mustHash("data"))
+	asserter.True(errors.Is(err, ErrNotFound), "unexpected error: %v", err)
+	asserter.False(errors.Is(err, ErrInvalidResponse))
+
+	_, err = client.VerifyHash(ctx, []byte("no hash"))
+	asserter.Error(err)
+	_, err = (&VerificationClient{URL: server.URL}).VerifyHash(ctx, mustHash("data"))
+	asserter.Error(err)
+
+	invalid := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("{"))
+	}))
+	defer invalid.Close()
+	_, err = (&VerificationClient{URL: invalid.URL, Keys: keyService}).VerifyHash(ctx, mustHash("data"))
+	asserter.True(errors.Is(err, ErrInvalidResponse))
+
+	_, err = NewVerificationClient("", keyService)
+	asserter.True(errors.Is(err, ErrUnknownEnvironment))
+}
+
+func TestVerifyWithKeys_Ed25519(t *testing.T) {
+	requirer := require.New(t)
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	requirer.NoError(err)
+	encoded, err := ubirch.Encode(&ubirch.SignedUPP{Version: ubirch.Signed, Uuid: uuid.New(), Hint: ubirch.Binary, Payload: mustHash("data")})
+	requirer.NoError(err)
+	signedPart := encoded[:len(encoded)-1]
+	signature := ed25519.Sign(priv, signedPart)
+	upp := append(append(signedPart, 0xc4, byte(len(signature))), signature...)
+
+	key, err := verifyWithKeys(upp, []PublicKeyInfo{{PubKey: pub}})
+	requirer.NoError(err)
+	assert.Equal(t, []byte(pub), key)
+
+	otherPub, _, err := ed25519.GenerateKey(rand.Reader)
+	requirer.NoError(err)
+	_, err = verifyWithKeys(upp, []PublicKeyInfo{{PubKey: otherPub}})
+	assert.Error(t, err)
+}
+
+//TestVerifyWithKeys_SkipsInvalidKeys tests that a key which can't be used does not hide a valid key
+func TestVerifyWithKeys_SkipsInvalidKeys(t *testing.T) {
+	requirer := require.New(t)
+
+	id := uuid.New()
+	p := newTestProtocol(t, "A", id)
+	pubKey, err := p.GetPublicKey("A")
+	requirer.NoError(err)
+	upp, err := p.SignHash("A", mustHash("data"), ubirch.Signed)
+	requirer.NoError(err)
+
+	malformed := []PublicKeyInfo{{PubKey: []byte("malformed key")}, {PubKey: make([]byte, 64)}}
+	key, err := verifyWithKeys(upp, append(malformed, PublicKeyInfo{PubKey: pubKey}))
+	requirer.NoError(err)
+	assert.Equal(t, pubKey, key)
+
+	_, err = verifyWithKeys(upp, malformed)
+	requirer.Error(err)
+	assert.Contains(t, err.Error(), "key 0")
+}
+
+//staticKeys resolves the same public keys for every UUID
+type staticKeys []PublicKeyInfo
+
+func (k staticKeys) GetPublicKeys(context.Context, uuid.UUID) ([]PublicKeyInfo, error) {
+	return k, nil
+}
+
+//TestVerificationResult_CheckAnchorConsistency verifies a response in the format of the verification service
+//(anchors with upper path and upper blockchains) and checks the consistency of its anchors
+func TestVerificationResult_CheckAnchorConsistency(t *testing.T) {
+	asserter := assert.New(t)
+	requirer := require.New(t)
+
+	response, err := os.ReadFile("testdata/verification_response.json")
+	requirer.NoError(err)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(response)
+	}))
+	defer server.Close()
+	pubKey, err := base64.StdEncoding.DecodeString("eGwMxAxyGrvHCFZJTg/z+gSSYUQsc+hnSaTqXGIG1l0k84KBBl0H06K5c3A5jGYMWWRu3Unk4Hm7h+3SF3Sn7g==")
+	requirer.NoError(err)
+	hash, err := base64.StdEncoding.DecodeString("vmS/juVGdBc2/vryNz1kTIymSYJ9HZXHKuUoYt28ZGA=")
+	requirer.NoError(err)
+
+	client := &VerificationClient{URL: server.URL, HTTPClient: server.Client(), Keys: staticKeys{{PubKey: pubKey}}}
+	result, err := client.VerifyHash(context.Background(), hash)
+	requirer.NoError(err)
+	asserter.Equal(uuid.MustParse("ba70ad8b-a564-4e58-9a3b-224ac0f0153f"), result.UUID)
+
+	anchors, err := result.CheckAnchorConsistency()
+	requirer.NoError(err)
+	requirer.Len(anchors.UpperPath, 3)
+	requirer.Len(anchors.UpperBlockchains, 2)
+	asserter.Equal("ETHEREUM_TESTNET_RINKEBY_TESTNET_NETWORK", anchors.UpperBlockchains[0].Properties.PublicChain)
+	asserter.Equal(anchors.UpperPath[2].Properties.Hash, anchors.UpperBlockchains[1].Properties.Message)
+
+	//anchors of another UPP
+	other, err := ubirch.Encode(&ubirch.SignedUPP{Version: ubirch.Signed, Uuid: result.UUID, Hint: ubirch.Binary, Payload: mustHash("other"), Signature: make([]byte, 64)})
+	requirer.NoError(err)
+	result.UPP = other
+	_, err = result.CheckAnchorConsistency()
+	asserter.True(errors.Is(err, ubirch.ErrBrokenAnchorPath), "unexpected error: %v", err)
+
+	result.Anchors = nil
+	_, err = result.CheckAnchorConsistency()
+	asserter.True(errors.Is(err, ubirch.ErrBrokenAnchorPath), "unexpected error: %v", err)
+}
@@ -0,0 +1,230 @@
+/*
+ * Copyright (c) 2019 ubirch GmbH.
+ *
+ * ```
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * ```
+ */
+
+package ubirch
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// BundleVersion is the version of the verification bundle format
+const BundleVersion = 1
+
+// Bundle is a self-contained verification bundle. It contains everything needed to verify a
+// sequence of UPPs offline: the UPPs, the public key of the signer and optionally the signer's
+// certificate, the chain context, the original data hashes and metadata.
+type Bundle struct {
+	Version           int               `json:"version"`
+	Created           time.Time         `json:"created"`
+	UUID              uuid.UUID         `json:"uuid"`
+	PublicKey         string            `json:"publicKey"`                   // PEM encoded public key of the signer
+	Certificate       []byte            `json:"certificate,omitempty"`       // DER encoded X.509 certificate of the signer
+	UPPs              [][]byte          `json:"upps"`                        // the UPPs, chained UPPs in chain order
+	PreviousSignature []byte            `json:"previousSignature,omitempty"` // signature of the UPP preceding the first UPP
+	DataHashes        [][]byte          `json:"dataHashes,omitempty"`        // hashes of the original data, one per UPP
+	Metadata          map[string]string `json:"metadata,omitempty"`
+}
+
+// SignedBundle is the serialized form of a Bundle. The signature covers the compact JSON
+// encoding of the bundle and is created with the signer's key.
+type SignedBundle struct {
+	Bundle    json.RawMessage `json:"bundle"`
+	Signature []byte          `json:"signature"`
+}
+
+// BundleOptions contains the optional content of a verification bundle
+type BundleOptions struct {
+	PreviousSignature []byte            // signature of the UPP preceding the first UPP of the bundle
+	DataHashes        [][]byte          // hashes of the original data, one per UPP
+	Metadata          map[string]string // additional information, e.g. a description of the data
+}
+
+// ExportBundle packages the given UPPs of an identity, its public key and certificate (if one is
+// stored) into a verification bundle, which is signed with the identity's private key. The bundle
+// is verified with VerifyBundle before it is returned. Returns the JSON encoded SignedBundle.
+func (p *Protocol) ExportBundle(name string, upps [][]byte, opts BundleOptions) ([]byte, error) {
+	id, err := p.GetUUID(name)
+	if err != nil {
+		return nil, err
+	}
+
+	pubKey, err := p.ExportPublicKey(name, FormatPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := p.GetCertificate(name)
+	if err != nil {
+		if !errors.Is(err, ErrKeyNotFound) {
+			return nil, err
+		}
+		cert = nil
+	}
+
+	bundle := Bundle{
+		Version:           BundleVersion,
+		Created:           time.Now().UTC(),
+		UUID:              id,
+		PublicKey:         string(pubKey),
+		Certificate:       cert,
+		UPPs:              upps,
+		PreviousSignature: opts.PreviousSignature,
+		DataHashes:        opts.DataHashes,
+		Metadata:          opts.Metadata,
+	}
+	bundleJSON, err := json.Marshal(bundle)
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := p.Crypto.Sign(id, bundleJSON)
+	if err != nil {
+		return nil, fmt.Errorf("signing bundle failed: %w", err)
+	}
+
+	signedBundle, err := json.MarshalIndent(SignedBundle{Bundle: bundleJSON, Signature: signature}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = VerifyBundle(signedBundle)
+	if err != nil {
+		return nil, fmt.Errorf("exported bundle not verifiable: %w", err)
+	}
+	return signedBundle, nil
+}
+
+// VerifyBundle verifies a JSON encoded SignedBundle completely offline and returns the bundle.
+// It checks the signature of the bundle, that the certificate (if any) belongs to the public key,
+// that all UPPs belong to the bundle's UUID and are verifiable with the public key, that the
+// chained UPPs are linked to each other and to the previous signature (if any), and that the
+// payloads match the data hashes (if any).
+// Note that the public key is taken from the bundle itself, so the caller has to check that the
+// public key or certificate of the bundle is trusted.
+func VerifyBundle(data []byte) (*Bundle, error) {
+	var signedBundle SignedBundle
+	err := json.Unmarshal(data, &signedBundle)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse bundle: %v", err)
+	}
+
+	var bundleJSON bytes.Buffer
+	err = json.Compact(&bundleJSON, signedBundle.Bundle)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse bundle: %v", err)
+	}
+	var bundle Bundle
+	err = json.Unmarshal(bundleJSON.Bytes(), &bundle)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse bundle: %v", err)
+	}
+	if bundle.Version != BundleVersion {
+		return nil, fmt.Errorf("unsupported bundle version: %d", bundle.Version)
+	}
+
+	pub, err := parseVerificationKey([]byte(bundle.PublicKey), FormatPEM)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key in bundle: %w", err)
+	}
+	verified, err := verifySignature(pub, bundleJSON.Bytes(), signedBundle.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("verifying bundle signature failed: %w", err)
+	}
+	if !verified {
+		return nil, fmt.Errorf("bundle signature invalid")
+	}
+
+	if len(bundle.Certificate) != 0 {
+		cert, err := x509.ParseCertificate(bundle.Certificate)
+		if err != nil {
+			return nil, fmt.Errorf("invalid certificate in bundle: %v", err)
+		}
+		certPubKey, err := rawPublicKey(cert.PublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid certificate in bundle: %v", err)
+		}
+		bundlePubKey, err := rawPublicKey(pub)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(certPubKey, bundlePubKey) {
+			return nil, fmt.Errorf("certificate does not match the public key of the bundle")
+		}
+	}
+
+	if len(bundle.UPPs) == 0 {
+		return nil, fmt.Errorf("bundle contains no UPPs")
+	}
+	if len(bundle.DataHashes) != 0 && len(bundle.DataHashes) != len(bundle.UPPs) {
+		return nil, fmt.Errorf("number of data hashes (%d) does not match number of UPPs (%d)", len(bundle.DataHashes), len(bundle.UPPs))
+	}
+
+	var previous UPP
+	for i, upp := range bundle.UPPs {
+		decoded, err := Decode(upp)
+		if err != nil {
+			return nil, fmt.Errorf("decoding UPP at index %d failed: %w", i, err)
+		}
+		if decoded.GetUuid() != bundle.UUID {
+			return nil, fmt.Errorf("UPP at index %d belongs to UUID %s, not %s", i, decoded.GetUuid(), bundle.UUID)
+		}
+
+		signedPart, signature, err := splitUPP(upp)
+		if err != nil {
+			return nil, fmt.Errorf("UPP at index %d: %w", i, err)
+		}
+		verified, err := verifySignature(pub, signedPart, signature)
+		if err != nil {
+			return nil, fmt.Errorf("verifying UPP at index %d failed: %w", i, err)
+		}
+		if !verified {
+			return nil, fmt.Errorf("signature of UPP at index %d invalid", i)
+		}
+
+		if decoded.GetVersion() == Chained {
+			switch {
+			case previous != nil:
+				linked, err := CheckChainLink(previous, decoded)
+				if err != nil {
+					return nil, fmt.Errorf("checking chain link of UPP at index %d failed: %w", i, err)
+				}
+				if !linked {
+					return nil, fmt.Errorf("UPP at index %d is not linked to its predecessor", i)
+				}
+			case len(bundle.PreviousSignature) != 0:
+				if !bytes.Equal(bundle.PreviousSignature, decoded.GetPrevSignature()) {
+					return nil, fmt.Errorf("UPP at index %d is not linked to the previous signature", i)
+				}
+			}
+			previous = decoded
+		}
+
+		if len(bundle.DataHashes) != 0 && !bytes.Equal(bundle.DataHashes[i], decoded.GetPayload()) {
+			return nil, fmt.Errorf("payload of UPP at index %d does not match the data hash", i)
+		}
+	}
+
+	return &bundle, nil
+}
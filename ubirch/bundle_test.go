@@ -0,0 +1,197 @@
+/*
+ * Copyright (c) 2019 ubirch GmbH.
+ *
+ * ```
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * ```
+ */
+
+package ubirch
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// signBundleTestHelper signs a bundle with the key of the default identity
+func signBundleTestHelper(t *testing.T, p *Protocol, bundle Bundle) []byte {
+	bundleJSON, err := json.Marshal(bundle)
+	require.NoError(t, err)
+	signature, err := p.Crypto.Sign(uuid.MustParse(defaultUUID), bundleJSON)
+	require.NoError(t, err)
+	signedBundle, err := json.Marshal(SignedBundle{Bundle: bundleJSON, Signature: signature})
+	require.NoError(t, err)
+	return signedBundle
+}
+
+// createChainTestHelper creates a chain of UPPs with the default identity and returns the UPPs and the data hashes
+func createChainTestHelper(t *testing.T, p *Protocol, n int) ([][]byte, [][]byte) {
+	var upps, hashes [][]byte
+	for i := 0; i < n; i++ {
+		hash := sha256.Sum256([]byte{byte(i)})
+		upp, err := p.SignHash(defaultName, hash[:], Chained)
+		require.NoError(t, err)
+		upps = append(upps, upp)
+		hashes = append(hashes, hash[:])
+	}
+	return upps, hashes
+}
+
+func TestExportBundle(t *testing.T) {
+	asserter := assert.New(t)
+	requirer := require.New(t)
+
+	p, err := newProtocolContextSigner(defaultName, defaultUUID, defaultPriv, defaultLastSig)
+	requirer.NoError(err)
+	cert, err := p.CreateSelfSignedCertificate(defaultName, CertificateOptions{})
+	requirer.NoError(err)
+	requirer.NoError(p.SetCertificate(defaultName, cert))
+
+	upps, hashes := createChainTestHelper(t, p, 3)
+	data, err := p.ExportBundle(defaultName, upps, BundleOptions{
+		PreviousSignature: mustDecodeHex(t, defaultLastSig),
+		DataHashes:        hashes,
+		Metadata:          map[string]string{"case": "42"},
+	})
+	requirer.NoError(err)
+
+	bundle, err := VerifyBundle(data)
+	requirer.NoError(err)
+	asserter.Equal(BundleVersion, bundle.Version)
+	asserter.Equal(uuid.MustParse(defaultUUID), bundle.UUID)
+	asserter.Equal(upps, bundle.UPPs)
+	asserter.Equal(hashes, bundle.DataHashes)
+	asserter.Equal(cert, bundle.Certificate)
+	asserter.Equal("42", bundle.Metadata["case"])
+	pubKey, err := ParsePublicKey([]byte(bundle.PublicKey), FormatPEM)
+	requirer.NoError(err)
+	asserter.Equal(mustDecodeHex(t, defaultPub), pubKey)
+
+	//the signature covers the content, not the formatting
+	var compactData bytes.Buffer
+	requirer.NoError(json.Compact(&compactData, data))
+	_, err = VerifyBundle(compactData.Bytes())
+	asserter.NoError(err)
+
+	//export fails for UPPs which are not linked to the previous signature
+	_, err = p.ExportBundle(defaultName, upps[1:], BundleOptions{PreviousSignature: mustDecodeHex(t, defaultLastSig)})
+	asserter.Error(err)
+
+	//export without certificate
+	verifier, err := newProtocolContextSigner(defaultName, defaultUUID, defaultPriv, "")
+	requirer.NoError(err)
+	data, err = verifier.ExportBundle(defaultName, upps, BundleOptions{})
+	requirer.NoError(err)
+	bundle, err = VerifyBundle(data)
+	requirer.NoError(err)
+	asserter.Nil(bundle.Certificate)
+
+	_, err = p.ExportBundle("unknown", upps, BundleOptions{})
+	asserter.Error(err)
+}
+
+func TestVerifyBundle_Fails(t *testing.T) {
+	requirer := require.New(t)
+
+	p, err := newProtocolContextSigner(defaultName, defaultUUID, defaultPriv, defaultLastSig)
+	requirer.NoError(err)
+	upps, hashes := createChainTestHelper(t, p, 3)
+	pubKey, err := p.ExportPublicKey(defaultName, FormatPEM)
+	requirer.NoError(err)
+	signedUPP, err := p.SignHash(defaultName, hashes[0], Signed)
+	requirer.NoError(err)
+
+	other, err := newProtocolContextSigner(defaultName, uuid.New().String(), defaultPriv, "")
+	requirer.NoError(err)
+	otherUPPs, _ := createChainTestHelper(t, other, 1)
+
+	otherCertContext, err := newProtocolContextSigner(defaultName, defaultUUID, "10a0bef246575ea219e15bffbb6704d2a58b0e4aa99f101f12f0b1ce7a143559", "")
+	requirer.NoError(err)
+	otherCert, err := otherCertContext.CreateSelfSignedCertificate(defaultName, CertificateOptions{})
+	requirer.NoError(err)
+
+	valid := func() Bundle {
+		return Bundle{
+			Version:           BundleVersion,
+			UUID:              uuid.MustParse(defaultUUID),
+			PublicKey:         string(pubKey),
+			UPPs:              append([][]byte{}, upps...),
+			PreviousSignature: mustDecodeHex(t, defaultLastSig),
+			DataHashes:        append([][]byte{}, hashes...),
+		}
+	}
+	_, err = VerifyBundle(signBundleTestHelper(t, p, valid()))
+	requirer.NoError(err, "valid bundle not verifiable")
+
+	var tests = []struct {
+		testName string
+		modify   func(b *Bundle)
+	}{
+		{"wrong version", func(b *Bundle) { b.Version = 2 }},
+		{"invalid public key", func(b *Bundle) { b.PublicKey = "invalid" }},
+		{"certificate of other key", func(b *Bundle) { b.Certificate = otherCert }},
+		{"invalid certificate", func(b *Bundle) { b.Certificate = []byte{0x30, 0x00} }},
+		{"no UPPs", func(b *Bundle) { b.UPPs = nil; b.DataHashes = nil }},
+		{"missing data hash", func(b *Bundle) { b.DataHashes = b.DataHashes[1:] }},
+		{"wrong data hash", func(b *Bundle) { b.DataHashes[1] = b.DataHashes[0] }},
+		{"UPP of other UUID", func(b *Bundle) { b.UPPs[0] = otherUPPs[0] }},
+		{"manipulated UPP", func(b *Bundle) {
+			b.UPPs[1] = append([]byte{}, b.UPPs[1]...)
+			b.UPPs[1][len(b.UPPs[1])-1] ^= 0xff
+		}},
+		{"invalid UPP", func(b *Bundle) { b.UPPs[1] = b.UPPs[1][:20] }},
+		{"wrong order", func(b *Bundle) { b.UPPs[1], b.UPPs[2] = b.UPPs[2], b.UPPs[1]; b.DataHashes = nil }},
+		{"missing UPP", func(b *Bundle) { b.UPPs = append(b.UPPs[:1], b.UPPs[2]); b.DataHashes = nil }},
+		{"wrong previous signature", func(b *Bundle) { b.PreviousSignature = make([]byte, 64) }},
+		{"signed UPP with wrong hash", func(b *Bundle) { b.UPPs = [][]byte{signedUPP}; b.DataHashes = [][]byte{hashes[1]} }},
+	}
+
+	for _, currTest := range tests {
+		t.Run(currTest.testName, func(t *testing.T) {
+			bundle := valid()
+			currTest.modify(&bundle)
+			_, err := VerifyBundle(signBundleTestHelper(t, p, bundle))
+			assert.Error(t, err)
+		})
+	}
+
+	//manipulated bundle content or signature
+	data := signBundleTestHelper(t, p, valid())
+	var signedBundle SignedBundle
+	requirer.NoError(json.Unmarshal(data, &signedBundle))
+	signedBundle.Signature[0] ^= 0xff
+	manipulated, err := json.Marshal(signedBundle)
+	requirer.NoError(err)
+	_, err = VerifyBundle(manipulated)
+	assert.Error(t, err, "bundle with invalid signature verifiable")
+
+	signedBundle.Signature[0] ^= 0xff
+	var content map[string]interface{}
+	requirer.NoError(json.Unmarshal(signedBundle.Bundle, &content))
+	content["metadata"] = map[string]string{"added": "later"}
+	signedBundle.Bundle, err = json.Marshal(content)
+	requirer.NoError(err)
+	manipulated, err = json.Marshal(signedBundle)
+	requirer.NoError(err)
+	_, err = VerifyBundle(manipulated)
+	assert.Error(t, err, "manipulated bundle verifiable")
+
+	_, err = VerifyBundle([]byte("{"))
+	assert.Error(t, err, "invalid JSON accepted")
+}
@@ -0,0 +1,321 @@
+/*
+ * Copyright (c) 2019 ubirch GmbH.
+ *
+ * ```
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * ```
+ */
+
+package ubirch
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"math/bits"
+	"net/url"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	defaultCertificateValidity = 365 * 24 * time.Hour
+	serialNumberBits           = 128
+)
+
+var (
+	oidExtensionKeyUsage    = asn1.ObjectIdentifier{2, 5, 29, 15}
+	oidExtensionExtKeyUsage = asn1.ObjectIdentifier{2, 5, 29, 37}
+
+	oidExtKeyUsage = map[x509.ExtKeyUsage]asn1.ObjectIdentifier{
+		x509.ExtKeyUsageAny:             {2, 5, 29, 37, 0},
+		x509.ExtKeyUsageServerAuth:      {1, 3, 6, 1, 5, 5, 7, 3, 1},
+		x509.ExtKeyUsageClientAuth:      {1, 3, 6, 1, 5, 5, 7, 3, 2},
+		x509.ExtKeyUsageCodeSigning:     {1, 3, 6, 1, 5, 5, 7, 3, 3},
+		x509.ExtKeyUsageEmailProtection: {1, 3, 6, 1, 5, 5, 7, 3, 4},
+		x509.ExtKeyUsageTimeStamping:    {1, 3, 6, 1, 5, 5, 7, 3, 8},
+		x509.ExtKeyUsageOCSPSigning:     {1, 3, 6, 1, 5, 5, 7, 3, 9},
+	}
+)
+
+// CertificateOptions contains the subject and the extensions used for certificate signing requests
+// and self-signed certificates of an identity. Empty fields are left out.
+type CertificateOptions struct {
+	Country            string
+	Organization       string
+	OrganizationalUnit string
+	Locality           string
+	Province           string
+	CommonName         string // defaults to the UUID of the identity
+
+	UUIDURI        bool     // adds the UUID of the identity as SAN URI ("urn:uuid:<UUID>")
+	URIs           []string // additional SAN URIs
+	DNSNames       []string
+	EmailAddresses []string
+
+	KeyUsage    x509.KeyUsage
+	ExtKeyUsage []x509.ExtKeyUsage
+
+	// only used for certificates
+	NotBefore time.Time // defaults to now
+	NotAfter  time.Time // defaults to one year after NotBefore
+}
+
+// certificateEntryTitle returns a string of the Certificate Entry
+func certificateEntryTitle(id uuid.UUID) string {
+	return id.String() + "_certificate"
+}
+
+// nonEmpty returns a slice containing the string, or nil if the string is empty
+func nonEmpty(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return []string{s}
+}
+
+// subject returns the subject name described by the options
+func (opts CertificateOptions) subject(id uuid.UUID) pkix.Name {
+	commonName := opts.CommonName
+	if commonName == "" {
+		commonName = id.String()
+	}
+	return pkix.Name{
+		Country:            nonEmpty(opts.Country),
+		Organization:       nonEmpty(opts.Organization),
+		OrganizationalUnit: nonEmpty(opts.OrganizationalUnit),
+		Locality:           nonEmpty(opts.Locality),
+		Province:           nonEmpty(opts.Province),
+		CommonName:         commonName,
+	}
+}
+
+// uris returns the SAN URIs described by the options
+func (opts CertificateOptions) uris(id uuid.UUID) ([]*url.URL, error) {
+	var uris []*url.URL
+	if opts.UUIDURI {
+		uris = append(uris, &url.URL{Scheme: "urn", Opaque: "uuid:" + id.String()})
+	}
+	for _, rawURI := range opts.URIs {
+		uri, err := url.Parse(rawURI)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SAN URI %q: %v", rawURI, err)
+		}
+		uris = append(uris, uri)
+	}
+	return uris, nil
+}
+
+// marshalKeyUsage encodes the key usage extension (RFC 5280, section 4.2.1.3)
+func marshalKeyUsage(keyUsage x509.KeyUsage) (pkix.Extension, error) {
+	// bit 0 of the key usage is the most significant bit of the first byte in the bit string
+	bitString := []byte{bits.Reverse8(byte(keyUsage)), bits.Reverse8(byte(keyUsage >> 8))}
+	if bitString[1] == 0 {
+		bitString = bitString[:1]
+	}
+
+	// the bit length excludes the trailing zero bits
+	bitLength := len(bitString) * 8
+	last := bitString[len(bitString)-1]
+	for i := 0; i < 8 && last&(1<<uint(i)) == 0; i++ {
+		bitLength--
+	}
+
+	value, err := asn1.Marshal(asn1.BitString{Bytes: bitString, BitLength: bitLength})
+	if err != nil {
+		return pkix.Extension{}, err
+	}
+	return pkix.Extension{Id: oidExtensionKeyUsage, Critical: true, Value: value}, nil
+}
+
+// marshalExtKeyUsage encodes the extended key usage extension (RFC 5280, section 4.2.1.12)
+func marshalExtKeyUsage(extKeyUsage []x509.ExtKeyUsage) (pkix.Extension, error) {
+	oids := make([]asn1.ObjectIdentifier, 0, len(extKeyUsage))
+	for _, usage := range extKeyUsage {
+		oid, found := oidExtKeyUsage[usage]
+		if !found {
+			return pkix.Extension{}, fmt.Errorf("unsupported extended key usage: %d", usage)
+		}
+		oids = append(oids, oid)
+	}
+
+	value, err := asn1.Marshal(oids)
+	if err != nil {
+		return pkix.Extension{}, err
+	}
+	return pkix.Extension{Id: oidExtensionExtKeyUsage, Value: value}, nil
+}
+
+// GetCSRWithOptions gets a certificate signing request with the subject and extensions given in the options.
+func (c *CryptoContext) GetCSRWithOptions(name string, opts CertificateOptions) ([]byte, error) {
+	id, err := c.GetUUID(name)
+	if err != nil {
+		return nil, err
+	}
+
+	uris, err := opts.uris(id)
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.CertificateRequest{
+		SignatureAlgorithm: x509.ECDSAWithSHA256,
+		Subject:            opts.subject(id),
+		DNSNames:           opts.DNSNames,
+		EmailAddresses:     opts.EmailAddresses,
+		URIs:               uris,
+	}
+	// certificate requests have no key usage fields, so the extensions are added explicitly
+	if opts.KeyUsage != 0 {
+		extension, err := marshalKeyUsage(opts.KeyUsage)
+		if err != nil {
+			return nil, err
+		}
+		template.ExtraExtensions = append(template.ExtraExtensions, extension)
+	}
+	if len(opts.ExtKeyUsage) != 0 {
+		extension, err := marshalExtKeyUsage(opts.ExtKeyUsage)
+		if err != nil {
+			return nil, err
+		}
+		template.ExtraExtensions = append(template.ExtraExtensions, extension)
+	}
+
+	priv, err := c.getDecodedPrivateKey(id)
+	if err != nil {
+		return nil, err
+	}
+	defer zeroizePrivateKey(priv)
+
+	return x509.CreateCertificateRequest(rand.Reader, template, priv)
+}
+
+// CreateSelfSignedCertificate creates a DER encoded X.509 certificate for the identity key, which is signed
+// with the identity key itself. The subject and extensions are given in the options.
+func (c *CryptoContext) CreateSelfSignedCertificate(name string, opts CertificateOptions) ([]byte, error) {
+	id, err := c.GetUUID(name)
+	if err != nil {
+		return nil, err
+	}
+
+	uris, err := opts.uris(id)
+	if err != nil {
+		return nil, err
+	}
+
+	notBefore := opts.NotBefore
+	if notBefore.IsZero() {
+		notBefore = time.Now()
+	}
+	notAfter := opts.NotAfter
+	if notAfter.IsZero() {
+		notAfter = notBefore.Add(defaultCertificateValidity)
+	}
+	if notAfter.Before(notBefore) {
+		return nil, fmt.Errorf("invalid validity period: not after (%v) is before not before (%v)", notAfter, notBefore)
+	}
+
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), serialNumberBits))
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serialNumber,
+		SignatureAlgorithm:    x509.ECDSAWithSHA256,
+		Subject:               opts.subject(id),
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		KeyUsage:              opts.KeyUsage,
+		ExtKeyUsage:           opts.ExtKeyUsage,
+		BasicConstraintsValid: true,
+		DNSNames:              opts.DNSNames,
+		EmailAddresses:        opts.EmailAddresses,
+		URIs:                  uris,
+	}
+
+	priv, err := c.getDecodedPrivateKey(id)
+	if err != nil {
+		return nil, err
+	}
+	defer zeroizePrivateKey(priv)
+
+	return x509.CreateCertificate(rand.Reader, template, template, &priv.PublicKey, priv)
+}
+
+// SetCertificate stores an X.509 certificate (DER or PEM encoded) next to the identity in the keystore.
+// The public key of the certificate has to match the public key of the identity.
+func (c *CryptoContext) SetCertificate(name string, cert []byte) error {
+	id, err := c.GetUUID(name)
+	if err != nil {
+		return err
+	}
+
+	if block, _ := pem.Decode(cert); block != nil {
+		if block.Type != "CERTIFICATE" {
+			return fmt.Errorf("unexpected PEM block type: %q", block.Type)
+		}
+		cert = block.Bytes
+	}
+
+	parsedCert, err := x509.ParseCertificate(cert)
+	if err != nil {
+		return fmt.Errorf("unable to parse certificate: %v", err)
+	}
+	certPubKey, err := x509.MarshalPKIXPublicKey(parsedCert.PublicKey)
+	if err != nil {
+		return err
+	}
+
+	pub, err := c.getDecodedPublicKey(id)
+	if err != nil {
+		return err
+	}
+	identityPubKey, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(certPubKey, identityPubKey) {
+		return fmt.Errorf("public key of certificate does not match public key of '%s'", name)
+	}
+
+	return c.Keystore.SetKey(certificateEntryTitle(id), cert)
+}
+
+// GetCertificate gets the DER encoded X.509 certificate stored for the identity.
+func (c *CryptoContext) GetCertificate(name string) ([]byte, error) {
+	id, err := c.GetUUID(name)
+	if err != nil {
+		return nil, err
+	}
+
+	//check for invalid keystore
+	if err := c.checkKeystore(); err != nil {
+		return nil, fmt.Errorf("can't get certificate: %w", err)
+	}
+
+	certExists, err := c.keyEntryExists(certificateEntryTitle(id))
+	if err != nil {
+		return nil, err
+	}
+	if !certExists {
+		return nil, fmt.Errorf("no certificate for '%s': %w", name, ErrKeyNotFound)
+	}
+	return c.Keystore.GetKey(certificateEntryTitle(id))
+}
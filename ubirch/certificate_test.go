@@ -0,0 +1,143 @@
+/*
+ * Copyright (c) 2019 ubirch GmbH.
+ *
+ * ```
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * ```
+ */
+
+package ubirch
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testCertificateOptions are the options used for the certificate tests
+var testCertificateOptions = CertificateOptions{
+	Country:            "DE",
+	Organization:       "Test GmbH",
+	OrganizationalUnit: "Devices",
+	Locality:           "Berlin",
+	UUIDURI:            true,
+	URIs:               []string{"https://example.com/devices/A"},
+	KeyUsage:           x509.KeyUsageDigitalSignature | x509.KeyUsageContentCommitment,
+	ExtKeyUsage:        []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+}
+
+// TestCryptoContext_GetCSRWithOptions tests the creation of a CSR with the full set of options
+//		the subject, SAN URIs and key usage extensions are set as requested
+//		the key usage extensions are encoded the same way the x509 library encodes them for certificates
+func TestCryptoContext_GetCSRWithOptions(t *testing.T) {
+	asserter := assert.New(t)
+	requirer := require.New(t)
+	p, err := newProtocolContextSigner(defaultName, defaultUUID, defaultPriv, "")
+	requirer.NoError(err, "creating protocol context failed")
+
+	_, err = p.GetCSRWithOptions("NOBODY", testCertificateOptions)
+	asserter.Error(err, "getting CSR for unknown name did not fail")
+	invalidOptions := testCertificateOptions
+	invalidOptions.URIs = []string{"%%"}
+	_, err = p.GetCSRWithOptions(defaultName, invalidOptions)
+	asserter.Error(err, "getting CSR with invalid URI did not fail")
+
+	csr, err := p.GetCSRWithOptions(defaultName, testCertificateOptions)
+	requirer.NoError(err, "getting CSR failed")
+	request, err := x509.ParseCertificateRequest(csr)
+	requirer.NoError(err, "parsing CSR failed")
+	asserter.NoError(request.CheckSignature(), "CSR signature invalid")
+
+	asserter.Equal([]string{"DE"}, request.Subject.Country)
+	asserter.Equal([]string{"Test GmbH"}, request.Subject.Organization)
+	asserter.Equal([]string{"Devices"}, request.Subject.OrganizationalUnit)
+	asserter.Equal([]string{"Berlin"}, request.Subject.Locality)
+	asserter.Empty(request.Subject.Province)
+	asserter.Equal(defaultUUID, request.Subject.CommonName)
+	requirer.Len(request.URIs, 2)
+	asserter.Equal("urn:uuid:"+defaultUUID, request.URIs[0].String())
+	asserter.Equal("https://example.com/devices/A", request.URIs[1].String())
+
+	cert, err := p.CreateSelfSignedCertificate(defaultName, testCertificateOptions)
+	requirer.NoError(err, "creating certificate failed")
+	certificate, err := x509.ParseCertificate(cert)
+	requirer.NoError(err, "parsing certificate failed")
+
+	for _, oid := range []string{oidExtensionKeyUsage.String(), oidExtensionExtKeyUsage.String()} {
+		var csrValue, certValue []byte
+		for _, extension := range request.Extensions {
+			if extension.Id.String() == oid {
+				csrValue = extension.Value
+			}
+		}
+		for _, extension := range certificate.Extensions {
+			if extension.Id.String() == oid {
+				certValue = extension.Value
+			}
+		}
+		asserter.NotNilf(csrValue, "extension %s missing in CSR", oid)
+		asserter.Equalf(certValue, csrValue, "extension %s of CSR differs from certificate", oid)
+	}
+}
+
+// TestCryptoContext_Certificate tests creating, storing and loading a self-signed certificate
+func TestCryptoContext_Certificate(t *testing.T) {
+	asserter := assert.New(t)
+	requirer := require.New(t)
+	p, err := newProtocolContextSigner(defaultName, defaultUUID, defaultPriv, "")
+	requirer.NoError(err, "creating protocol context failed")
+	requirer.NoError(p.GenerateKey("other", uuid.New()), "generating key failed")
+
+	_, err = p.GetCertificate(defaultName)
+	asserter.Error(err, "getting non existing certificate did not fail")
+
+	options := testCertificateOptions
+	options.NotBefore = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	options.NotAfter = options.NotBefore.AddDate(0, 0, -1)
+	_, err = p.CreateSelfSignedCertificate(defaultName, options)
+	asserter.Error(err, "creating certificate with invalid validity did not fail")
+
+	options.NotAfter = options.NotBefore.AddDate(1, 0, 0)
+	cert, err := p.CreateSelfSignedCertificate(defaultName, options)
+	requirer.NoError(err, "creating certificate failed")
+	certificate, err := x509.ParseCertificate(cert)
+	requirer.NoError(err, "parsing certificate failed")
+	asserter.NoError(certificate.CheckSignature(certificate.SignatureAlgorithm, certificate.RawTBSCertificate, certificate.Signature),
+		"certificate is not self-signed")
+	asserter.Equal(options.NotBefore, certificate.NotBefore)
+	asserter.Equal(options.NotAfter, certificate.NotAfter)
+	asserter.Equal(options.KeyUsage, certificate.KeyUsage)
+	asserter.Equal(options.ExtKeyUsage, certificate.ExtKeyUsage)
+	asserter.Equal(defaultUUID, certificate.Subject.CommonName)
+
+	// the certificate does not belong to the other identity
+	asserter.Error(p.SetCertificate("other", cert), "storing certificate of other key did not fail")
+	asserter.Error(p.SetCertificate(defaultName, cert[1:]), "storing invalid certificate did not fail")
+
+	// PEM and DER certificates can be stored, DER is returned
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert})
+	requirer.NoError(p.SetCertificate(defaultName, certPEM), "storing PEM certificate failed")
+	storedCert, err := p.GetCertificate(defaultName)
+	requirer.NoError(err, "getting certificate failed")
+	asserter.Equal(cert, storedCert, "stored certificate does not match")
+
+	requirer.NoError(p.DeleteIdentity(defaultName), "deleting identity failed")
+	keynames, err := p.Crypto.(*CryptoContext).Keystore.GetKeyNames()
+	requirer.NoError(err, "listing keystore failed")
+	asserter.NotContains(keynames, certificateEntryTitle(uuid.MustParse(defaultUUID)), "certificate of deleted identity still present")
+}
@@ -0,0 +1,89 @@
+/*
+ * Copyright (c) 2019 ubirch GmbH.
+ *
+ * ```
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * ```
+ */
+
+// ubirch-mock-backend serves a mock of the ubirch backend (key service, ingestion and verification endpoint)
+// for integration tests of devices.
+//
+// Usage:
+//	ubirch-mock-backend [-addr <address>] [-any-token] [-token <uuid>=<auth token> ...]
+//
+// The URLs of the endpoints and the public key of the backend, which signs the response UPPs,
+// are printed at startup.
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/ubirch/ubirch-protocol-go/ubirch/v2/backend/mock"
+)
+
+// tokenFlags collects the auth tokens given with -token
+type tokenFlags map[uuid.UUID]string
+
+func (t tokenFlags) String() string {
+	return fmt.Sprintf("%d tokens", len(t))
+}
+
+func (t tokenFlags) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("expected <uuid>=<auth token>")
+	}
+	id, err := uuid.Parse(parts[0])
+	if err != nil {
+		return err
+	}
+	t[id] = parts[1]
+	return nil
+}
+
+func main() {
+	tokens := tokenFlags{}
+	addr := flag.String("addr", "localhost:8080", "address to listen on")
+	anyToken := flag.Bool("any-token", false, "accept UPPs with any auth token")
+	flag.Var(tokens, "token", "auth token of a UUID as <uuid>=<auth token>, can be repeated")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [-addr <address>] [-any-token] [-token <uuid>=<auth token> ...]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	b, err := mock.New()
+	if err != nil {
+		log.Fatalf("unable to create mock backend: %v", err)
+	}
+	b.AllowAnyToken = *anyToken
+	for id, token := range tokens {
+		b.SetAuthToken(id, token)
+	}
+
+	urls := b.URLs("http://" + *addr)
+	fmt.Printf("key service:         %s\n", urls.KeyService)
+	fmt.Printf("ingestion endpoint:  %s\n", urls.Niomon)
+	fmt.Printf("verify endpoint:     %s\n", urls.Verify)
+	fmt.Printf("backend public key:  %s\n", hex.EncodeToString(b.PublicKey()))
+
+	log.Fatal(http.ListenAndServe(*addr, b))
+}
@@ -0,0 +1,114 @@
+/*
+ * Copyright (c) 2019 ubirch GmbH.
+ *
+ * ```
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * ```
+ */
+
+// ubirch-verify-bundle verifies verification bundles created with Protocol.ExportBundle offline.
+//
+// Usage:
+//	ubirch-verify-bundle [-pubkey <file>] <bundle.json> [<bundle.json> ...]
+//
+// If a trusted public key is given (in any format supported by ubirch.ParsePublicKey), the
+// bundles must have been created with this key. The exit code is 0 if all bundles are valid.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"github.com/ubirch/ubirch-protocol-go/ubirch/v2"
+)
+
+func main() {
+	pubKeyFile := flag.String("pubkey", "", "file containing the trusted public key of the signer")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [-pubkey <file>] <bundle.json> [<bundle.json> ...]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var trustedPubKey []byte
+	if *pubKeyFile != "" {
+		data, err := ioutil.ReadFile(*pubKeyFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to read public key: %v\n", err)
+			os.Exit(2)
+		}
+		trustedPubKey, err = ubirch.ParsePublicKey(data, ubirch.FormatAuto)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to parse public key: %v\n", err)
+			os.Exit(2)
+		}
+	}
+
+	failed := false
+	for _, filename := range flag.Args() {
+		err := verifyBundleFile(filename, trustedPubKey)
+		if err != nil {
+			fmt.Printf("%s: INVALID: %v\n", filename, err)
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// verifyBundleFile verifies a bundle file and prints a summary of its content
+func verifyBundleFile(filename string, trustedPubKey []byte) error {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+
+	bundle, err := ubirch.VerifyBundle(data)
+	if err != nil {
+		return err
+	}
+
+	if trustedPubKey != nil {
+		bundlePubKey, err := ubirch.ParsePublicKey([]byte(bundle.PublicKey), ubirch.FormatPEM)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(bundlePubKey, trustedPubKey) {
+			return fmt.Errorf("bundle was not created with the trusted public key")
+		}
+	}
+
+	fmt.Printf("%s: OK\n", filename)
+	fmt.Printf("  UUID:        %s\n", bundle.UUID)
+	fmt.Printf("  created:     %s\n", bundle.Created)
+	fmt.Printf("  UPPs:        %d\n", len(bundle.UPPs))
+	fmt.Printf("  certificate: %t\n", len(bundle.Certificate) != 0)
+	keys := make([]string, 0, len(bundle.Metadata))
+	for key := range bundle.Metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Printf("  %s: %s\n", key, bundle.Metadata[key])
+	}
+	return nil
+}
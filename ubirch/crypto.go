@@ -19,17 +19,20 @@
 package ubirch
 
 import (
+	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/asn1"
 	"encoding/pem"
-	"errors"
 	"fmt"
 	"math/big"
 	"reflect"
+	"sort"
 
 	"github.com/google/uuid"
 )
@@ -45,28 +48,57 @@ const (
 	nistp256SignatureLength = nistp256RLength + nistp256SLength //Bytes, Signature = concatenate(R,S)
 )
 
+// KeyType definition
+type KeyType string
+
+const (
+	ECDSAP256 KeyType = "ecdsa-p256v1" // ECDSA with the NIST P-256 curve
+	ED25519   KeyType = "ed25519"      // Ed25519, only supported for verification
+)
+
+// Identity describes an identity (name and UUID) known to the crypto context
+type Identity struct {
+	Name          string
+	UUID          uuid.UUID
+	HasPrivateKey bool    // true if a private key for the UUID exists in the keystore
+	KeyType       KeyType // the type of the public key, empty if there is no public key
+	KeyErr        error   // set if the public key can't be decoded, KeyType is empty then
+}
+
 // CryptoContext contains the key store, a mapping for names -> UUIDs
 // and the last generated signature per UUID.
 type CryptoContext struct {
 	Keystore Keystorer
 	Names    map[string]uuid.UUID
+
+	// DeterministicSignatures enables deterministic ECDSA signatures (RFC 6979), so signing the same
+	// data with the same key always results in the same signature. Signatures are randomized by default.
+	// The deterministic signer is not constant time like crypto/ecdsa, only enable it where timing of
+	// signature operations can't be observed by an attacker.
+	DeterministicSignatures bool `json:"-"`
+
+	// Instrumentation optionally reports logs and metrics of key generation and keystore errors
+	Instrumentation *Instrumentation `json:"-"`
+
+	// KeyCache optionally caches the decoded keys, so they are not decrypted and decoded on every use
+	KeyCache *KeyCache `json:"-"`
 }
 
 // Ensure CryptoContext implements the Crypto interface
 var _ Crypto = (*CryptoContext)(nil)
 
 // encodePrivateKey encodes the Private Key as x509 and returns the encoded PEM
-func encodePrivateKey(privateKey *ecdsa.PrivateKey) ([]byte, error) {
+func encodePrivateKey(privateKey *ecdsa.PrivateKey, headers map[string]string) ([]byte, error) {
 	x509Encoded, err := x509.MarshalECPrivateKey(privateKey)
 	if err != nil {
 		return nil, err
 	}
-	pemEncoded := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: x509Encoded})
+	pemEncoded := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Headers: headers, Bytes: x509Encoded})
 	return pemEncoded, nil
 }
 
 // encodePublicKey encodes the Public Key as x509 and returns the encoded PEM
-func encodePublicKey(publicKey *ecdsa.PublicKey) ([]byte, error) {
+func encodePublicKey(publicKey crypto.PublicKey) ([]byte, error) {
 	x509EncodedPub, err := x509.MarshalPKIXPublicKey(publicKey)
 	if err != nil {
 		return nil, err
@@ -85,8 +117,21 @@ func decodePrivateKey(pemEncoded []byte) (*ecdsa.PrivateKey, error) {
 	return x509.ParseECPrivateKey(x509Encoded)
 }
 
-// decodePublicKey decodes a Public Key from the x509 PEM format and returns the Public Key
+// decodePublicKey decodes an ECDSA Public Key from the x509 PEM format and returns the Public Key
 func decodePublicKey(pemEncoded []byte) (*ecdsa.PublicKey, error) {
+	genericPublicKey, err := decodeVerificationKey(pemEncoded)
+	if err != nil {
+		return nil, err
+	}
+	pubKey, ok := genericPublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("public key is not an ECDSA key: %T", genericPublicKey)
+	}
+	return pubKey, nil
+}
+
+// decodeVerificationKey decodes a Public Key of any supported key type from the x509 PEM format
+func decodeVerificationKey(pemEncoded []byte) (crypto.PublicKey, error) {
 	block, _ := pem.Decode(pemEncoded)
 	if block == nil {
 		return nil, fmt.Errorf("unable to parse PEM block")
@@ -95,7 +140,217 @@ func decodePublicKey(pemEncoded []byte) (*ecdsa.PublicKey, error) {
 	if err != nil {
 		return nil, err
 	}
-	return genericPublicKey.(*ecdsa.PublicKey), nil
+	if _, err := keyTypeOf(genericPublicKey); err != nil {
+		return nil, err
+	}
+	return genericPublicKey, nil
+}
+
+// keyTypeOf returns the KeyType of a public key or an error, if the key type is not supported
+func keyTypeOf(pub crypto.PublicKey) (KeyType, error) {
+	switch k := pub.(type) {
+	case *ecdsa.PublicKey:
+		if k.Curve.Params().Name == "P-256" {
+			return ECDSAP256, nil
+		}
+		return "", fmt.Errorf("unsupported curve: %s", k.Curve.Params().Name)
+	case ed25519.PublicKey:
+		return ED25519, nil
+	default:
+		return "", fmt.Errorf("unsupported public key type: %T", pub)
+	}
+}
+
+// rawPublicKey returns the raw bytes of a public key, 64 bytes (X||Y) for NIST P-256 keys
+// and 32 bytes for Ed25519 keys
+func rawPublicKey(pub crypto.PublicKey) ([]byte, error) {
+	switch k := pub.(type) {
+	case *ecdsa.PublicKey:
+		return publicKeyToBytes(k)
+	case ed25519.PublicKey:
+		return append([]byte{}, k...), nil
+	default:
+		return nil, fmt.Errorf("unsupported public key type: %T", pub)
+	}
+}
+
+// publicKeyFromBytes creates a NIST P-256 public key from its raw bytes (64 bytes, X||Y)
+func publicKeyFromBytes(pubKeyBytes []byte) (*ecdsa.PublicKey, error) {
+	if len(pubKeyBytes) != nistp256PubkeyLength {
+		return nil, fmt.Errorf("public key length wrong: %d != %d", len(pubKeyBytes), nistp256PubkeyLength)
+	}
+
+	pubKey := new(ecdsa.PublicKey)
+	pubKey.Curve = elliptic.P256()
+	pubKey.X = &big.Int{}
+	pubKey.X.SetBytes(pubKeyBytes[0:nistp256XLength])
+	pubKey.Y = &big.Int{}
+	pubKey.Y.SetBytes(pubKeyBytes[nistp256XLength:(nistp256XLength + nistp256YLength)])
+
+	if !pubKey.IsOnCurve(pubKey.X, pubKey.Y) {
+		return nil, fmt.Errorf("invalid public key value: point not on curve")
+	}
+	return pubKey, nil
+}
+
+// publicKeyToBytes returns the raw bytes (64 bytes, X||Y) of a NIST P-256 public key
+func publicKeyToBytes(pubKey *ecdsa.PublicKey) ([]byte, error) {
+	if pubKey.Curve.Params().Name != "P-256" {
+		return nil, fmt.Errorf("public key has unexpected type: %s", pubKey.Curve.Params().Name)
+	}
+
+	pubKeyBytes := make([]byte, 0, nistp256PubkeyLength)
+
+	//copy only the bytes vailable in X/Y.Bytes() while preverving the leading zeroes in paddedX/Y
+	//this ensures pubkeybytes is always the correct size even if X/Y could be representend in
+	//less bytes (and thus X/Y.bytes will actually return less bytes)
+	paddedX := make([]byte, nistp256XLength)
+	paddedY := make([]byte, nistp256YLength)
+	copy(paddedX[nistp256XLength-len(pubKey.X.Bytes()):], pubKey.X.Bytes())
+	copy(paddedY[nistp256YLength-len(pubKey.Y.Bytes()):], pubKey.Y.Bytes())
+	pubKeyBytes = append(pubKeyBytes, paddedX...)
+	pubKeyBytes = append(pubKeyBytes, paddedY...)
+
+	return pubKeyBytes, nil
+}
+
+// privateKeyFromBytes creates a NIST P-256 private key from its raw bytes (32 bytes) and calculates the public key
+func privateKeyFromBytes(privKeyBytes []byte) (*ecdsa.PrivateKey, error) {
+	if len(privKeyBytes) != nistp256PrivkeyLength {
+		return nil, fmt.Errorf("private key lenght wrong: %d != %d", len(privKeyBytes), nistp256PrivkeyLength)
+	}
+
+	privKey := new(ecdsa.PrivateKey)
+	privKey.D = new(big.Int)
+	privKey.D.SetBytes(privKeyBytes)
+	privKey.PublicKey.Curve = elliptic.P256()
+
+	curveOrder := privKey.PublicKey.Curve.Params().N
+	if privKey.D.Cmp(curveOrder) >= 0 {
+		return nil, fmt.Errorf("invalid private key value: value is greater or equal curve order")
+	}
+	if privKey.D.Sign() == 0 {
+		return nil, fmt.Errorf("invalid private key value: value is zero")
+	}
+
+	privKey.PublicKey.X, privKey.PublicKey.Y = privKey.PublicKey.Curve.ScalarBaseMult(privKeyBytes)
+	return privKey, nil
+}
+
+// privateKeyToBytes returns the raw bytes (32 bytes) of a NIST P-256 private key
+func privateKeyToBytes(privKey *ecdsa.PrivateKey) ([]byte, error) {
+	if privKey.Curve.Params().Name != "P-256" {
+		return nil, fmt.Errorf("private key has unexpected type: %s", privKey.Curve.Params().Name)
+	}
+
+	//pad with leading zeroes, if D can be represented in less bytes
+	privKeyBytes := make([]byte, nistp256PrivkeyLength)
+	dBytes := privKey.D.Bytes()
+	copy(privKeyBytes[nistp256PrivkeyLength-len(dBytes):], dBytes)
+	return privKeyBytes, nil
+}
+
+// verifyECDSA verifies a raw (R||S) signature of the SHA256 hash of 'data' with the given public key
+func verifyECDSA(pub *ecdsa.PublicKey, data []byte, signature []byte) (bool, error) {
+	if len(signature) != nistp256SignatureLength {
+		return false, fmt.Errorf("wrong signature length: expected: %d, got: %d", nistp256SignatureLength, len(signature))
+	}
+
+	r, s := &big.Int{}, &big.Int{}
+	r.SetBytes(signature[:nistp256RLength])
+	s.SetBytes(signature[nistp256SLength:])
+
+	hash := sha256.Sum256(data)
+	return ecdsa.Verify(pub, hash[:], r, s), nil
+}
+
+// verifySignature verifies the signature of 'data' with the given public key, using the signature scheme of the key type:
+// ECDSA with SHA256 and a raw (R||S) signature for NIST P-256 keys, and Ed25519 for Ed25519 keys
+func verifySignature(pub crypto.PublicKey, data []byte, signature []byte) (bool, error) {
+	switch k := pub.(type) {
+	case *ecdsa.PublicKey:
+		return verifyECDSA(k, data, signature)
+	case ed25519.PublicKey:
+		if len(signature) != ed25519.SignatureSize {
+			return false, fmt.Errorf("wrong signature length: expected: %d, got: %d", ed25519.SignatureSize, len(signature))
+		}
+		return ed25519.Verify(k, data, signature), nil
+	default:
+		return false, fmt.Errorf("unsupported public key type: %T", pub)
+	}
+}
+
+// VerifySignatureWithPublicKey verifies a signature of 'data' with the given public key, which can be given
+// in the formats supported by VerifyUPPWithPublicKey. The signature scheme depends on the type of the key:
+// ECDSA with SHA256 for NIST P-256 keys, with a raw (64 bytes, R||S) or ASN.1 DER encoded signature, and
+// Ed25519 for Ed25519 keys. Returns 'true' and 'nil' error if the signature was verifiable.
+func VerifySignatureWithPublicKey(pubKey []byte, format KeyFormat, data []byte, signature []byte) (bool, error) {
+	pub, err := parseVerificationKey(pubKey, format)
+	if err != nil {
+		return false, fmt.Errorf("invalid public key: %w", err)
+	}
+	if _, isECDSA := pub.(*ecdsa.PublicKey); isECDSA && len(signature) != nistp256SignatureLength {
+		signature, err = SignatureFromDER(signature)
+		if err != nil {
+			return false, err
+		}
+	}
+	return verifySignature(pub, data, signature)
+}
+
+// ecdsaSignature is the ASN.1 structure of an ECDSA signature (RFC 3279, section 2.2.3)
+type ecdsaSignature struct {
+	R, S *big.Int
+}
+
+// SignatureToDER converts a raw NIST P-256 signature (64 bytes, R||S) into an ASN.1 DER encoded signature.
+func SignatureToDER(signature []byte) ([]byte, error) {
+	if len(signature) != nistp256SignatureLength {
+		return nil, fmt.Errorf("wrong signature length: expected: %d, got: %d", nistp256SignatureLength, len(signature))
+	}
+
+	r, s := &big.Int{}, &big.Int{}
+	r.SetBytes(signature[:nistp256RLength])
+	s.SetBytes(signature[nistp256RLength:])
+	if r.Sign() == 0 || s.Sign() == 0 {
+		return nil, fmt.Errorf("invalid signature: R or S is zero")
+	}
+	return asn1.Marshal(ecdsaSignature{R: r, S: s})
+}
+
+// SignatureFromDER converts an ASN.1 DER encoded NIST P-256 signature into a raw signature (64 bytes, R||S).
+func SignatureFromDER(der []byte) ([]byte, error) {
+	var sig ecdsaSignature
+	rest, err := asn1.Unmarshal(der, &sig)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse DER signature: %v", err)
+	}
+	if len(rest) != 0 {
+		return nil, fmt.Errorf("unable to parse DER signature: %d bytes of trailing data", len(rest))
+	}
+	if sig.R.Sign() <= 0 || sig.S.Sign() <= 0 {
+		return nil, fmt.Errorf("invalid DER signature: R and S must be positive")
+	}
+	if sig.R.BitLen() > nistp256RLength*8 || sig.S.BitLen() > nistp256SLength*8 {
+		return nil, fmt.Errorf("invalid DER signature: R or S too large")
+	}
+
+	//pad R and S with leading zeroes, if they can be represented in less bytes
+	signature := make([]byte, nistp256SignatureLength)
+	rBytes, sBytes := sig.R.Bytes(), sig.S.Bytes()
+	copy(signature[nistp256RLength-len(rBytes):nistp256RLength], rBytes)
+	copy(signature[nistp256SignatureLength-len(sBytes):], sBytes)
+	return signature, nil
+}
+
+// checkKeystore returns an error wrapping ErrKeystoreNil, if the keystore of the context is not set
+func (c *CryptoContext) checkKeystore() error {
+	if c.Keystore == nil { //check for 'direct' nil
+		return ErrKeystoreNil
+	} else if reflect.ValueOf(c.Keystore).IsNil() { //check for pointer which is nil
+		return fmt.Errorf("%w, pointer type is %T", ErrKeystoreNil, c.Keystore)
+	}
+	return nil
 }
 
 // privKeyEntryTitle returns a string of the Private Key Entry
@@ -108,29 +363,23 @@ func pubKeyEntryTitle(id uuid.UUID) string {
 	return id.String()
 }
 
-//func signatureToPoints(signature []byte) (r, s *big.Int, err error) {
-//	r, s = &big.Int{}, &big.Int{}
-//
-//	data := asn1.RawValue{}
-//	_, err = asn1.Unmarshal(signature, &data)
-//	if err != nil {
-//		return nil, nil, err
-//	}
-//
-//	rLen := data.Bytes[1]
-//	r.SetBytes(data.Bytes[2 : rLen+2])
-//	s.SetBytes(data.Bytes[rLen+4:])
-//
-//	return r, s, nil
-//}
-
-// storePrivateKey stores the private Key, returns 'nil', if successful
-func (c *CryptoContext) storePrivateKey(name string, id uuid.UUID, k *ecdsa.PrivateKey) error {
+// exportableEntryTitle returns a string of the entry which marked a Private Key as exportable in earlier
+// versions. The mark wasn't bound to the key, it is only removed now.
+func exportableEntryTitle(id uuid.UUID) string {
+	return privKeyEntryTitle(id) + "_exportable"
+}
+
+// pubKeyHistoryEntryTitle returns a string of the Public Key History Entry
+func pubKeyHistoryEntryTitle(id uuid.UUID) string {
+	return id.String() + "_history"
+}
+
+// storePrivateKey stores the private Key, returns 'nil', if successful. An exportable key is marked
+// with a PEM header inside the encrypted entry.
+func (c *CryptoContext) storePrivateKey(name string, id uuid.UUID, k *ecdsa.PrivateKey, exportable bool) error {
 	//check for invalid keystore
-	if c.Keystore == nil { //check for 'direct' nil
-		return fmt.Errorf("can't set private key: keystore is nil")
-	} else if reflect.ValueOf(c.Keystore).IsNil() { //check for pointer which is nil
-		return fmt.Errorf("can't set private key: keystore pointer is nil, pointer type is %T", c.Keystore)
+	if err := c.checkKeystore(); err != nil {
+		return fmt.Errorf("can't set private key: %w", err)
 	}
 
 	if c.Names == nil {
@@ -138,20 +387,27 @@ func (c *CryptoContext) storePrivateKey(name string, id uuid.UUID, k *ecdsa.Priv
 	}
 	c.Names[name] = id
 
-	privKeyBytes, err := encodePrivateKey(k)
+	var headers map[string]string
+	if exportable {
+		headers = map[string]string{exportableHeader: id.String()}
+	}
+	privKeyBytes, err := encodePrivateKey(k, headers)
 	if err != nil {
 		return err
 	}
-	return c.Keystore.SetKey(privKeyEntryTitle(id), privKeyBytes)
+	c.KeyCache.Invalidate(id)
+	err = c.Keystore.SetKey(privKeyEntryTitle(id), privKeyBytes)
+	if err != nil {
+		c.Instrumentation.keystoreError(err, "set private key", id)
+	}
+	return err
 }
 
 // storePublicKey stores the public Key, returns 'nil', if successful
-func (c *CryptoContext) storePublicKey(name string, id uuid.UUID, k *ecdsa.PublicKey) error {
+func (c *CryptoContext) storePublicKey(name string, id uuid.UUID, k crypto.PublicKey) error {
 	//check for invalid keystore
-	if c.Keystore == nil { //check for 'direct' nil
-		return fmt.Errorf("can't set public key: keystore is nil")
-	} else if reflect.ValueOf(c.Keystore).IsNil() { //check for pointer which is nil
-		return fmt.Errorf("can't set public key: keystore pointer is nil, pointer type is %T", c.Keystore)
+	if err := c.checkKeystore(); err != nil {
+		return fmt.Errorf("can't set public key: %w", err)
 	}
 
 	if c.Names == nil {
@@ -163,61 +419,125 @@ func (c *CryptoContext) storePublicKey(name string, id uuid.UUID, k *ecdsa.Publi
 	if err != nil {
 		return err
 	}
-	return c.Keystore.SetKey(pubKeyEntryTitle(id), pubKeyBytes)
+
+	// the public key history only supports NIST P-256 keys
+	if ecdsaKey, ok := k.(*ecdsa.PublicKey); ok {
+		err = c.recordPublicKeyRotation(id, ecdsaKey)
+		if err != nil {
+			return err
+		}
+	}
+	c.KeyCache.Invalidate(id)
+	err = c.Keystore.SetKey(pubKeyEntryTitle(id), pubKeyBytes)
+	if err != nil {
+		c.Instrumentation.keystoreError(err, "set public key", id)
+	}
+	return err
 }
 
-// getDecodedPrivateKey gets the decoded private key for the given name.
+// getDecodedPrivateKey gets the decoded private key for the given name. The returned key is a copy
+// owned by the caller (the key cache keeps its own), callers zeroize it when done with it.
 func (c *CryptoContext) getDecodedPrivateKey(id uuid.UUID) (*ecdsa.PrivateKey, error) {
 	//check for invalid keystore
-	if c.Keystore == nil { //check for 'direct' nil
-		return nil, fmt.Errorf("can't get private key: keystore is nil")
-	} else if reflect.ValueOf(c.Keystore).IsNil() { //check for pointer which is nil
-		return nil, fmt.Errorf("can't get private key: keystore pointer is nil, pointer type is %T", c.Keystore)
+	if err := c.checkKeystore(); err != nil {
+		return nil, &KeyError{Op: "get private key", UUID: id, Err: err}
+	}
+
+	// cached keys must not be used while the keystore is locked
+	lockable, _ := c.Keystore.(interface{ IsLocked() bool })
+	if lockable != nil && lockable.IsLocked() {
+		c.KeyCache.Purge()
+		return nil, &KeyError{Op: "get private key", UUID: id, Err: ErrKeystoreLocked}
+	}
+
+	if cached := c.KeyCache.getPrivateKey(id); cached != nil {
+		return cached, nil
+	}
+
+	// the keystore purges the cache when it is locked
+	if purging, ok := c.Keystore.(interface{ purgeOnLock(*KeyCache) }); ok {
+		purging.purgeOnLock(c.KeyCache)
 	}
 
 	// get encoded private key from keystore
 	privKey, err := c.Keystore.GetKey(privKeyEntryTitle(id))
 	if err != nil {
-		return nil, err
+		c.Instrumentation.keystoreError(err, "get private key", id)
+		return nil, &KeyError{Op: "get private key", UUID: id, Err: err}
 	}
 
 	// decode the key
-	return decodePrivateKey(privKey)
+	decoded, err := decodePrivateKey(privKey)
+	if err != nil {
+		return nil, err
+	}
+	c.KeyCache.putPrivateKey(id, decoded)
+	// the keystore may have been locked after the key was read, before it was cached
+	if lockable != nil && lockable.IsLocked() {
+		c.KeyCache.Purge()
+	}
+	return decoded, nil
 }
 
-// getDecodedPublicKey gets the decoded public key for the given name.
+// getDecodedPublicKey gets the decoded ECDSA public key for the given name.
 func (c *CryptoContext) getDecodedPublicKey(id uuid.UUID) (*ecdsa.PublicKey, error) {
+	genericPublicKey, err := c.getVerificationKey(id)
+	if err != nil {
+		return nil, err
+	}
+	pubKey, ok := genericPublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, &KeyError{Op: "get public key", UUID: id, Err: fmt.Errorf("public key is not an ECDSA key: %T", genericPublicKey)}
+	}
+	return pubKey, nil
+}
+
+// getVerificationKey gets the decoded public key of any supported key type for the given name.
+func (c *CryptoContext) getVerificationKey(id uuid.UUID) (crypto.PublicKey, error) {
 	//check for invalid keystore
-	if c.Keystore == nil { //check for 'direct' nil
-		return nil, fmt.Errorf("can't get public key: keystore is nil")
-	} else if reflect.ValueOf(c.Keystore).IsNil() { //check for pointer which is nil
-		return nil, fmt.Errorf("can't get public key: keystore pointer is nil, pointer type is %T", c.Keystore)
+	if err := c.checkKeystore(); err != nil {
+		return nil, &KeyError{Op: "get public key", UUID: id, Err: err}
+	}
+
+	if cached := c.KeyCache.getPublicKey(id); cached != nil {
+		return cached, nil
 	}
 
 	// get encoded public key from keystore
 	pubKey, err := c.Keystore.GetKey(pubKeyEntryTitle(id))
 	if err != nil {
-		return nil, err
+		c.Instrumentation.keystoreError(err, "get public key", id)
+		return nil, &KeyError{Op: "get public key", UUID: id, Err: err}
 	}
 
 	// decode the key
-	return decodePublicKey(pubKey)
+	decoded, err := decodeVerificationKey(pubKey)
+	if err != nil {
+		return nil, err
+	}
+	c.KeyCache.putPublicKey(id, decoded)
+	return decoded, nil
 }
 
-// storeKey stores the Private Key, as well as the Public Key, returns 'nil', if successful
-func (c *CryptoContext) storeKey(name string, id uuid.UUID, k *ecdsa.PrivateKey) error {
+// storeKey stores the Private Key, as well as the Public Key, returns 'nil', if successful.
+// The private key can only be exported later on, if 'exportable' is set.
+func (c *CryptoContext) storeKey(name string, id uuid.UUID, k *ecdsa.PrivateKey, exportable bool) error {
 	err := c.storePublicKey(name, id, &k.PublicKey)
 	if err != nil {
 		return err
 	}
-	return c.storePrivateKey(name, id, k)
+	err = c.storePrivateKey(name, id, k, exportable)
+	if err != nil {
+		return err
+	}
+	return c.Keystore.DeleteKey(exportableEntryTitle(id))
 }
 
 // GetUUID gets the uuid that is related the given name.
 func (c *CryptoContext) GetUUID(name string) (uuid.UUID, error) {
 	id, found := c.Names[name]
 	if !found {
-		return uuid.Nil, errors.New(fmt.Sprintf("no uuid/key entry for '%s'", name))
+		return uuid.Nil, &UnknownNameError{Name: name}
 	}
 	return id, nil
 }
@@ -226,10 +546,10 @@ func (c *CryptoContext) GetUUID(name string) (uuid.UUID, error) {
 func (c *CryptoContext) GenerateKey(name string, id uuid.UUID) error {
 	// check for empty name
 	if name == "" {
-		return errors.New(fmt.Sprintf("generating key for empty name not possible"))
+		return fmt.Errorf("generating key not possible: %w", ErrEmptyName)
 	}
 	if id == uuid.Nil {
-		return errors.New(fmt.Sprintf("generating key for uuid = \"Nil\" not possible"))
+		return fmt.Errorf("generating key not possible: %w", ErrNilUUID)
 	}
 
 	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
@@ -237,31 +557,29 @@ func (c *CryptoContext) GenerateKey(name string, id uuid.UUID) error {
 		return err
 	}
 
-	return c.storeKey(name, id, k)
+	err = c.storeKey(name, id, k, false)
+	if err != nil {
+		return err
+	}
+	c.Instrumentation.info("generated key", "name", name, "uuid", id.String())
+	return nil
 }
 
 //SetPublicKey sets the public key (64 bytes)
 func (c *CryptoContext) SetPublicKey(name string, id uuid.UUID, pubKeyBytes []byte) error {
-	const expectedKeyLength = nistp256PubkeyLength
-	if len(pubKeyBytes) != expectedKeyLength {
-		return fmt.Errorf("public key length wrong: %d != %d", len(pubKeyBytes), expectedKeyLength)
+	if len(pubKeyBytes) != nistp256PubkeyLength {
+		return fmt.Errorf("public key length wrong: %d != %d", len(pubKeyBytes), nistp256PubkeyLength)
 	}
 	if name == "" {
-		return errors.New(fmt.Sprintf("Setting key for empty name not possible"))
+		return fmt.Errorf("setting key not possible: %w", ErrEmptyName)
 	}
 	if id == uuid.Nil {
-		return errors.New(fmt.Sprintf("Setting key for uuid = \"Nil\" not possible"))
+		return fmt.Errorf("setting key not possible: %w", ErrNilUUID)
 	}
 
-	pubKey := new(ecdsa.PublicKey)
-	pubKey.Curve = elliptic.P256()
-	pubKey.X = &big.Int{}
-	pubKey.X.SetBytes(pubKeyBytes[0:nistp256XLength])
-	pubKey.Y = &big.Int{}
-	pubKey.Y.SetBytes(pubKeyBytes[nistp256XLength:(nistp256XLength + nistp256YLength)])
-
-	if !pubKey.IsOnCurve(pubKey.X, pubKey.Y) {
-		return fmt.Errorf("invalid public key value: point not on curve")
+	pubKey, err := publicKeyFromBytes(pubKeyBytes)
+	if err != nil {
+		return err
 	}
 
 	return c.storePublicKey(name, id, pubKey)
@@ -271,27 +589,21 @@ func (c *CryptoContext) SetPublicKey(name string, id uuid.UUID, pubKeyBytes []by
 func (c *CryptoContext) SetKey(name string, id uuid.UUID, privKeyBytes []byte) error {
 	const expectedKeyLength = nistp256PrivkeyLength
 	if len(privKeyBytes) != expectedKeyLength {
-		return errors.New(fmt.Sprintf("private key lenght wrong: %d != %d", len(privKeyBytes), expectedKeyLength))
+		return fmt.Errorf("private key lenght wrong: %d != %d", len(privKeyBytes), expectedKeyLength)
 	}
 	if name == "" {
-		return errors.New(fmt.Sprintf("Setting key for empty name not possible"))
+		return fmt.Errorf("setting key not possible: %w", ErrEmptyName)
 	}
 	if id == uuid.Nil {
-		return errors.New(fmt.Sprintf("Setting key for uuid = \"Nil\" not possible"))
+		return fmt.Errorf("setting key not possible: %w", ErrNilUUID)
 	}
 
-	privKey := new(ecdsa.PrivateKey)
-	privKey.D = new(big.Int)
-	privKey.D.SetBytes(privKeyBytes)
-	privKey.PublicKey.Curve = elliptic.P256()
-	privKey.PublicKey.X, privKey.PublicKey.Y = privKey.PublicKey.Curve.ScalarBaseMult(privKey.D.Bytes())
-
-	curveOrder := privKey.PublicKey.Curve.Params().N
-	if privKey.D.Cmp(curveOrder) >= 0 {
-		return fmt.Errorf("invalid private key value: value is greater or equal curve order")
+	privKey, err := privateKeyFromBytes(privKeyBytes)
+	if err != nil {
+		return err
 	}
 
-	return c.storeKey(name, id, privKey)
+	return c.storeKey(name, id, privKey, false)
 }
 
 // GetCSR gets a certificate signing request.
@@ -314,6 +626,7 @@ func (c *CryptoContext) GetCSR(name string, subjectCountry string, subjectOrgani
 	if err != nil {
 		return nil, err
 	}
+	defer zeroizePrivateKey(priv)
 
 	return x509.CreateCertificateRequest(rand.Reader, template, priv)
 }
@@ -325,27 +638,11 @@ func (c *CryptoContext) GetPublicKey(name string) ([]byte, error) {
 		return nil, err
 	}
 
-	decodedPubKey, err := c.getDecodedPublicKey(id)
+	decodedPubKey, err := c.getVerificationKey(id)
 	if err != nil {
-		return nil, fmt.Errorf("decoding public key from keystore failed: %s", err)
-	}
-	if decodedPubKey.Curve.Params().Name != "P-256" {
-		return nil, fmt.Errorf("public key from keystore has unexpected type: %s", decodedPubKey.Curve.Params().Name)
+		return nil, fmt.Errorf("decoding public key from keystore failed: %w", err)
 	}
-
-	pubKeyBytes := make([]byte, 0, 0)
-
-	//copy only the bytes vailable in X/Y.Bytes() while preverving the leading zeroes in paddedX/Y
-	//this ensures pubkeybytes is always the correct size even if X/Y could be representend in
-	//less bytes (and thus X/Y.bytes will actually return less bytes)
-	paddedX := make([]byte, nistp256XLength)
-	paddedY := make([]byte, nistp256YLength)
-	copy(paddedX[nistp256XLength-len(decodedPubKey.X.Bytes()):], decodedPubKey.X.Bytes())
-	copy(paddedY[nistp256YLength-len(decodedPubKey.Y.Bytes()):], decodedPubKey.Y.Bytes())
-	pubKeyBytes = append(pubKeyBytes, paddedX...)
-	pubKeyBytes = append(pubKeyBytes, paddedY...)
-
-	return pubKeyBytes, nil
+	return rawPublicKey(decodedPubKey)
 }
 
 // PrivateKeyExists Checks if a private key entry for the given name exists in the keystore.
@@ -355,27 +652,145 @@ func (c *CryptoContext) PrivateKeyExists(name string) bool {
 		return false
 	}
 
-	_, err = c.getDecodedPrivateKey(id)
+	priv, err := c.getDecodedPrivateKey(id)
 	if err != nil {
 		return false
 	}
+	zeroizePrivateKey(priv)
 	return true
 }
 
+// keyTypeOfUUID returns the type of the public key of the UUID
+func (c *CryptoContext) keyTypeOfUUID(id uuid.UUID) (KeyType, error) {
+	pub, err := c.getVerificationKey(id)
+	if err != nil {
+		return "", err
+	}
+	return keyTypeOf(pub)
+}
+
+// GetKeyType returns the type of the public key of the UUID. Only the key of the UUID is decoded.
+// Returns a KeyError wrapping ErrUnknownName, if no name refers to the UUID.
+func (c *CryptoContext) GetKeyType(id uuid.UUID) (KeyType, error) {
+	known := false
+	for _, nameID := range c.Names {
+		if nameID == id {
+			known = true
+			break
+		}
+	}
+	if !known {
+		return "", &KeyError{Op: "get key type", UUID: id, Err: ErrUnknownName}
+	}
+	return c.keyTypeOfUUID(id)
+}
+
+// ListIdentities returns all identities known to the context, sorted by name. A public key which can't be
+// decoded does not fail the listing, the error is reported in the KeyErr field of the identity instead.
+func (c *CryptoContext) ListIdentities() ([]Identity, error) {
+	//check for invalid keystore
+	if err := c.checkKeystore(); err != nil {
+		return nil, fmt.Errorf("can't list identities: %w", err)
+	}
+
+	keynames, err := c.Keystore.GetKeyNames()
+	if err != nil {
+		return nil, err
+	}
+	entries := make(map[string]bool, len(keynames))
+	for _, keyname := range keynames {
+		entries[keyname] = true
+	}
+
+	identities := make([]Identity, 0, len(c.Names))
+	for name, id := range c.Names {
+		identity := Identity{
+			Name:          name,
+			UUID:          id,
+			HasPrivateKey: entries[privKeyEntryTitle(id)],
+		}
+		if entries[pubKeyEntryTitle(id)] {
+			identity.KeyType, identity.KeyErr = c.keyTypeOfUUID(id)
+			if identity.KeyErr != nil {
+				identity.KeyErr = fmt.Errorf("decoding public key of '%s' failed: %w", name, identity.KeyErr)
+			}
+		}
+		identities = append(identities, identity)
+	}
+	sort.Slice(identities, func(i, j int) bool { return identities[i].Name < identities[j].Name })
+
+	return identities, nil
+}
+
+// DeleteIdentity removes the name of an identity from the context. The private and public key of the related
+// UUID are deleted from the keystore, if no other name refers to the same UUID.
+func (c *CryptoContext) DeleteIdentity(name string) error {
+	id, err := c.GetUUID(name)
+	if err != nil {
+		return err
+	}
+
+	//check for invalid keystore
+	if err := c.checkKeystore(); err != nil {
+		return fmt.Errorf("can't delete identity: %w", err)
+	}
+
+	sharedID := false
+	for otherName, otherID := range c.Names {
+		if otherName != name && otherID == id {
+			sharedID = true
+			break
+		}
+	}
+
+	if !sharedID {
+		c.KeyCache.Invalidate(id)
+		err = c.Keystore.DeleteKey(privKeyEntryTitle(id))
+		if err != nil {
+			return err
+		}
+		err = c.Keystore.DeleteKey(pubKeyEntryTitle(id))
+		if err != nil {
+			return err
+		}
+		err = c.Keystore.DeleteKey(pubKeyHistoryEntryTitle(id))
+		if err != nil {
+			return err
+		}
+		err = c.Keystore.DeleteKey(exportableEntryTitle(id))
+		if err != nil {
+			return err
+		}
+		err = c.Keystore.DeleteKey(certificateEntryTitle(id))
+		if err != nil {
+			return err
+		}
+	}
+
+	delete(c.Names, name)
+	return nil
+}
+
 // Sign returns the signature for 'data' using the private key of a specific UUID. Need to get the UUID via CryptoContext#GetUUID().
 func (c *CryptoContext) Sign(id uuid.UUID, data []byte) ([]byte, error) {
 	if len(data) == 0 {
-		return nil, errors.New("empty data cannot be signed")
+		return nil, fmt.Errorf("%w: can't be signed", ErrEmptyData)
 	}
 
 	priv, err := c.getDecodedPrivateKey(id)
 	if err != nil {
 		return nil, err
 	}
+	defer zeroizePrivateKey(priv)
 
 	// ecdsa in go does not automatically apply the hashing
 	hash := sha256.Sum256(data)
-	r, s, err := ecdsa.Sign(rand.Reader, priv, hash[:])
+	var r, s *big.Int
+	if c.DeterministicSignatures {
+		r, s, err = signDeterministic(priv, hash[:])
+	} else {
+		r, s, err = ecdsa.Sign(rand.Reader, priv, hash[:])
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -392,25 +807,44 @@ func (c *CryptoContext) Sign(id uuid.UUID, data []byte) ([]byte, error) {
 }
 
 // Verify verifies that 'signature' matches 'data' using the public key with a specific UUID.
+// The signature scheme depends on the type of the public key: raw ECDSA signatures (64 bytes, R||S)
+// of the SHA256 hash of the data for NIST P-256 keys, Ed25519 signatures (64 bytes) for Ed25519 keys.
 // Need to get the UUID via CryptoContext#GetUUID().
 // Returns 'true' and 'nil' error if signature was verifiable.
 func (c *CryptoContext) Verify(id uuid.UUID, data []byte, signature []byte) (bool, error) {
 	if len(data) == 0 {
-		return false, fmt.Errorf("empty data cannot be verified")
+		return false, fmt.Errorf("%w: can't be verified", ErrEmptyData)
 	}
-	if len(signature) != nistp256SignatureLength {
-		return false, fmt.Errorf("wrong signature length: expected: %d, got: %d", nistp256SignatureLength, len(signature))
+	if len(signature) == 0 {
+		return false, fmt.Errorf("%w: can't be verified", ErrEmptySignature)
 	}
 
-	pub, err := c.getDecodedPublicKey(id)
+	pub, err := c.getVerificationKey(id)
 	if err != nil {
 		return false, err
 	}
 
-	r, s := &big.Int{}, &big.Int{}
-	r.SetBytes(signature[:nistp256RLength])
-	s.SetBytes(signature[nistp256SLength:])
+	return verifySignature(pub, data, signature)
+}
 
-	hash := sha256.Sum256(data)
-	return ecdsa.Verify(pub, hash[:], r, s), nil
+// VerifyAnyEncoding verifies that 'signature' matches 'data' using the public key with a specific UUID.
+// Unlike Verify, the signature can either be a raw signature (64 bytes, R||S) or an ASN.1 DER encoded signature.
+// Returns 'true' and 'nil' error if signature was verifiable.
+func (c *CryptoContext) VerifyAnyEncoding(id uuid.UUID, data []byte, signature []byte) (bool, error) {
+	if len(signature) == nistp256SignatureLength {
+		verified, err := c.Verify(id, data, signature)
+		if err != nil || verified {
+			return verified, err
+		}
+	}
+
+	// a DER encoded signature can also be 64 bytes long, so DER is tried if raw verification failed
+	rawSignature, err := SignatureFromDER(signature)
+	if err != nil {
+		if len(signature) == nistp256SignatureLength {
+			return false, nil
+		}
+		return false, err
+	}
+	return c.Verify(id, data, rawSignature)
 }
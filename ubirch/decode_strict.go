@@ -0,0 +1,385 @@
+/*
+ * Copyright (c) 2019 ubirch GmbH.
+ *
+ * ```
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * ```
+ */
+
+package ubirch
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/google/uuid"
+)
+
+const (
+	lenSignedUPPArray  = 5 // version, uuid, hint, payload, signature
+	lenChainedUPPArray = 6 // version, uuid, previous signature, hint, payload, signature
+	lenUUID            = 16
+)
+
+// msgpackReader reads msgpack elements. Unless it is lenient, it rejects all encodings which are not
+// the shortest possible.
+type msgpackReader struct {
+	data    []byte
+	pos     int
+	lenient bool // accept non-minimal encodings and strings as byte arrays
+}
+
+// next returns the next n bytes of the data
+func (r *msgpackReader) next(n int) ([]byte, error) {
+	if n < 0 || len(r.data)-r.pos < n {
+		return nil, fmt.Errorf("unexpected end of data at offset %d", r.pos)
+	}
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b, nil
+}
+
+// readLength reads a big endian length or value of the given size (1, 2, 4 or 8 bytes)
+func (r *msgpackReader) readLength(size int) (uint64, error) {
+	b, err := r.next(size)
+	if err != nil {
+		return 0, err
+	}
+	switch size {
+	case 1:
+		return uint64(b[0]), nil
+	case 2:
+		return uint64(binary.BigEndian.Uint16(b)), nil
+	case 4:
+		return uint64(binary.BigEndian.Uint32(b)), nil
+	default:
+		return binary.BigEndian.Uint64(b), nil
+	}
+}
+
+// readArrayHeader reads an array header and returns the number of elements
+func (r *msgpackReader) readArrayHeader() (int, error) {
+	offset := r.pos
+	header, err := r.next(1)
+	if err != nil {
+		return 0, err
+	}
+
+	var n uint64
+	var minimum uint64
+	switch {
+	case header[0]&0xf0 == 0x90: // fixarray
+		return int(header[0] & 0x0f), nil
+	case header[0] == 0xdc: // array 16
+		n, err = r.readLength(2)
+		minimum = 0x10
+	case header[0] == 0xdd: // array 32
+		n, err = r.readLength(4)
+		minimum = 0x10000
+	default:
+		return 0, fmt.Errorf("expected array at offset %d, got type 0x%02x", offset, header[0])
+	}
+	if err != nil {
+		return 0, err
+	}
+	if !r.lenient && n < minimum {
+		return 0, fmt.Errorf("non-minimal array header at offset %d", offset)
+	}
+	return int(n), nil
+}
+
+// readUint reads an unsigned integer
+func (r *msgpackReader) readUint() (uint64, error) {
+	offset := r.pos
+	header, err := r.next(1)
+	if err != nil {
+		return 0, err
+	}
+
+	var v uint64
+	var minimum uint64
+	switch {
+	case header[0] <= 0x7f: // positive fixint
+		return uint64(header[0]), nil
+	case header[0] == 0xcc: // uint 8
+		v, err = r.readLength(1)
+		minimum = 0x80
+	case header[0] == 0xcd: // uint 16
+		v, err = r.readLength(2)
+		minimum = 0x100
+	case header[0] == 0xce: // uint 32
+		v, err = r.readLength(4)
+		minimum = 0x10000
+	case header[0] == 0xcf: // uint 64
+		v, err = r.readLength(8)
+		minimum = 0x100000000
+	default:
+		return 0, fmt.Errorf("expected unsigned integer at offset %d, got type 0x%02x", offset, header[0])
+	}
+	if err != nil {
+		return 0, err
+	}
+	if v < minimum {
+		return 0, fmt.Errorf("non-minimal integer encoding at offset %d", offset)
+	}
+	return v, nil
+}
+
+// readBin reads a byte array. If expectedLength is not negative, the array must have exactly this length.
+func (r *msgpackReader) readBin(expectedLength int) ([]byte, error) {
+	offset := r.pos
+	header, err := r.next(1)
+	if err != nil {
+		return nil, err
+	}
+
+	var n uint64
+	var minimum uint64
+	switch {
+	case header[0] == 0xc4: // bin 8
+		n, err = r.readLength(1)
+	case header[0] == 0xc5: // bin 16
+		n, err = r.readLength(2)
+		minimum = 0x100
+	case header[0] == 0xc6: // bin 32
+		n, err = r.readLength(4)
+		minimum = 0x10000
+	case r.lenient && header[0]&0xe0 == 0xa0: // fixstr
+		n = uint64(header[0] & 0x1f)
+	case r.lenient && header[0] == 0xd9: // str 8
+		n, err = r.readLength(1)
+	case r.lenient && header[0] == 0xda: // str 16
+		n, err = r.readLength(2)
+	case r.lenient && header[0] == 0xdb: // str 32
+		n, err = r.readLength(4)
+	default:
+		return nil, fmt.Errorf("expected byte array at offset %d, got type 0x%02x", offset, header[0])
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !r.lenient && n < minimum {
+		return nil, fmt.Errorf("non-minimal byte array header at offset %d", offset)
+	}
+	if expectedLength >= 0 && n != uint64(expectedLength) {
+		return nil, fmt.Errorf("byte array at offset %d has invalid length: %d != %d", offset, n, expectedLength)
+	}
+	if n > uint64(len(r.data)) {
+		return nil, fmt.Errorf("unexpected end of data at offset %d", r.pos)
+	}
+	return r.next(int(n))
+}
+
+// skip skips the next element including all nested elements of arrays and maps
+func (r *msgpackReader) skip() error {
+	for remaining := uint64(1); remaining > 0; remaining-- {
+		offset := r.pos
+		header, err := r.next(1)
+		if err != nil {
+			return err
+		}
+
+		var size uint64 // number of bytes following the header
+		var elements uint64
+		h := header[0]
+		switch {
+		case h <= 0x7f || h >= 0xe0, h == 0xc0, h == 0xc2, h == 0xc3: // fixint, nil, bool
+		case h&0xf0 == 0x80: // fixmap
+			elements = 2 * uint64(h&0x0f)
+		case h&0xf0 == 0x90: // fixarray
+			elements = uint64(h & 0x0f)
+		case h&0xe0 == 0xa0: // fixstr
+			size = uint64(h & 0x1f)
+		case h == 0xc4 || h == 0xd9: // bin 8, str 8
+			size, err = r.readLength(1)
+		case h == 0xc5 || h == 0xda: // bin 16, str 16
+			size, err = r.readLength(2)
+		case h == 0xc6 || h == 0xdb: // bin 32, str 32
+			size, err = r.readLength(4)
+		case h == 0xc7: // ext 8
+			size, err = r.readLength(1)
+			size++
+		case h == 0xc8: // ext 16
+			size, err = r.readLength(2)
+			size++
+		case h == 0xc9: // ext 32
+			size, err = r.readLength(4)
+			size++
+		case h == 0xca: // float 32
+			size = 4
+		case h == 0xcb: // float 64
+			size = 8
+		case h >= 0xcc && h <= 0xd3: // uint 8 - 64, int 8 - 64
+			size = 1 << ((h - 0xcc) % 4)
+		case h >= 0xd4 && h <= 0xd8: // fixext 1 - 16
+			size = 1<<(h-0xd4) + 1
+		case h == 0xdc: // array 16
+			elements, err = r.readLength(2)
+		case h == 0xdd: // array 32
+			elements, err = r.readLength(4)
+		case h == 0xde: // map 16
+			elements, err = r.readLength(2)
+			elements *= 2
+		case h == 0xdf: // map 32
+			elements, err = r.readLength(4)
+			elements *= 2
+		default:
+			return fmt.Errorf("invalid type 0x%02x at offset %d", h, offset)
+		}
+		if err != nil {
+			return err
+		}
+		if size > uint64(len(r.data)-r.pos) {
+			return fmt.Errorf("unexpected end of data at offset %d", r.pos)
+		}
+		r.pos += int(size)
+		remaining += elements
+	}
+	return nil
+}
+
+// locateSignature walks the msgpack array of an encoded UPP leniently, without checking the types of
+// the elements before the signature or the encoding to be canonical. Returns the signature, which is the
+// last element of the array, and its offset, which is the length of the signed part of the UPP.
+func locateSignature(upp []byte) ([]byte, int, error) {
+	r := &msgpackReader{data: upp, lenient: true}
+
+	arrayLength, err := r.readArrayHeader()
+	if err != nil {
+		return nil, 0, err
+	}
+	if arrayLength < 2 {
+		return nil, 0, fmt.Errorf("invalid UPP array length: %d", arrayLength)
+	}
+	for i := 0; i < arrayLength-1; i++ {
+		err = r.skip()
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	signatureStart := r.pos
+	signature, err := r.readBin(-1)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(signature) == 0 {
+		return nil, 0, fmt.Errorf("empty signature")
+	}
+	if r.pos != len(upp) {
+		return nil, 0, fmt.Errorf("%d bytes of trailing data after UPP", len(upp)-r.pos)
+	}
+	return signature, signatureStart, nil
+}
+
+// parseUPP decodes an encoded UPP element by element and only accepts the canonical encoding.
+// The (previous) signatures must have the given length, if it is not negative. Returns the decoded
+// UPP and the offset of the signature element, which is the length of the signed part of the UPP.
+func parseUPP(upp []byte, signatureLength int) (UPP, int, error) {
+	r := &msgpackReader{data: upp}
+
+	arrayLength, err := r.readArrayHeader()
+	if err != nil {
+		return nil, 0, err
+	}
+	if arrayLength != lenSignedUPPArray && arrayLength != lenChainedUPPArray {
+		return nil, 0, fmt.Errorf("invalid UPP array length: %d", arrayLength)
+	}
+
+	version, err := r.readUint()
+	if err != nil {
+		return nil, 0, err
+	}
+	switch {
+	case version == uint64(Signed) && arrayLength == lenSignedUPPArray:
+	case version == uint64(Chained) && arrayLength == lenChainedUPPArray:
+	case version == uint64(Signed) || version == uint64(Chained):
+		return nil, 0, fmt.Errorf("invalid UPP array length %d for protocol version 0x%02x", arrayLength, version)
+	default:
+		return nil, 0, &ProtocolVersionError{Version: ProtocolVersion(version)}
+	}
+
+	uuidBytes, err := r.readBin(lenUUID)
+	if err != nil {
+		return nil, 0, err
+	}
+	id, err := uuid.FromBytes(uuidBytes)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var prevSignature []byte
+	if version == uint64(Chained) {
+		prevSignature, err = r.readBin(signatureLength)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	hint, err := r.readUint()
+	if err != nil {
+		return nil, 0, err
+	}
+	if hint > 0xff {
+		return nil, 0, fmt.Errorf("invalid hint: 0x%x", hint)
+	}
+
+	payload, err := r.readBin(-1)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	signatureStart := r.pos
+	signature, err := r.readBin(signatureLength)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(signature) == 0 {
+		return nil, 0, fmt.Errorf("empty signature")
+	}
+
+	if r.pos != len(upp) {
+		return nil, 0, fmt.Errorf("%d bytes of trailing data after UPP", len(upp)-r.pos)
+	}
+
+	if version == uint64(Chained) {
+		return &ChainedUPP{Chained, id, prevSignature, Hint(hint), payload, signature}, signatureStart, nil
+	}
+	return &SignedUPP{Signed, id, Hint(hint), payload, signature}, signatureStart, nil
+}
+
+// DecodeStrict decodes raw protocol package data (bytes) into an UPP (structured) like Decode, but only
+// accepts the canonical encoding. It checks the array length, the lengths of the UUID (16 bytes) and
+// signature fields (64 bytes), that all elements use the shortest possible encoding and that there is no
+// trailing data. Re-encoding the returned UPP results in exactly the input bytes.
+func DecodeStrict(upp []byte) (UPP, error) {
+	if len(upp) < 2 {
+		return nil, fmt.Errorf("input nil or invalid length")
+	}
+
+	decoded, _, err := parseUPP(upp, nistp256SignatureLength)
+	if err != nil {
+		return nil, fmt.Errorf("non-canonical UPP: %w", err)
+	}
+
+	encoded, err := Encode(decoded)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(encoded, upp) {
+		return nil, fmt.Errorf("non-canonical UPP: re-encoding results in different bytes")
+	}
+
+	return decoded, nil
+}
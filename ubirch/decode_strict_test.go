@@ -0,0 +1,105 @@
+/*
+ * Copyright (c) 2019 ubirch GmbH.
+ *
+ * ```
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * ```
+ */
+
+package ubirch
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	strictTestUUID      = "c4106eac4d0b16e645088c4622e7451ea5a1"
+	strictTestSignature = "c440bc2a01322c679b9648a9391704e992c041053404aafcdab08fc4ce54a57eb16876d741918d01219abf2dc7913f2d9d49439d350f11d05cdb3f85972ac95c45fc"
+	strictTestPayload   = "c4206b86b273ff34fce19d6b804eff5a3f5747ada4eaa22f1d49c01e52ddb7875b4b"
+)
+
+//TestDecodeStrict tests that DecodeStrict accepts canonical UPPs and returns the same result as Decode
+func TestDecodeStrict(t *testing.T) {
+	var tests = []struct {
+		testName string
+		UPP      string
+	}{
+		{"signed UPP", "9522" + strictTestUUID + "00" + strictTestPayload + strictTestSignature},
+		{"chained UPP", "9623" + strictTestUUID + strictTestSignature + "00" + strictTestPayload + strictTestSignature},
+		{"hint uint 8", "9522" + strictTestUUID + "ccfa" + strictTestPayload + strictTestSignature},
+		{"hint positive fixint", "9522" + strictTestUUID + "7f" + strictTestPayload + strictTestSignature},
+		{"empty payload", "9522" + strictTestUUID + "00" + "c400" + strictTestSignature},
+	}
+
+	for _, currTest := range tests {
+		t.Run(currTest.testName, func(t *testing.T) {
+			asserter := assert.New(t)
+			requirer := require.New(t)
+
+			uppBytes := mustDecodeHex(t, currTest.UPP)
+
+			strict, err := DecodeStrict(uppBytes)
+			requirer.NoError(err)
+			lenient, err := Decode(uppBytes)
+			requirer.NoError(err)
+			asserter.Equal(lenient, strict)
+
+			encoded, err := Encode(strict)
+			requirer.NoError(err)
+			asserter.Equal(uppBytes, encoded)
+		})
+	}
+}
+
+//TestDecodeStrict_Fails tests that DecodeStrict rejects all non-canonical or malformed encodings
+func TestDecodeStrict_Fails(t *testing.T) {
+	var tests = []struct {
+		testName string
+		UPP      string
+	}{
+		{"empty input", ""},
+		{"not an array", "c4106eac4d0b16e645088c4622e7451ea5a1"},
+		{"invalid array length", "9422" + strictTestUUID + "00" + strictTestPayload},
+		{"non-minimal array header", "dc000522" + strictTestUUID + "00" + strictTestPayload + strictTestSignature},
+		{"invalid version", "9524" + strictTestUUID + "00" + strictTestPayload + strictTestSignature},
+		{"non-minimal version", "95cc22" + strictTestUUID + "00" + strictTestPayload + strictTestSignature},
+		{"chained version in signed array", "9523" + strictTestUUID + "00" + strictTestPayload + strictTestSignature},
+		{"signed version in chained array", "9622" + strictTestUUID + strictTestSignature + "00" + strictTestPayload + strictTestSignature},
+		{"UUID too short", "9522c40f6eac4d0b16e645088c4622e7451ea5" + "00" + strictTestPayload + strictTestSignature},
+		{"UUID too long", "9522c411006eac4d0b16e645088c4622e7451ea5a1" + "00" + strictTestPayload + strictTestSignature},
+		{"UUID as string", "9522b06eac4d0b16e645088c4622e7451ea5a1" + "00" + strictTestPayload + strictTestSignature},
+		{"non-minimal UUID header", "9522c500106eac4d0b16e645088c4622e7451ea5a1" + "00" + strictTestPayload + strictTestSignature},
+		{"previous signature too short", "9623" + strictTestUUID + "c43f" + strictTestSignature[4:len(strictTestSignature)-2] + "00" + strictTestPayload + strictTestSignature},
+		{"non-minimal hint", "9522" + strictTestUUID + "cc00" + strictTestPayload + strictTestSignature},
+		{"hint too large", "9522" + strictTestUUID + "cd0100" + strictTestPayload + strictTestSignature},
+		{"negative hint", "9522" + strictTestUUID + "e0" + strictTestPayload + strictTestSignature},
+		{"non-minimal payload header", "9522" + strictTestUUID + "00" + "c50020" + strictTestPayload[4:] + strictTestSignature},
+		{"payload as string", "9522" + strictTestUUID + "00" + "a3616263" + strictTestSignature},
+		{"payload nil", "9522" + strictTestUUID + "00" + "c0" + strictTestSignature},
+		{"signature too short", "9522" + strictTestUUID + "00" + strictTestPayload + "c43f" + strictTestSignature[4:len(strictTestSignature)-2]},
+		{"signature too long", "9522" + strictTestUUID + "00" + strictTestPayload + "c441" + strictTestSignature[4:] + "00"},
+		{"signature truncated", "9522" + strictTestUUID + "00" + strictTestPayload + strictTestSignature[:len(strictTestSignature)-2]},
+		{"trailing data", "9522" + strictTestUUID + "00" + strictTestPayload + strictTestSignature + "00"},
+	}
+
+	for _, currTest := range tests {
+		t.Run(currTest.testName, func(t *testing.T) {
+			decoded, err := DecodeStrict(mustDecodeHex(t, currTest.UPP))
+			assert.Error(t, err)
+			assert.Nil(t, decoded)
+		})
+	}
+}
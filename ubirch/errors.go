@@ -0,0 +1,142 @@
+/*
+ * Copyright (c) 2019 ubirch GmbH.
+ *
+ * ```
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * ```
+ */
+
+package ubirch
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+)
+
+// Sentinel errors of the ubirch package. Errors returned by the package wrap these, so they can be
+// checked with errors.Is, e.g. errors.Is(err, ErrUnknownName). The typed errors below carry the name
+// or UUID involved and can be retrieved with errors.As.
+var (
+	ErrUnknownName            = errors.New("unknown name")
+	ErrEmptyName              = errors.New("name is empty")
+	ErrNilUUID                = errors.New("uuid is Nil")
+	ErrKeystoreNil            = errors.New("keystore is nil")
+	ErrKeyNotFound            = errors.New("key not found")
+	ErrDecryptFailed          = errors.New("decrypting key failed")
+	ErrKeystoreLocked         = errors.New("keystore is locked")
+	ErrEmptyData              = errors.New("data is empty")
+	ErrEmptySignature         = errors.New("signature is empty")
+	ErrInvalidHashSize        = errors.New("invalid hash size")
+	ErrInvalidProtocolVersion = errors.New("invalid protocol version")
+	ErrBrokenChainState       = errors.New("broken chain state")
+	ErrPendingUPP             = errors.New("uncommitted chained UPP pending")
+	ErrNoPendingUPP           = errors.New("no pending UPP")
+	ErrBrokenAnchorPath       = errors.New("inconsistent anchor path")
+)
+
+// UnknownNameError is returned if there is no identity (UUID/key entry) for a name
+type UnknownNameError struct {
+	Name string
+}
+
+func (e *UnknownNameError) Error() string {
+	return fmt.Sprintf("no uuid/key entry for '%s'", e.Name)
+}
+
+// Is reports whether the target is ErrUnknownName
+func (e *UnknownNameError) Is(target error) bool {
+	return target == ErrUnknownName
+}
+
+// KeyError records a failed operation on a key of an identity, the UUID involved and the cause,
+// e.g. ErrKeystoreNil, ErrKeyNotFound or ErrDecryptFailed.
+type KeyError struct {
+	Op   string // the failed operation, e.g. "get private key"
+	UUID uuid.UUID
+	Err  error
+}
+
+func (e *KeyError) Error() string {
+	return fmt.Sprintf("can't %s for %s: %v", e.Op, e.UUID, e.Err)
+}
+
+// Unwrap returns the cause of the error
+func (e *KeyError) Unwrap() error {
+	return e.Err
+}
+
+// HashSizeError is returned if a hash does not have the expected size
+type HashSizeError struct {
+	Expected int
+	Actual   int
+}
+
+func (e *HashSizeError) Error() string {
+	return fmt.Sprintf("invalid hash size, expected %v, got %v bytes", e.Expected, e.Actual)
+}
+
+// Is reports whether the target is ErrInvalidHashSize
+func (e *HashSizeError) Is(target error) bool {
+	return target == ErrInvalidHashSize
+}
+
+// ProtocolVersionError is returned if a protocol version is neither Signed nor Chained
+type ProtocolVersionError struct {
+	Version ProtocolVersion
+}
+
+func (e *ProtocolVersionError) Error() string {
+	return fmt.Sprintf("invalid protocol version: 0x%02x", uint8(e.Version))
+}
+
+// Is reports whether the target is ErrInvalidProtocolVersion
+func (e *ProtocolVersionError) Is(target error) bool {
+	return target == ErrInvalidProtocolVersion
+}
+
+// ChainStateError is returned if the stored chain state (the signature of the last chained UPP) of an
+// identity is invalid, so no chained UPP can be created for it.
+type ChainStateError struct {
+	UUID   uuid.UUID
+	Reason string
+}
+
+func (e *ChainStateError) Error() string {
+	return fmt.Sprintf("invalid last signature for %s, can't create chained UPP: %s", e.UUID, e.Reason)
+}
+
+// Is reports whether the target is ErrBrokenChainState
+func (e *ChainStateError) Is(target error) bool {
+	return target == ErrBrokenChainState
+}
+
+// AnchorLinkError is returned if a link of an anchor path is inconsistent. Link 0 connects the UPP to the first
+// node of the path, link i connects node i-1 to node i and the last link connects the last node to the
+// blockchain transactions.
+type AnchorLinkError struct {
+	Link   int
+	From   string // the lower end of the link, "UPP" or "<label> <i>"
+	To     string // the upper end of the link, "<label> <i>" or "PUBLIC_CHAIN <transaction>"
+	Reason string
+}
+
+func (e *AnchorLinkError) Error() string {
+	return fmt.Sprintf("anchor path link %d (%s -> %s) inconsistent: %s", e.Link, e.From, e.To, e.Reason)
+}
+
+// Is reports whether the target is ErrBrokenAnchorPath
+func (e *AnchorLinkError) Is(target error) bool {
+	return target == ErrBrokenAnchorPath
+}
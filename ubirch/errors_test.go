@@ -0,0 +1,143 @@
+/*
+ * Copyright (c) 2019 ubirch GmbH.
+ *
+ * ```
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * ```
+ */
+
+package ubirch
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+//TestErrors_UnknownName tests that operations on an unknown name return an UnknownNameError
+func TestErrors_UnknownName(t *testing.T) {
+	asserter := assert.New(t)
+	requirer := require.New(t)
+
+	protocol, err := newProtocolContextSigner(defaultName, defaultUUID, defaultPriv, defaultLastSig)
+	requirer.NoError(err)
+
+	_, err = protocol.SignHash("unknown", mustDecodeHex(t, defaultHash), Signed)
+	asserter.True(errors.Is(err, ErrUnknownName))
+	var nameErr *UnknownNameError
+	requirer.True(errors.As(err, &nameErr))
+	asserter.Equal("unknown", nameErr.Name)
+
+	_, err = protocol.Verify("unknown", make([]byte, 100))
+	asserter.True(errors.Is(err, ErrUnknownName))
+}
+
+//TestErrors_Protocol tests the errors returned for invalid hashes, protocol versions and chain states
+func TestErrors_Protocol(t *testing.T) {
+	asserter := assert.New(t)
+	requirer := require.New(t)
+
+	protocol, err := newProtocolContextSigner(defaultName, defaultUUID, defaultPriv, defaultLastSig)
+	requirer.NoError(err)
+
+	_, err = protocol.SignHash(defaultName, []byte{1, 2, 3}, Signed)
+	asserter.True(errors.Is(err, ErrInvalidHashSize))
+	var hashErr *HashSizeError
+	requirer.True(errors.As(err, &hashErr))
+	asserter.Equal(expectedHashSize, hashErr.Expected)
+	asserter.Equal(3, hashErr.Actual)
+
+	_, err = protocol.SignHash(defaultName, mustDecodeHex(t, defaultHash), 0x42)
+	asserter.True(errors.Is(err, ErrInvalidProtocolVersion))
+	var versionErr *ProtocolVersionError
+	requirer.True(errors.As(err, &versionErr))
+	asserter.Equal(ProtocolVersion(0x42), versionErr.Version)
+
+	_, err = Decode([]byte{0x95, 0x42})
+	asserter.True(errors.Is(err, ErrInvalidProtocolVersion))
+	_, err = DecodeStrict([]byte{0x95, 0x42})
+	asserter.True(errors.Is(err, ErrInvalidProtocolVersion))
+
+	id := uuid.MustParse(defaultUUID)
+	protocol.Signatures[id] = []byte{1, 2, 3}
+	_, err = protocol.SignHash(defaultName, mustDecodeHex(t, defaultHash), Chained)
+	asserter.True(errors.Is(err, ErrBrokenChainState))
+	var chainErr *ChainStateError
+	requirer.True(errors.As(err, &chainErr))
+	asserter.Equal(id, chainErr.UUID)
+}
+
+//TestErrors_Keystore tests the errors returned for a missing keystore, missing keys and keys which can't be decrypted
+func TestErrors_Keystore(t *testing.T) {
+	asserter := assert.New(t)
+	requirer := require.New(t)
+	id := uuid.MustParse(defaultUUID)
+
+	//nil keystore
+	context := &CryptoContext{Keystore: nil, Names: map[string]uuid.UUID{defaultName: id}}
+	_, err := context.Sign(id, []byte(defaultInputData))
+	asserter.True(errors.Is(err, ErrKeystoreNil))
+	var keyErr *KeyError
+	requirer.True(errors.As(err, &keyErr))
+	asserter.Equal(id, keyErr.UUID)
+
+	//nil keystore pointer
+	context.Keystore = (*EncryptedKeystore)(nil)
+	_, err = context.GetPublicKey(defaultName)
+	asserter.True(errors.Is(err, ErrKeystoreNil))
+	asserter.True(errors.Is(context.GenerateKey(defaultName, id), ErrKeystoreNil))
+
+	//missing private key
+	context.Keystore = NewEncryptedKeystore([]byte(defaultSecret))
+	requirer.NoError(context.SetPublicKey(defaultName, id, mustDecodeHex(t, defaultPub)))
+	_, err = context.Sign(id, []byte(defaultInputData))
+	asserter.True(errors.Is(err, ErrKeyNotFound))
+	requirer.True(errors.As(err, &keyErr))
+	asserter.Equal(id, keyErr.UUID)
+	asserter.False(errors.Is(err, ErrDecryptFailed))
+
+	//wrong secret
+	requirer.NoError(context.SetKey(defaultName, id, mustDecodeHex(t, defaultPriv)))
+	context.Keystore.(*EncryptedKeystore).secret = []byte("0123456789abcdef")
+	_, err = context.Sign(id, []byte(defaultInputData))
+	asserter.True(errors.Is(err, ErrDecryptFailed))
+	requirer.True(errors.As(err, &keyErr))
+	asserter.Equal(id, keyErr.UUID)
+
+	//entry which is no valid encrypted key
+	(*context.Keystore.(*EncryptedKeystore).Keystore)[privKeyEntryTitle(id)] = "not base64 encoded"
+	_, err = context.Sign(id, []byte(defaultInputData))
+	asserter.True(errors.Is(err, ErrDecryptFailed))
+
+	//empty data and signature
+	_, err = context.Sign(id, nil)
+	asserter.True(errors.Is(err, ErrEmptyData))
+	_, err = context.Verify(id, nil, make([]byte, 64))
+	asserter.True(errors.Is(err, ErrEmptyData))
+	_, err = context.Verify(id, []byte(defaultInputData), nil)
+	asserter.True(errors.Is(err, ErrEmptySignature))
+	_, err = context.VerifyAt(id, nil, make([]byte, 64), time.Now())
+	asserter.True(errors.Is(err, ErrEmptyData))
+	_, err = (&Protocol{Crypto: context, Signatures: map[uuid.UUID][]byte{}}).SignData(defaultName, nil, Signed)
+	asserter.True(errors.Is(err, ErrEmptyData))
+
+	//empty name and nil UUID
+	asserter.True(errors.Is(context.GenerateKey("", id), ErrEmptyName))
+	asserter.True(errors.Is(context.GenerateKey(defaultName, uuid.Nil), ErrNilUUID))
+	asserter.True(errors.Is(context.SetKey("", id, mustDecodeHex(t, defaultPriv)), ErrEmptyName))
+	asserter.True(errors.Is(context.SetPublicKey(defaultName, uuid.Nil, mustDecodeHex(t, defaultPub)), ErrNilUUID))
+}
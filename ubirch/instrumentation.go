@@ -0,0 +1,214 @@
+/*
+ * Copyright (c) 2019 ubirch GmbH.
+ *
+ * ```
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * ```
+ */
+
+package ubirch
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Names of the metrics reported to Metrics and their labels
+const (
+	MetricSignTotal          = "ubirch_sign_total"              // counter, labels: name, version, result
+	MetricSignDuration       = "ubirch_sign_duration_seconds"   // histogram, labels: name, version
+	MetricVerifyTotal        = "ubirch_verify_total"            // counter, labels: name, result
+	MetricVerifyDuration     = "ubirch_verify_duration_seconds" // histogram, labels: name
+	MetricKeystoreErrorTotal = "ubirch_keystore_errors_total"   // counter, labels: uuid, operation
+)
+
+// Values of the "result" label
+const (
+	ResultOK      = "ok"      // signing succeeded or signature valid
+	ResultInvalid = "invalid" // signature not valid
+	ResultError   = "error"   // operation failed with an error
+)
+
+// Label is a key/value pair attached to metrics and trace spans
+type Label struct {
+	Key   string
+	Value string
+}
+
+// Logger is a structured, leveled logger. The methods take a message followed by alternating
+// keys and values like log/slog, so a *slog.Logger can be used directly.
+type Logger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+// Metrics records counters and histograms. The metric names and their labels are
+// the Metric* constants.
+type Metrics interface {
+	IncCounter(name string, labels ...Label)
+	ObserveHistogram(name string, value float64, labels ...Label)
+}
+
+// Tracer starts trace spans
+type Tracer interface {
+	StartSpan(name string, attributes ...Label) Span
+}
+
+// Span is a trace span started by a Tracer
+type Span interface {
+	// SetError marks the span as failed
+	SetError(err error)
+	// End finishes the span
+	End()
+}
+
+// Instrumentation bundles the optional logger, metrics and tracer of a Protocol or CryptoContext.
+// Any of the fields may be nil. A nil *Instrumentation disables all instrumentation
+// without any overhead.
+type Instrumentation struct {
+	Logger  Logger
+	Metrics Metrics
+	Tracer  Tracer
+}
+
+// noopSpan is returned if no tracer is configured
+type noopSpan struct{}
+
+func (noopSpan) SetError(error) {}
+func (noopSpan) End()           {}
+
+// startSpan starts a trace span for an operation on the identity with the given name, if a tracer is configured
+func (i *Instrumentation) startSpan(spanName string, name string) Span {
+	if i == nil || i.Tracer == nil {
+		return noopSpan{}
+	}
+	return i.Tracer.StartSpan(spanName, Label{"name", name})
+}
+
+// startTime returns the current time, if metrics are configured
+func (i *Instrumentation) startTime() time.Time {
+	if i == nil || i.Metrics == nil {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+// incCounter increments a counter, if metrics are configured
+func (i *Instrumentation) incCounter(name string, labels ...Label) {
+	if i == nil || i.Metrics == nil {
+		return
+	}
+	i.Metrics.IncCounter(name, labels...)
+}
+
+// observeDuration records the time since start in a histogram, if metrics are configured
+func (i *Instrumentation) observeDuration(name string, start time.Time, labels ...Label) {
+	if i == nil || i.Metrics == nil {
+		return
+	}
+	i.Metrics.ObserveHistogram(name, time.Since(start).Seconds(), labels...)
+}
+
+// logger returns the configured logger or nil
+func (i *Instrumentation) logger() Logger {
+	if i == nil {
+		return nil
+	}
+	return i.Logger
+}
+
+// debug logs a debug message, if a logger is configured
+func (i *Instrumentation) debug(msg string, args ...interface{}) {
+	if l := i.logger(); l != nil {
+		l.Debug(msg, args...)
+	}
+}
+
+// info logs an info message, if a logger is configured
+func (i *Instrumentation) info(msg string, args ...interface{}) {
+	if l := i.logger(); l != nil {
+		l.Info(msg, args...)
+	}
+}
+
+// warn logs a warning, if a logger is configured
+func (i *Instrumentation) warn(msg string, args ...interface{}) {
+	if l := i.logger(); l != nil {
+		l.Warn(msg, args...)
+	}
+}
+
+// error logs an error, if a logger is configured
+func (i *Instrumentation) error(msg string, args ...interface{}) {
+	if l := i.logger(); l != nil {
+		l.Error(msg, args...)
+	}
+}
+
+// endSign finishes the instrumentation of a signing operation
+func (i *Instrumentation) endSign(span Span, start time.Time, name string, protocol ProtocolVersion, err error) {
+	defer span.End()
+	if i == nil {
+		return
+	}
+
+	version := fmt.Sprintf("0x%02x", uint8(protocol))
+	result := ResultOK
+	if err != nil {
+		result = ResultError
+		span.SetError(err)
+		i.error("signing failed", "name", name, "version", version, "error", err)
+	} else {
+		i.debug("signed UPP", "name", name, "version", version)
+	}
+	i.incCounter(MetricSignTotal, Label{"name", name}, Label{"version", version}, Label{"result", result})
+	i.observeDuration(MetricSignDuration, start, Label{"name", name}, Label{"version", version})
+}
+
+// endVerify finishes the instrumentation of a verification
+func (i *Instrumentation) endVerify(span Span, start time.Time, name string, verified bool, err error) {
+	defer span.End()
+	if i == nil {
+		return
+	}
+
+	result := ResultOK
+	switch {
+	case err != nil:
+		result = ResultError
+		span.SetError(err)
+		i.error("verification failed", "name", name, "error", err)
+	case !verified:
+		result = ResultInvalid
+		span.SetError(errors.New("signature invalid"))
+		i.warn("invalid signature", "name", name)
+	default:
+		i.debug("verified UPP", "name", name)
+	}
+	i.incCounter(MetricVerifyTotal, Label{"name", name}, Label{"result", result})
+	i.observeDuration(MetricVerifyDuration, start, Label{"name", name})
+}
+
+// keystoreError records a failed keystore operation
+func (i *Instrumentation) keystoreError(err error, operation string, id uuid.UUID) {
+	if i == nil {
+		return
+	}
+	i.error("keystore operation failed", "uuid", id.String(), "operation", operation, "error", err)
+	i.incCounter(MetricKeystoreErrorTotal, Label{"uuid", id.String()}, Label{"operation", operation})
+}
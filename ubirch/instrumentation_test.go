@@ -0,0 +1,161 @@
+/*
+ * Copyright (c) 2019 ubirch GmbH.
+ *
+ * ```
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * ```
+ */
+
+package ubirch
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recorder implements Logger, Metrics and Tracer and records all calls
+type recorder struct {
+	logs       []string
+	counters   map[string][][]Label
+	histograms map[string][]float64
+	spans      []*recordedSpan
+}
+
+type recordedSpan struct {
+	name  string
+	err   error
+	ended bool
+}
+
+func newRecorder() *recorder {
+	return &recorder{counters: map[string][][]Label{}, histograms: map[string][]float64{}}
+}
+
+func (r *recorder) Debug(msg string, args ...interface{}) { r.logs = append(r.logs, "DEBUG "+msg) }
+func (r *recorder) Info(msg string, args ...interface{})  { r.logs = append(r.logs, "INFO "+msg) }
+func (r *recorder) Warn(msg string, args ...interface{})  { r.logs = append(r.logs, "WARN "+msg) }
+func (r *recorder) Error(msg string, args ...interface{}) { r.logs = append(r.logs, "ERROR "+msg) }
+
+func (r *recorder) IncCounter(name string, labels ...Label) {
+	r.counters[name] = append(r.counters[name], labels)
+}
+
+func (r *recorder) ObserveHistogram(name string, value float64, labels ...Label) {
+	r.histograms[name] = append(r.histograms[name], value)
+}
+
+func (r *recorder) StartSpan(name string, attributes ...Label) Span {
+	span := &recordedSpan{name: name}
+	r.spans = append(r.spans, span)
+	return span
+}
+
+func (s *recordedSpan) SetError(err error) { s.err = err }
+func (s *recordedSpan) End()               { s.ended = true }
+
+//TestInstrumentation_SignVerify tests that signing and verification report logs, metrics and spans
+func TestInstrumentation_SignVerify(t *testing.T) {
+	asserter := assert.New(t)
+	requirer := require.New(t)
+
+	protocol, err := newProtocolContextSigner(defaultName, defaultUUID, defaultPriv, defaultLastSig)
+	requirer.NoError(err)
+	rec := newRecorder()
+	protocol.Instrumentation = &Instrumentation{Logger: rec, Metrics: rec, Tracer: rec}
+
+	upp, err := protocol.SignHash(defaultName, mustDecodeHex(t, defaultHash), Chained)
+	requirer.NoError(err)
+	_, err = protocol.SignHash("unknown", mustDecodeHex(t, defaultHash), Signed)
+	requirer.Error(err)
+
+	verified, err := protocol.Verify(defaultName, upp)
+	requirer.NoError(err)
+	requirer.True(verified)
+	upp[len(upp)-1] ^= 0xff
+	verified, err = protocol.Verify(defaultName, upp)
+	requirer.NoError(err)
+	requirer.False(verified)
+
+	asserter.Equal([][]Label{
+		{{"name", defaultName}, {"version", "0x23"}, {"result", ResultOK}},
+		{{"name", "unknown"}, {"version", "0x22"}, {"result", ResultError}},
+	}, rec.counters[MetricSignTotal])
+	asserter.Equal([][]Label{
+		{{"name", defaultName}, {"result", ResultOK}},
+		{{"name", defaultName}, {"result", ResultInvalid}},
+	}, rec.counters[MetricVerifyTotal])
+	asserter.Len(rec.histograms[MetricSignDuration], 2)
+	asserter.Len(rec.histograms[MetricVerifyDuration], 2)
+
+	requirer.Len(rec.spans, 4)
+	asserter.Equal("ubirch.SignHash", rec.spans[0].name)
+	asserter.NoError(rec.spans[0].err)
+	asserter.True(errors.Is(rec.spans[1].err, ErrUnknownName))
+	asserter.Equal("ubirch.Verify", rec.spans[2].name)
+	asserter.Error(rec.spans[3].err)
+	for _, span := range rec.spans {
+		asserter.True(span.ended)
+	}
+
+	asserter.Equal([]string{"DEBUG signed UPP", "ERROR signing failed", "DEBUG verified UPP", "WARN invalid signature"}, rec.logs)
+
+	//the deprecated Sign() logs a warning instead of printing to stdout
+	rec.logs = nil
+	_, err = protocol.Sign(defaultName, mustDecodeHex(t, defaultHash), Signed)
+	requirer.NoError(err)
+	asserter.Equal("WARN Sign() is deprecated, please use SignHash() or SignData() as appropriate", rec.logs[0])
+}
+
+//TestInstrumentation_Keystore tests that key generation and keystore errors are reported
+func TestInstrumentation_Keystore(t *testing.T) {
+	asserter := assert.New(t)
+	requirer := require.New(t)
+	id := uuid.MustParse(defaultUUID)
+
+	rec := newRecorder()
+	context := &CryptoContext{
+		Keystore:        NewEncryptedKeystore([]byte(defaultSecret)),
+		Names:           map[string]uuid.UUID{},
+		Instrumentation: &Instrumentation{Logger: rec, Metrics: rec},
+	}
+
+	requirer.NoError(context.SetPublicKey(defaultName, id, mustDecodeHex(t, defaultPub)))
+	_, err := context.Sign(id, []byte(defaultInputData))
+	requirer.Error(err)
+	asserter.Equal([][]Label{{{"uuid", defaultUUID}, {"operation", "get private key"}}}, rec.counters[MetricKeystoreErrorTotal])
+
+	requirer.NoError(context.GenerateKey("B", uuid.New()))
+	asserter.Equal([]string{"ERROR keystore operation failed", "INFO generated key"}, rec.logs)
+}
+
+//TestInstrumentation_Disabled tests that a nil instrumentation does not allocate
+func TestInstrumentation_Disabled(t *testing.T) {
+	var instrumentation *Instrumentation
+	err := errors.New("test")
+
+	allocs := testing.AllocsPerRun(100, func() {
+		span := instrumentation.startSpan("ubirch.SignHash", defaultName)
+		start := instrumentation.startTime()
+		instrumentation.endSign(span, start, defaultName, Signed, err)
+		instrumentation.endVerify(span, start, defaultName, false, nil)
+		instrumentation.keystoreError(err, "get private key", uuid.Nil)
+		instrumentation.warn("test")
+	})
+	assert.Zero(t, allocs)
+	assert.True(t, instrumentation.startTime().Equal(time.Time{}))
+}
@@ -0,0 +1,190 @@
+/*
+ * Copyright (c) 2019 ubirch GmbH.
+ *
+ * ```
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * ```
+ */
+
+package ubirch
+
+import (
+	"container/list"
+	"crypto"
+	"crypto/ecdsa"
+	"math/big"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// DefaultKeyCacheSize is the number of UUIDs whose keys are cached by a KeyCache created with size 0
+const DefaultKeyCacheSize = 100
+
+// KeyCache is an in-memory cache of the decoded keys of the most recently used UUIDs, so signing and
+// verifying don't have to decrypt and decode the keys from the keystore every time. The cache of a
+// CryptoContext is invalidated for a UUID, whenever its keys change. The private keys of evicted or
+// invalidated entries are zeroized. If the keystore is modified bypassing the CryptoContext, e.g. by
+// unmarshaling it, the cache has to be purged. A nil KeyCache caches nothing. KeyCache is safe for
+// concurrent use.
+type KeyCache struct {
+	mutex   sync.Mutex
+	size    int
+	entries map[uuid.UUID]*list.Element
+	lru     *list.List // least recently used entry at the back
+}
+
+// keyCacheEntry contains the cached keys of a UUID, either of them can be nil
+type keyCacheEntry struct {
+	id         uuid.UUID
+	privateKey *ecdsa.PrivateKey
+	publicKey  crypto.PublicKey
+}
+
+// NewKeyCache returns a cache of the keys of up to size UUIDs, DefaultKeyCacheSize if size is not positive
+func NewKeyCache(size int) *KeyCache {
+	if size <= 0 {
+		size = DefaultKeyCacheSize
+	}
+	return &KeyCache{
+		size:    size,
+		entries: make(map[uuid.UUID]*list.Element, size),
+		lru:     list.New(),
+	}
+}
+
+// zeroizePrivateKey overwrites the secret scalar of the private key
+func zeroizePrivateKey(k *ecdsa.PrivateKey) {
+	if k == nil || k.D == nil {
+		return
+	}
+	words := k.D.Bits()
+	for i := range words {
+		words[i] = 0
+	}
+	k.D.SetInt64(0)
+}
+
+// copyPrivateKey returns a copy of the private key, so zeroizing the cached key doesn't affect users of the copy
+func copyPrivateKey(k *ecdsa.PrivateKey) *ecdsa.PrivateKey {
+	return &ecdsa.PrivateKey{PublicKey: k.PublicKey, D: new(big.Int).Set(k.D)}
+}
+
+// entry returns the entry of the UUID and marks it as recently used, if create is set a missing entry is
+// created, evicting the least recently used entry if the cache is full. Must be called with the mutex held.
+func (kc *KeyCache) entry(id uuid.UUID, create bool) *keyCacheEntry {
+	if element, found := kc.entries[id]; found {
+		kc.lru.MoveToFront(element)
+		return element.Value.(*keyCacheEntry)
+	}
+	if !create {
+		return nil
+	}
+	if kc.lru.Len() >= kc.size {
+		kc.remove(kc.lru.Back())
+	}
+	e := &keyCacheEntry{id: id}
+	kc.entries[id] = kc.lru.PushFront(e)
+	return e
+}
+
+// remove removes an entry and zeroizes its private key. Must be called with the mutex held.
+func (kc *KeyCache) remove(element *list.Element) {
+	e := kc.lru.Remove(element).(*keyCacheEntry)
+	delete(kc.entries, e.id)
+	zeroizePrivateKey(e.privateKey)
+}
+
+// getPrivateKey returns a copy of the cached private key of the UUID, nil if it is not cached
+func (kc *KeyCache) getPrivateKey(id uuid.UUID) *ecdsa.PrivateKey {
+	if kc == nil {
+		return nil
+	}
+	kc.mutex.Lock()
+	defer kc.mutex.Unlock()
+	e := kc.entry(id, false)
+	if e == nil || e.privateKey == nil {
+		return nil
+	}
+	return copyPrivateKey(e.privateKey)
+}
+
+// putPrivateKey caches a copy of the private key of the UUID
+func (kc *KeyCache) putPrivateKey(id uuid.UUID, k *ecdsa.PrivateKey) {
+	if kc == nil {
+		return
+	}
+	kc.mutex.Lock()
+	defer kc.mutex.Unlock()
+	e := kc.entry(id, true)
+	zeroizePrivateKey(e.privateKey)
+	e.privateKey = copyPrivateKey(k)
+}
+
+// getPublicKey returns the cached public key of the UUID, nil if it is not cached
+func (kc *KeyCache) getPublicKey(id uuid.UUID) crypto.PublicKey {
+	if kc == nil {
+		return nil
+	}
+	kc.mutex.Lock()
+	defer kc.mutex.Unlock()
+	e := kc.entry(id, false)
+	if e == nil {
+		return nil
+	}
+	return e.publicKey
+}
+
+// putPublicKey caches the public key of the UUID
+func (kc *KeyCache) putPublicKey(id uuid.UUID, k crypto.PublicKey) {
+	if kc == nil {
+		return
+	}
+	kc.mutex.Lock()
+	defer kc.mutex.Unlock()
+	kc.entry(id, true).publicKey = k
+}
+
+// Invalidate removes the keys of the UUID from the cache
+func (kc *KeyCache) Invalidate(id uuid.UUID) {
+	if kc == nil {
+		return
+	}
+	kc.mutex.Lock()
+	defer kc.mutex.Unlock()
+	if element, found := kc.entries[id]; found {
+		kc.remove(element)
+	}
+}
+
+// Purge removes all keys from the cache
+func (kc *KeyCache) Purge() {
+	if kc == nil {
+		return
+	}
+	kc.mutex.Lock()
+	defer kc.mutex.Unlock()
+	for kc.lru.Len() > 0 {
+		kc.remove(kc.lru.Back())
+	}
+}
+
+// Len returns the number of UUIDs whose keys are cached
+func (kc *KeyCache) Len() int {
+	if kc == nil {
+		return 0
+	}
+	kc.mutex.Lock()
+	defer kc.mutex.Unlock()
+	return kc.lru.Len()
+}
@@ -0,0 +1,194 @@
+/*
+ * Copyright (c) 2019 ubirch GmbH.
+ *
+ * ```
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * ```
+ */
+
+package ubirch
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+//countingKeystore counts the keys read from the keystore
+type countingKeystore struct {
+	*EncryptedKeystore
+	gets int
+}
+
+func (k *countingKeystore) GetKey(keyname string) ([]byte, error) {
+	k.gets++
+	return k.EncryptedKeystore.GetKey(keyname)
+}
+
+func TestCryptoContext_KeyCache(t *testing.T) {
+	asserter := assert.New(t)
+	requirer := require.New(t)
+
+	keystore := &countingKeystore{EncryptedKeystore: NewEncryptedKeystore([]byte(defaultSecret))}
+	context := &CryptoContext{Keystore: keystore, Names: map[string]uuid.UUID{}, KeyCache: NewKeyCache(10)}
+	id := uuid.MustParse(defaultUUID)
+	requirer.NoError(context.SetKey(defaultName, id, mustDecodeHex(t, defaultPriv)))
+
+	data := []byte("data to sign")
+	signature, err := context.Sign(id, data)
+	requirer.NoError(err)
+	verified, err := context.Verify(id, data, signature)
+	requirer.NoError(err)
+	requirer.True(verified)
+
+	//the keys are only read from the keystore on first use
+	gets := keystore.gets
+	for i := 0; i < 10; i++ {
+		signature, err = context.Sign(id, data)
+		requirer.NoError(err)
+		verified, err = context.Verify(id, data, signature)
+		requirer.NoError(err)
+		requirer.True(verified)
+	}
+	asserter.Equal(gets, keystore.gets, "cached keys read from keystore")
+	asserter.Equal(1, context.KeyCache.Len())
+
+	//the decoded keys are copies zeroized by their users, the cached key is not affected
+	decoded, err := context.getDecodedPrivateKey(id)
+	requirer.NoError(err)
+	zeroizePrivateKey(decoded)
+	asserter.NotEqual(0, context.KeyCache.getPrivateKey(id).D.Sign(), "cached private key zeroized")
+	signature, err = context.Sign(id, data)
+	requirer.NoError(err)
+	verified, err = context.Verify(id, data, signature)
+	requirer.NoError(err)
+	asserter.True(verified)
+
+	//setting a new key invalidates the cache
+	requirer.NoError(context.GenerateKey(defaultName, id))
+	signature, err = context.Sign(id, data)
+	requirer.NoError(err)
+	verified, err = context.Verify(id, data, signature)
+	requirer.NoError(err)
+	asserter.True(verified, "signature of new key not verifiable, stale key cached")
+	newPubKey, err := context.GetPublicKey(defaultName)
+	requirer.NoError(err)
+	verified, err = VerifyUPPWithPublicKey(mustSignTestHelper(t, context, defaultName), newPubKey, FormatRaw)
+	requirer.NoError(err)
+	asserter.True(verified, "signed with stale private key")
+
+	//setting a public key invalidates the cache
+	requirer.NoError(context.SetPublicKey(defaultName, id, mustDecodeHex(t, defaultPub)))
+	verified, err = context.Verify(id, data, signature)
+	requirer.NoError(err)
+	asserter.False(verified, "verified with stale public key")
+
+	//deleting the identity invalidates the cache
+	requirer.NoError(context.DeleteIdentity(defaultName))
+	asserter.Equal(0, context.KeyCache.Len())
+	_, err = context.Sign(id, data)
+	asserter.Error(err, "signed with key of deleted identity")
+}
+
+//mustSignTestHelper creates a signed UPP of the default hash with the given crypto context
+func mustSignTestHelper(t *testing.T, context *CryptoContext, name string) []byte {
+	p := &Protocol{Crypto: context, Signatures: map[uuid.UUID][]byte{}}
+	upp, err := p.SignHash(name, mustDecodeHex(t, defaultHash), Signed)
+	require.NoError(t, err)
+	return upp
+}
+
+func TestKeyCache_Eviction(t *testing.T) {
+	asserter := assert.New(t)
+	requirer := require.New(t)
+
+	cache := NewKeyCache(2)
+	var ids []uuid.UUID
+	var keys []*ecdsa.PrivateKey
+	for i := 0; i < 3; i++ {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		requirer.NoError(err)
+		ids, keys = append(ids, uuid.New()), append(keys, key)
+	}
+
+	cache.putPrivateKey(ids[0], keys[0])
+	cache.putPublicKey(ids[1], &keys[1].PublicKey)
+	cached := cache.entries[ids[0]].Value.(*keyCacheEntry).privateKey
+
+	//the returned key is a copy, zeroizing it does not affect the cache
+	returned := cache.getPrivateKey(ids[0])
+	requirer.NotNil(returned)
+	asserter.Equal(keys[0].D, returned.D)
+	zeroizePrivateKey(returned)
+	asserter.Equal(keys[0].D, cache.getPrivateKey(ids[0]).D)
+
+	//ids[0] was used recently, ids[1] is evicted
+	cache.putPrivateKey(ids[2], keys[2])
+	asserter.Equal(2, cache.Len())
+	asserter.Nil(cache.getPublicKey(ids[1]))
+	asserter.NotNil(cache.getPrivateKey(ids[0]))
+	asserter.NotNil(cache.getPrivateKey(ids[2]))
+
+	//evicted private keys are zeroized
+	cache.putPublicKey(ids[1], &keys[1].PublicKey)
+	asserter.Nil(cache.getPrivateKey(ids[0]))
+	asserter.Equal(0, cached.D.Sign(), "evicted private key not zeroized")
+	asserter.NotEqual(0, keys[0].D.Sign(), "private key of the caller zeroized")
+
+	cached = cache.entries[ids[2]].Value.(*keyCacheEntry).privateKey
+	cache.Invalidate(ids[2])
+	asserter.Equal(0, cached.D.Sign(), "invalidated private key not zeroized")
+	cache.Purge()
+	asserter.Equal(0, cache.Len())
+
+	//a nil cache caches nothing
+	var nilCache *KeyCache
+	nilCache.putPrivateKey(ids[0], keys[0])
+	asserter.Nil(nilCache.getPrivateKey(ids[0]))
+	nilCache.Invalidate(ids[0])
+	nilCache.Purge()
+	asserter.Equal(0, nilCache.Len())
+	asserter.Equal(DefaultKeyCacheSize, NewKeyCache(0).size)
+}
+
+//BenchmarkCryptoContext_Sign benchmarks signing with and without key cache
+func BenchmarkCryptoContext_Sign(b *testing.B) {
+	for _, cache := range []*KeyCache{nil, NewKeyCache(0)} {
+		context := &CryptoContext{
+			Keystore: NewEncryptedKeystore([]byte(defaultSecret)),
+			Names:    map[string]uuid.UUID{},
+			KeyCache: cache,
+		}
+		id := uuid.MustParse(defaultUUID)
+		privKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err := context.storeKey(defaultName, id, privKey, false); err != nil {
+			b.Fatal(err)
+		}
+		description := "NoCache"
+		if cache != nil {
+			description = "Cache"
+		}
+		b.Run(description, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := context.Sign(id, []byte(defaultInputData)); err != nil {
+					b.Fatalf("CryptoContext.Sign() failed with error %v", err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,591 @@
+/*
+ * Copyright (c) 2019 ubirch GmbH.
+ *
+ * ```
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * ```
+ */
+
+package ubirch
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+
+	"github.com/google/uuid"
+)
+
+// KeyFormat definition
+type KeyFormat uint8
+
+const (
+	FormatAuto             KeyFormat = iota // detect the format when importing a key
+	FormatRaw                               // raw key bytes, public key: X||Y (64 bytes), private key: D (32 bytes)
+	FormatPEM                               // PEM encoded key, public key: SubjectPublicKeyInfo, private key: SEC1
+	FormatDER                               // DER encoded key, public key: SubjectPublicKeyInfo, private key: SEC1
+	FormatJWK                               // JSON Web Key (RFC 7517)
+	FormatSEC1Uncompressed                  // uncompressed SEC1 point: 0x04||X||Y (65 bytes), public key only
+	FormatSEC1Compressed                    // compressed SEC1 point: 0x02/0x03||X (33 bytes), public key only
+	FormatPKCS8PEM                          // PEM encoded PKCS#8, private key only
+	FormatPKCS8DER                          // DER encoded PKCS#8, private key only
+)
+
+const (
+	nistp256UncompressedPointLength = 1 + nistp256XLength + nistp256YLength //Bytes, 0x04||X||Y
+	nistp256CompressedPointLength   = 1 + nistp256XLength                   //Bytes, 0x02/0x03||X
+	jwkKeyTypeEC                    = "EC"
+	jwkCurveP256                    = "P-256"
+)
+
+// String returns the name of the key format
+func (f KeyFormat) String() string {
+	switch f {
+	case FormatAuto:
+		return "auto"
+	case FormatRaw:
+		return "raw"
+	case FormatPEM:
+		return "PEM"
+	case FormatDER:
+		return "DER"
+	case FormatJWK:
+		return "JWK"
+	case FormatSEC1Uncompressed:
+		return "SEC1 uncompressed"
+	case FormatSEC1Compressed:
+		return "SEC1 compressed"
+	case FormatPKCS8PEM:
+		return "PKCS#8 PEM"
+	case FormatPKCS8DER:
+		return "PKCS#8 DER"
+	default:
+		return fmt.Sprintf("unknown (%d)", uint8(f))
+	}
+}
+
+// jsonWebKey is the JSON representation of an elliptic curve key (RFC 7518, section 6.2)
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	D   string `json:"d,omitempty"`
+}
+
+// detectPublicKeyFormat guesses the format of an encoded public key
+func detectPublicKeyFormat(data []byte) (KeyFormat, error) {
+	trimmed := bytes.TrimSpace(data)
+	switch {
+	case len(data) == nistp256PubkeyLength:
+		return FormatRaw, nil
+	case len(data) == nistp256UncompressedPointLength && data[0] == 0x04:
+		return FormatSEC1Uncompressed, nil
+	case len(data) == nistp256CompressedPointLength && (data[0] == 0x02 || data[0] == 0x03):
+		return FormatSEC1Compressed, nil
+	case bytes.HasPrefix(trimmed, []byte("-----BEGIN")):
+		return FormatPEM, nil
+	case bytes.HasPrefix(trimmed, []byte("{")):
+		return FormatJWK, nil
+	case len(data) > 0 && data[0] == 0x30: // ASN.1 SEQUENCE
+		return FormatDER, nil
+	default:
+		return FormatAuto, fmt.Errorf("unable to detect public key format")
+	}
+}
+
+// decodeJWKCoordinate decodes a base64url encoded JWK coordinate or private key value
+func decodeJWKCoordinate(name string, value string, length int) ([]byte, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid JWK parameter %q: %v", name, err)
+	}
+	if len(decoded) != length {
+		return nil, fmt.Errorf("invalid JWK parameter %q length: %d != %d", name, len(decoded), length)
+	}
+	return decoded, nil
+}
+
+// parseJSONWebKey decodes a JSON Web Key and checks the key type and curve
+func parseJSONWebKey(data []byte) (*jsonWebKey, error) {
+	jwk := &jsonWebKey{}
+	err := json.Unmarshal(data, jwk)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse JWK: %v", err)
+	}
+	if jwk.Kty != jwkKeyTypeEC {
+		return nil, fmt.Errorf("unsupported JWK key type: %q", jwk.Kty)
+	}
+	if jwk.Crv != jwkCurveP256 {
+		return nil, fmt.Errorf("unsupported JWK curve: %q", jwk.Crv)
+	}
+	return jwk, nil
+}
+
+// ParsePublicKey decodes a NIST P-256 public key in the given format and returns the raw public
+// key bytes (64 bytes, X||Y). With FormatAuto the format is detected from the data.
+func ParsePublicKey(data []byte, format KeyFormat) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("empty public key")
+	}
+
+	if format == FormatAuto {
+		var err error
+		format, err = detectPublicKeyFormat(data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var pubKey *ecdsa.PublicKey
+	switch format {
+	case FormatRaw:
+		var err error
+		pubKey, err = publicKeyFromBytes(data)
+		if err != nil {
+			return nil, err
+		}
+	case FormatPEM:
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("unable to parse PEM block")
+		}
+		if block.Type != "PUBLIC KEY" {
+			return nil, fmt.Errorf("unexpected PEM block type: %q", block.Type)
+		}
+		return ParsePublicKey(block.Bytes, FormatDER)
+	case FormatDER:
+		genericPublicKey, err := x509.ParsePKIXPublicKey(data)
+		if err != nil {
+			return nil, err
+		}
+		var ok bool
+		pubKey, ok = genericPublicKey.(*ecdsa.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("unsupported public key type: %T", genericPublicKey)
+		}
+	case FormatJWK:
+		jwk, err := parseJSONWebKey(data)
+		if err != nil {
+			return nil, err
+		}
+		x, err := decodeJWKCoordinate("x", jwk.X, nistp256XLength)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeJWKCoordinate("y", jwk.Y, nistp256YLength)
+		if err != nil {
+			return nil, err
+		}
+		pubKey, err = publicKeyFromBytes(append(x, y...))
+		if err != nil {
+			return nil, err
+		}
+	case FormatSEC1Uncompressed:
+		if len(data) != nistp256UncompressedPointLength || data[0] != 0x04 {
+			return nil, fmt.Errorf("invalid uncompressed SEC1 point")
+		}
+		var err error
+		pubKey, err = publicKeyFromBytes(data[1:])
+		if err != nil {
+			return nil, err
+		}
+	case FormatSEC1Compressed:
+		if len(data) != nistp256CompressedPointLength {
+			return nil, fmt.Errorf("invalid compressed SEC1 point length: %d != %d", len(data), nistp256CompressedPointLength)
+		}
+		x, y := elliptic.UnmarshalCompressed(elliptic.P256(), data)
+		if x == nil {
+			return nil, fmt.Errorf("invalid compressed SEC1 point")
+		}
+		pubKey = &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+	default:
+		return nil, fmt.Errorf("unsupported public key format: %v", format)
+	}
+
+	return publicKeyToBytes(pubKey)
+}
+
+// MarshalPublicKey encodes raw NIST P-256 public key bytes (64 bytes, X||Y) in the given format.
+func MarshalPublicKey(pubKeyBytes []byte, format KeyFormat) ([]byte, error) {
+	pubKey, err := publicKeyFromBytes(pubKeyBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	switch format {
+	case FormatRaw:
+		return append([]byte{}, pubKeyBytes...), nil
+	case FormatPEM:
+		return encodePublicKey(pubKey)
+	case FormatDER:
+		return x509.MarshalPKIXPublicKey(pubKey)
+	case FormatJWK:
+		return json.Marshal(jsonWebKey{
+			Kty: jwkKeyTypeEC,
+			Crv: jwkCurveP256,
+			X:   base64.RawURLEncoding.EncodeToString(pubKeyBytes[:nistp256XLength]),
+			Y:   base64.RawURLEncoding.EncodeToString(pubKeyBytes[nistp256XLength:]),
+		})
+	case FormatSEC1Uncompressed:
+		return append([]byte{0x04}, pubKeyBytes...), nil
+	case FormatSEC1Compressed:
+		return elliptic.MarshalCompressed(elliptic.P256(), pubKey.X, pubKey.Y), nil
+	default:
+		return nil, fmt.Errorf("unsupported public key format: %v", format)
+	}
+}
+
+// parseEd25519PublicKey decodes an Ed25519 public key in PEM or DER format. Returns 'nil', if the
+// data is no Ed25519 public key.
+func parseEd25519PublicKey(data []byte, format KeyFormat) ed25519.PublicKey {
+	if format == FormatAuto {
+		format, _ = detectPublicKeyFormat(data)
+	}
+	if format == FormatPEM {
+		block, _ := pem.Decode(data)
+		if block == nil || block.Type != "PUBLIC KEY" {
+			return nil
+		}
+		data, format = block.Bytes, FormatDER
+	}
+	if format != FormatDER {
+		return nil
+	}
+	genericPublicKey, err := x509.ParsePKIXPublicKey(data)
+	if err != nil {
+		return nil
+	}
+	pubKey, _ := genericPublicKey.(ed25519.PublicKey)
+	return pubKey
+}
+
+// parseVerificationKey decodes a public key of any supported key type in the given format. Raw Ed25519
+// keys (32 bytes) are told apart from raw NIST P-256 keys by their length.
+func parseVerificationKey(data []byte, format KeyFormat) (crypto.PublicKey, error) {
+	if (format == FormatRaw || format == FormatAuto) && len(data) == ed25519.PublicKeySize {
+		return ed25519.PublicKey(append([]byte{}, data...)), nil
+	}
+	if ed25519Key := parseEd25519PublicKey(data, format); ed25519Key != nil {
+		return ed25519Key, nil
+	}
+	pubKeyBytes, err := ParsePublicKey(data, format)
+	if err != nil {
+		return nil, err
+	}
+	return publicKeyFromBytes(pubKeyBytes)
+}
+
+// ImportPublicKey sets the public key for the given name and UUID from an encoded public key.
+// With FormatAuto the format is detected from the data. Besides NIST P-256 keys, Ed25519 keys in
+// PEM or DER format can be imported. They can only be used to verify signatures.
+func (c *CryptoContext) ImportPublicKey(name string, id uuid.UUID, data []byte, format KeyFormat) error {
+	if ed25519Key := parseEd25519PublicKey(data, format); ed25519Key != nil {
+		if name == "" {
+			return fmt.Errorf("setting key not possible: %w", ErrEmptyName)
+		}
+		if id == uuid.Nil {
+			return fmt.Errorf("setting key not possible: %w", ErrNilUUID)
+		}
+		return c.storePublicKey(name, id, ed25519Key)
+	}
+
+	pubKeyBytes, err := ParsePublicKey(data, format)
+	if err != nil {
+		return err
+	}
+	return c.SetPublicKey(name, id, pubKeyBytes)
+}
+
+// ExportPublicKey gets the public key for the given name, encoded in the given format. Ed25519 public
+// keys can only be exported in raw (32 bytes), PEM or DER format.
+func (c *CryptoContext) ExportPublicKey(name string, format KeyFormat) ([]byte, error) {
+	id, err := c.GetUUID(name)
+	if err != nil {
+		return nil, err
+	}
+	pub, err := c.getVerificationKey(id)
+	if err != nil {
+		return nil, err
+	}
+
+	ed25519Key, ok := pub.(ed25519.PublicKey)
+	if !ok {
+		pubKeyBytes, err := rawPublicKey(pub)
+		if err != nil {
+			return nil, err
+		}
+		return MarshalPublicKey(pubKeyBytes, format)
+	}
+	switch format {
+	case FormatRaw:
+		return append([]byte{}, ed25519Key...), nil
+	case FormatPEM:
+		return encodePublicKey(ed25519Key)
+	case FormatDER:
+		return x509.MarshalPKIXPublicKey(ed25519Key)
+	default:
+		return nil, fmt.Errorf("unsupported format for Ed25519 public keys: %v", format)
+	}
+}
+
+// detectPrivateKeyFormat guesses the format of an encoded private key
+func detectPrivateKeyFormat(data []byte) (KeyFormat, error) {
+	trimmed := bytes.TrimSpace(data)
+	switch {
+	case len(data) == nistp256PrivkeyLength:
+		return FormatRaw, nil
+	case bytes.HasPrefix(trimmed, []byte("-----BEGIN")):
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return FormatAuto, fmt.Errorf("unable to parse PEM block")
+		}
+		if _, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+			return FormatPKCS8PEM, nil
+		}
+		return FormatPEM, nil
+	case bytes.HasPrefix(trimmed, []byte("{")):
+		return FormatJWK, nil
+	case len(data) > 0 && data[0] == 0x30: // ASN.1 SEQUENCE
+		if _, err := x509.ParsePKCS8PrivateKey(data); err == nil {
+			return FormatPKCS8DER, nil
+		}
+		return FormatDER, nil
+	default:
+		return FormatAuto, fmt.Errorf("unable to detect private key format")
+	}
+}
+
+// ParsePrivateKey decodes a NIST P-256 private key in the given format and returns the raw private
+// key bytes (32 bytes). With FormatAuto the format is detected from the data.
+func ParsePrivateKey(data []byte, format KeyFormat) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("empty private key")
+	}
+
+	if format == FormatAuto {
+		var err error
+		format, err = detectPrivateKeyFormat(data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var privKey *ecdsa.PrivateKey
+	switch format {
+	case FormatRaw:
+		var err error
+		privKey, err = privateKeyFromBytes(data)
+		if err != nil {
+			return nil, err
+		}
+	case FormatPEM, FormatPKCS8PEM:
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("unable to parse PEM block")
+		}
+		// the keystore stores SEC1 keys in "PRIVATE KEY" blocks, so the block type is not checked for SEC1
+		if format == FormatPKCS8PEM {
+			if block.Type != "PRIVATE KEY" {
+				return nil, fmt.Errorf("unexpected PEM block type: %q", block.Type)
+			}
+			return ParsePrivateKey(block.Bytes, FormatPKCS8DER)
+		}
+		if block.Type != "EC PRIVATE KEY" && block.Type != "PRIVATE KEY" {
+			return nil, fmt.Errorf("unexpected PEM block type: %q", block.Type)
+		}
+		return ParsePrivateKey(block.Bytes, FormatDER)
+	case FormatDER:
+		var err error
+		privKey, err = x509.ParseECPrivateKey(data)
+		if err != nil {
+			return nil, err
+		}
+	case FormatPKCS8DER:
+		genericPrivateKey, err := x509.ParsePKCS8PrivateKey(data)
+		if err != nil {
+			return nil, err
+		}
+		var ok bool
+		privKey, ok = genericPrivateKey.(*ecdsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("unsupported private key type: %T", genericPrivateKey)
+		}
+	case FormatJWK:
+		jwk, err := parseJSONWebKey(data)
+		if err != nil {
+			return nil, err
+		}
+		d, err := decodeJWKCoordinate("d", jwk.D, nistp256PrivkeyLength)
+		if err != nil {
+			return nil, err
+		}
+		privKey, err = privateKeyFromBytes(d)
+		if err != nil {
+			return nil, err
+		}
+		// the public key of the JWK has to match the private key
+		pubKeyBytes, err := publicKeyToBytes(&privKey.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		expectedJWK, err := MarshalPublicKey(pubKeyBytes, FormatJWK)
+		if err != nil {
+			return nil, err
+		}
+		expected := &jsonWebKey{}
+		if err := json.Unmarshal(expectedJWK, expected); err != nil {
+			return nil, err
+		}
+		if jwk.X != expected.X || jwk.Y != expected.Y {
+			return nil, fmt.Errorf("JWK public key does not match private key")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported private key format: %v", format)
+	}
+
+	return privateKeyToBytes(privKey)
+}
+
+// MarshalPrivateKey encodes raw NIST P-256 private key bytes (32 bytes) in the given format.
+func MarshalPrivateKey(privKeyBytes []byte, format KeyFormat) ([]byte, error) {
+	privKey, err := privateKeyFromBytes(privKeyBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	switch format {
+	case FormatRaw:
+		return append([]byte{}, privKeyBytes...), nil
+	case FormatPEM, FormatDER:
+		der, err := x509.MarshalECPrivateKey(privKey)
+		if err != nil {
+			return nil, err
+		}
+		if format == FormatDER {
+			return der, nil
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+	case FormatPKCS8PEM, FormatPKCS8DER:
+		der, err := x509.MarshalPKCS8PrivateKey(privKey)
+		if err != nil {
+			return nil, err
+		}
+		if format == FormatPKCS8DER {
+			return der, nil
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+	case FormatJWK:
+		pubKeyBytes, err := publicKeyToBytes(&privKey.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(jsonWebKey{
+			Kty: jwkKeyTypeEC,
+			Crv: jwkCurveP256,
+			X:   base64.RawURLEncoding.EncodeToString(pubKeyBytes[:nistp256XLength]),
+			Y:   base64.RawURLEncoding.EncodeToString(pubKeyBytes[nistp256XLength:]),
+			D:   base64.RawURLEncoding.EncodeToString(privKeyBytes),
+		})
+	default:
+		return nil, fmt.Errorf("unsupported private key format: %v", format)
+	}
+}
+
+// ImportPrivateKey sets the private key (and the derived public key) for the given name and UUID from an
+// encoded private key. With FormatAuto the format is detected from the data. The key can only be exported
+// again with ExportPrivateKey, if 'exportable' is set.
+func (c *CryptoContext) ImportPrivateKey(name string, id uuid.UUID, data []byte, format KeyFormat, exportable bool) error {
+	if name == "" {
+		return fmt.Errorf("setting key not possible: %w", ErrEmptyName)
+	}
+	if id == uuid.Nil {
+		return fmt.Errorf("setting key not possible: %w", ErrNilUUID)
+	}
+
+	privKeyBytes, err := ParsePrivateKey(data, format)
+	if err != nil {
+		return err
+	}
+	privKey, err := privateKeyFromBytes(privKeyBytes)
+	if err != nil {
+		return err
+	}
+	return c.storeKey(name, id, privKey, exportable)
+}
+
+// GenerateExportableKey generates a new key pair and stores it, using the given name and associated UUID.
+// Unlike keys created with GenerateKey, the private key can be exported with ExportPrivateKey.
+func (c *CryptoContext) GenerateExportableKey(name string, id uuid.UUID) error {
+	if name == "" {
+		return fmt.Errorf("generating key not possible: %w", ErrEmptyName)
+	}
+	if id == uuid.Nil {
+		return fmt.Errorf("generating key not possible: %w", ErrNilUUID)
+	}
+
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	return c.storeKey(name, id, k, true)
+}
+
+// exportableHeader is the PEM header of stored private keys marking them as exportable, its value is
+// the UUID of the key
+const exportableHeader = "Exportable"
+
+// privateKeyExportable checks if the private key of the UUID is marked as exportable. The mark is
+// part of the encrypted private key entry and names the UUID, so it can neither be added without
+// knowing the keystore secret nor be copied from the entry of another identity.
+func (c *CryptoContext) privateKeyExportable(id uuid.UUID) bool {
+	privKey, err := c.Keystore.GetKey(privKeyEntryTitle(id))
+	if err != nil {
+		return false
+	}
+	block, _ := pem.Decode(privKey)
+	return block != nil && block.Headers[exportableHeader] == id.String()
+}
+
+// ExportPrivateKey gets the private key for the given name, encoded in the given format. Only keys
+// which were marked as exportable when they were created or imported can be exported.
+func (c *CryptoContext) ExportPrivateKey(name string, format KeyFormat) ([]byte, error) {
+	id, err := c.GetUUID(name)
+	if err != nil {
+		return nil, err
+	}
+
+	priv, err := c.getDecodedPrivateKey(id)
+	if err != nil {
+		return nil, err
+	}
+	defer zeroizePrivateKey(priv)
+
+	if !c.privateKeyExportable(id) {
+		return nil, fmt.Errorf("private key of '%s' is not exportable", name)
+	}
+
+	privKeyBytes, err := privateKeyToBytes(priv)
+	if err != nil {
+		return nil, err
+	}
+	return MarshalPrivateKey(privKeyBytes, format)
+}
@@ -0,0 +1,286 @@
+/*
+ * Copyright (c) 2019 ubirch GmbH.
+ *
+ * ```
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * ```
+ */
+
+package ubirch
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// PublicKeyRecord is a public key of a UUID together with its validity period.
+// A zero NotBefore or NotAfter means the validity is not limited in that direction.
+type PublicKeyRecord struct {
+	PublicKey []byte // raw public key bytes (64 bytes, X||Y)
+	NotBefore time.Time
+	NotAfter  time.Time
+}
+
+// ValidAt returns true, if the public key was valid at the given time.
+func (r PublicKeyRecord) ValidAt(t time.Time) bool {
+	if !r.NotBefore.IsZero() && t.Before(r.NotBefore) {
+		return false
+	}
+	if !r.NotAfter.IsZero() && t.After(r.NotAfter) {
+		return false
+	}
+	return true
+}
+
+// keyEntryExists checks if an entry with the given title exists in the keystore
+func (c *CryptoContext) keyEntryExists(title string) (bool, error) {
+	keynames, err := c.Keystore.GetKeyNames()
+	if err != nil {
+		return false, err
+	}
+	for _, keyname := range keynames {
+		if keyname == title {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// loadPublicKeyHistory loads the public key history of a UUID from the keystore. If there is no
+// history entry, but a current public key, the history consists of the current key without
+// validity limits.
+func (c *CryptoContext) loadPublicKeyHistory(id uuid.UUID) ([]PublicKeyRecord, error) {
+	//check for invalid keystore
+	if err := c.checkKeystore(); err != nil {
+		return nil, fmt.Errorf("can't get public key history: %w", err)
+	}
+
+	historyExists, err := c.keyEntryExists(pubKeyHistoryEntryTitle(id))
+	if err != nil {
+		return nil, err
+	}
+	if historyExists {
+		historyBytes, err := c.Keystore.GetKey(pubKeyHistoryEntryTitle(id))
+		if err != nil {
+			return nil, err
+		}
+		var history []PublicKeyRecord
+		err = json.Unmarshal(historyBytes, &history)
+		if err != nil {
+			return nil, fmt.Errorf("decoding public key history failed: %v", err)
+		}
+		return history, nil
+	}
+
+	pubKeyExists, err := c.keyEntryExists(pubKeyEntryTitle(id))
+	if err != nil {
+		return nil, err
+	}
+	if !pubKeyExists {
+		return nil, nil
+	}
+	genericPublicKey, err := c.getVerificationKey(id)
+	if err != nil {
+		return nil, err
+	}
+	pub, ok := genericPublicKey.(*ecdsa.PublicKey)
+	if !ok { // the history only contains NIST P-256 keys
+		return nil, nil
+	}
+	pubKeyBytes, err := publicKeyToBytes(pub)
+	if err != nil {
+		return nil, err
+	}
+	return []PublicKeyRecord{{PublicKey: pubKeyBytes}}, nil
+}
+
+// storePublicKeyHistory stores the public key history of a UUID in the keystore
+func (c *CryptoContext) storePublicKeyHistory(id uuid.UUID, history []PublicKeyRecord) error {
+	historyBytes, err := json.Marshal(history)
+	if err != nil {
+		return err
+	}
+	return c.Keystore.SetKey(pubKeyHistoryEntryTitle(id), historyBytes)
+}
+
+// recordPublicKeyRotation records the public key as the current key in the key history of the UUID, if it
+// replaces a different current public key. The validity of the replaced keys ends now, the validity of the
+// new key starts now. A key which was valid before, e.g. when rotating back to it, gets a new record, so its
+// earlier validity period is kept.
+func (c *CryptoContext) recordPublicKeyRotation(id uuid.UUID, k *ecdsa.PublicKey) error {
+	history, err := c.loadPublicKeyHistory(id)
+	if err != nil {
+		return err
+	}
+	if len(history) == 0 {
+		return nil
+	}
+
+	pubKeyBytes, err := publicKeyToBytes(k)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	changed, open := false, false
+	for i := range history {
+		if !history[i].NotAfter.IsZero() && !history[i].NotAfter.After(now) {
+			continue
+		}
+		if bytes.Equal(history[i].PublicKey, pubKeyBytes) {
+			open = true
+			continue
+		}
+		history[i].NotAfter = now
+		changed = true
+	}
+	if !open {
+		history = append(history, PublicKeyRecord{PublicKey: pubKeyBytes, NotBefore: now})
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+
+	return c.storePublicKeyHistory(id, history)
+}
+
+// AddPublicKey adds a public key (64 bytes) with the given validity period to the key history of the UUID.
+// A zero notBefore or notAfter means the validity is not limited in that direction. The key becomes the
+// current public key, if it is valid now and no other key valid now has a later start of validity.
+// Adding a key which is already part of the history updates its validity period.
+func (c *CryptoContext) AddPublicKey(name string, id uuid.UUID, pubKeyBytes []byte, notBefore time.Time, notAfter time.Time) error {
+	if name == "" {
+		return fmt.Errorf("setting key not possible: %w", ErrEmptyName)
+	}
+	if id == uuid.Nil {
+		return fmt.Errorf("setting key not possible: %w", ErrNilUUID)
+	}
+	if !notBefore.IsZero() && !notAfter.IsZero() && notAfter.Before(notBefore) {
+		return fmt.Errorf("invalid validity period: not after (%v) is before not before (%v)", notAfter, notBefore)
+	}
+	if _, err := publicKeyFromBytes(pubKeyBytes); err != nil {
+		return err
+	}
+
+	history, err := c.loadPublicKeyHistory(id)
+	if err != nil {
+		return err
+	}
+
+	// the key may have several records after rotating back to it, they are replaced by the added one
+	added := PublicKeyRecord{PublicKey: append([]byte{}, pubKeyBytes...), NotBefore: notBefore, NotAfter: notAfter}
+	updated := history[:0]
+	for _, record := range history {
+		if !bytes.Equal(record.PublicKey, pubKeyBytes) {
+			updated = append(updated, record)
+		}
+	}
+	history = append(updated, added)
+
+	err = c.storePublicKeyHistory(id, history)
+	if err != nil {
+		return err
+	}
+
+	// select the key which is valid now and was activated last as the current key
+	now := time.Now()
+	var current *PublicKeyRecord
+	for i := range history {
+		if history[i].ValidAt(now) && (current == nil || history[i].NotBefore.After(current.NotBefore)) {
+			current = &history[i]
+		}
+	}
+	if current == nil {
+		if c.Names == nil {
+			c.Names = make(map[string]uuid.UUID, 1)
+		}
+		c.Names[name] = id
+		return nil
+	}
+
+	pub, err := publicKeyFromBytes(current.PublicKey)
+	if err != nil {
+		return err
+	}
+	return c.storePublicKey(name, id, pub)
+}
+
+// GetPublicKeyHistory returns all known public keys of the given name together with their validity periods.
+func (c *CryptoContext) GetPublicKeyHistory(name string) ([]PublicKeyRecord, error) {
+	id, err := c.GetUUID(name)
+	if err != nil {
+		return nil, err
+	}
+
+	history, err := c.loadPublicKeyHistory(id)
+	if err != nil {
+		return nil, err
+	}
+	if len(history) == 0 {
+		return nil, fmt.Errorf("no public key for '%s'", name)
+	}
+	return history, nil
+}
+
+// verifyWithHistory verifies the signature with all keys of the history for which 'valid' returns true and
+// returns the record of the key which verified the signature.
+func (c *CryptoContext) verifyWithHistory(id uuid.UUID, data []byte, signature []byte, valid func(PublicKeyRecord) bool) (bool, PublicKeyRecord, error) {
+	if len(data) == 0 {
+		return false, PublicKeyRecord{}, fmt.Errorf("%w: can't be verified", ErrEmptyData)
+	}
+
+	history, err := c.loadPublicKeyHistory(id)
+	if err != nil {
+		return false, PublicKeyRecord{}, err
+	}
+	if len(history) == 0 {
+		return false, PublicKeyRecord{}, fmt.Errorf("no public key for UUID %s", id)
+	}
+
+	for _, record := range history {
+		if !valid(record) {
+			continue
+		}
+		pub, err := publicKeyFromBytes(record.PublicKey)
+		if err != nil {
+			return false, PublicKeyRecord{}, err
+		}
+		verified, err := verifyECDSA(pub, data, signature)
+		if err != nil {
+			return false, PublicKeyRecord{}, err
+		}
+		if verified {
+			return true, record, nil
+		}
+	}
+	return false, PublicKeyRecord{}, nil
+}
+
+// VerifyAt verifies that 'signature' matches 'data' using the public keys of the UUID which were valid
+// at the given time. Returns 'true' and 'nil' error if signature was verifiable.
+func (c *CryptoContext) VerifyAt(id uuid.UUID, data []byte, signature []byte, t time.Time) (bool, error) {
+	verified, _, err := c.verifyWithHistory(id, data, signature, func(r PublicKeyRecord) bool { return r.ValidAt(t) })
+	return verified, err
+}
+
+// VerifyWithHistory verifies that 'signature' matches 'data' using all known public keys of the UUID,
+// regardless of their validity. Returns 'true' and the record of the matching key if signature was verifiable.
+func (c *CryptoContext) VerifyWithHistory(id uuid.UUID, data []byte, signature []byte) (bool, PublicKeyRecord, error) {
+	return c.verifyWithHistory(id, data, signature, func(PublicKeyRecord) bool { return true })
+}
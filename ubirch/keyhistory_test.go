@@ -0,0 +1,191 @@
+/*
+ * Copyright (c) 2019 ubirch GmbH.
+ *
+ * ```
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * ```
+ */
+
+package ubirch
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestPublicKeyRecord_ValidAt tests the validity check of public key records
+func TestPublicKeyRecord_ValidAt(t *testing.T) {
+	asserter := assert.New(t)
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	asserter.True(PublicKeyRecord{}.ValidAt(start), "unlimited record not valid")
+	asserter.True(PublicKeyRecord{NotBefore: start, NotAfter: end}.ValidAt(start), "record not valid at start")
+	asserter.True(PublicKeyRecord{NotBefore: start, NotAfter: end}.ValidAt(end), "record not valid at end")
+	asserter.False(PublicKeyRecord{NotBefore: start, NotAfter: end}.ValidAt(start.Add(-time.Second)), "record valid before start")
+	asserter.False(PublicKeyRecord{NotBefore: start, NotAfter: end}.ValidAt(end.Add(time.Second)), "record valid after end")
+	asserter.True(PublicKeyRecord{NotBefore: start}.ValidAt(end.AddDate(100, 0, 0)), "record without end not valid")
+}
+
+// TestCryptoContext_KeyRotation tests that replacing the key of a UUID keeps the old public key in the history
+//		sign chained UPPs, rotate the key and sign more chained UPPs
+//		the UPPs signed with the old key can't be verified with the current key, but with the key history
+//		the chain continuing across the rotation verifies end to end
+func TestCryptoContext_KeyRotation(t *testing.T) {
+	asserter := assert.New(t)
+	requirer := require.New(t)
+	p, err := newProtocolContextSigner(defaultName, defaultUUID, defaultPriv, "")
+	requirer.NoError(err, "creating protocol context failed")
+
+	// without rotation the history consists of the current key
+	history, err := p.GetPublicKeyHistory(defaultName)
+	requirer.NoError(err, "getting key history failed")
+	requirer.Len(history, 1, "unexpected key history length")
+	asserter.Equal(defaultPub, hex.EncodeToString(history[0].PublicKey), "unexpected key in history")
+
+	var upps [][]byte
+	for i := 0; i < 4; i++ {
+		if i == 2 {
+			requirer.NoError(p.GenerateKey(defaultName, uuid.MustParse(defaultUUID)), "rotating key failed")
+		}
+		hash := sha256.Sum256([]byte{byte(i)})
+		upp, err := p.SignHash(defaultName, hash[:], Chained)
+		requirer.NoError(err, "signing failed")
+		upps = append(upps, upp)
+	}
+
+	history, err = p.GetPublicKeyHistory(defaultName)
+	requirer.NoError(err, "getting key history failed")
+	requirer.Len(history, 2, "rotated key not added to history")
+	asserter.Equal(defaultPub, hex.EncodeToString(history[0].PublicKey), "old key not in history")
+	asserter.False(history[0].NotAfter.IsZero(), "validity of old key not ended")
+	asserter.Equal(history[0].NotAfter, history[1].NotBefore, "validity of new key does not start at end of old key")
+	currentPub, err := p.GetPublicKey(defaultName)
+	requirer.NoError(err, "getting public key failed")
+	asserter.Equal(currentPub, history[1].PublicKey, "current key not last in history")
+
+	// the old UPPs are only verifiable with the history
+	verified, err := p.Verify(defaultName, upps[0])
+	requirer.NoError(err, "verifying failed")
+	asserter.False(verified, "UPP signed with old key verified with new key")
+	verified, key, err := p.VerifyWithHistory(defaultName, upps[0])
+	requirer.NoError(err, "verifying with history failed")
+	asserter.True(verified, "UPP signed with old key not verifiable with history")
+	asserter.Equal(history[0], key, "wrong matching key reported")
+	verified, key, err = p.VerifyWithHistory(defaultName, upps[3])
+	requirer.NoError(err, "verifying with history failed")
+	asserter.True(verified, "UPP signed with new key not verifiable with history")
+	asserter.Equal(history[1], key, "wrong matching key reported")
+
+	verified, err = p.VerifyAt(defaultName, upps[0], history[0].NotAfter.Add(-time.Second))
+	requirer.NoError(err, "verifying at time failed")
+	asserter.True(verified, "UPP signed with old key not verifiable at time the old key was valid")
+	verified, err = p.VerifyAt(defaultName, upps[0], history[0].NotAfter.Add(time.Second))
+	requirer.NoError(err, "verifying at time failed")
+	asserter.False(verified, "UPP signed with old key verifiable after the validity of the old key")
+
+	asserter.NoError(p.VerifyChain(defaultName, upps), "chain across key rotation not verifiable")
+	asserter.Error(p.VerifyChain(defaultName, [][]byte{upps[0], upps[2]}), "broken chain verifiable")
+	asserter.Error(p.VerifyChain(defaultName, [][]byte{upps[2], upps[0]}), "chain going back to the old key verifiable")
+}
+
+// TestCryptoContext_KeyRotationBack tests rotating back to a key which is already in the history (A -> B -> A)
+func TestCryptoContext_KeyRotationBack(t *testing.T) {
+	asserter := assert.New(t)
+	requirer := require.New(t)
+	p, err := newProtocolContextSigner(defaultName, defaultUUID, defaultPriv, "")
+	requirer.NoError(err, "creating protocol context failed")
+	id := uuid.MustParse(defaultUUID)
+
+	oldUPP, err := p.SignHash(defaultName, mustDecodeHex(t, defaultHash), Signed)
+	requirer.NoError(err, "signing failed")
+	requirer.NoError(p.GenerateKey(defaultName, id), "rotating key failed")
+	requirer.NoError(p.SetKey(defaultName, id, mustDecodeHex(t, defaultPriv)), "rotating back failed")
+
+	history, err := p.GetPublicKeyHistory(defaultName)
+	requirer.NoError(err, "getting key history failed")
+	requirer.Len(history, 3, "rotation back not added to history")
+	asserter.Equal(defaultPub, hex.EncodeToString(history[0].PublicKey))
+	asserter.False(history[0].NotAfter.IsZero(), "validity of first period of A not ended")
+	asserter.False(history[1].NotAfter.IsZero(), "validity of B not ended")
+	asserter.Equal(defaultPub, hex.EncodeToString(history[2].PublicKey))
+	asserter.True(history[2].NotAfter.IsZero(), "validity of A not reopened")
+	asserter.Equal(history[1].NotAfter, history[2].NotBefore)
+
+	//new and old UPPs of A are verifiable at the time they were created
+	upp, err := p.SignHash(defaultName, mustDecodeHex(t, defaultHash), Signed)
+	requirer.NoError(err, "signing failed")
+	verified, err := p.Verify(defaultName, upp)
+	requirer.NoError(err)
+	asserter.True(verified)
+	verified, err = p.VerifyAt(defaultName, upp, time.Now())
+	requirer.NoError(err)
+	asserter.True(verified, "UPP of current key not verifiable now")
+	verified, err = p.VerifyAt(defaultName, oldUPP, history[0].NotAfter.Add(-time.Second))
+	requirer.NoError(err)
+	asserter.True(verified, "UPP not verifiable in the first validity period of the key")
+
+	//setting the current key again does not change the history
+	requirer.NoError(p.SetKey(defaultName, id, mustDecodeHex(t, defaultPriv)))
+	unchanged, err := p.GetPublicKeyHistory(defaultName)
+	requirer.NoError(err)
+	asserter.Equal(history, unchanged)
+}
+
+// TestCryptoContext_AddPublicKey tests adding public keys with validity periods to a verifier context
+func TestCryptoContext_AddPublicKey(t *testing.T) {
+	asserter := assert.New(t)
+	requirer := require.New(t)
+	var context = &CryptoContext{
+		Keystore: NewEncryptedKeystore([]byte(defaultSecret)),
+		Names:    map[string]uuid.UUID{},
+	}
+	id := uuid.MustParse(defaultUUID)
+	oldPub, err := hex.DecodeString(defaultPub)
+	requirer.NoError(err, "decoding public key failed")
+	signer, err := newProtocolContextSigner("signer", uuid.New().String(), "", "")
+	requirer.NoError(err, "creating protocol context failed")
+	requirer.NoError(signer.GenerateKey("new", uuid.New()), "generating key failed")
+	newPub, err := signer.GetPublicKey("new")
+	requirer.NoError(err, "getting public key failed")
+
+	rotation := time.Now().Add(-time.Hour).UTC().Round(time.Second)
+
+	asserter.Error(context.AddPublicKey(defaultName, id, oldPub, rotation, rotation.Add(-time.Hour)), "invalid validity period accepted")
+	asserter.Error(context.AddPublicKey(defaultName, id, oldPub[1:], time.Time{}, rotation), "invalid key accepted")
+	asserter.Error(context.AddPublicKey("", id, oldPub, time.Time{}, rotation), "empty name accepted")
+	asserter.Error(context.AddPublicKey(defaultName, uuid.Nil, oldPub, time.Time{}, rotation), "nil UUID accepted")
+
+	// the old key is not valid anymore, so it is not the current key
+	requirer.NoError(context.AddPublicKey(defaultName, id, oldPub, time.Time{}, rotation), "adding old key failed")
+	_, err = context.GetPublicKey(defaultName)
+	asserter.Error(err, "expired key set as current key")
+
+	requirer.NoError(context.AddPublicKey(defaultName, id, newPub, rotation, time.Time{}), "adding new key failed")
+	currentPub, err := context.GetPublicKey(defaultName)
+	requirer.NoError(err, "getting public key failed")
+	asserter.Equal(newPub, currentPub, "new key not set as current key")
+
+	history, err := context.GetPublicKeyHistory(defaultName)
+	requirer.NoError(err, "getting key history failed")
+	asserter.Equal([]PublicKeyRecord{
+		{PublicKey: oldPub, NotAfter: rotation},
+		{PublicKey: newPub, NotBefore: rotation},
+	}, history, "unexpected key history")
+}
@@ -20,6 +20,11 @@ package ubirch
 
 import (
 	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
 	"github.com/ubirch/go.crypto/keystore"
 )
 
@@ -28,6 +33,8 @@ import (
 type Keystorer interface {
 	GetKey(keyname string) ([]byte, error)
 	SetKey(keyname string, keyvalue []byte) error
+	GetKeyNames() ([]string, error)
+	DeleteKey(keyname string) error
 
 	// Required for saving and restoring
 	MarshalJSON() ([]byte, error)
@@ -35,39 +42,252 @@ type Keystorer interface {
 }
 
 // EncryptedKeystore is the reference implementation for a simple keystore.
-// The secret has to be 16 Bytes long
+// The secret has to be 16 Bytes long and is only set with NewEncryptedKeystore,
+// Unlock and Rekey. Reading or writing keys of a locked keystore fails with
+// ErrKeystoreLocked.
 type EncryptedKeystore struct {
 	*keystore.Keystore
-	Secret []byte
+
+	mutex   sync.Mutex
+	secret  []byte // nil if the keystore is locked
+	timer   *time.Timer
+	session uint64
+	caches  map[*KeyCache]struct{} // purged when the keystore is locked
 }
 
 // Ensure EncryptedKeystore implements the Keystorer interface
 var _ Keystorer = (*EncryptedKeystore)(nil)
 
-// NewEncryptedKeystore returns a new freshly initialized Keystore
+// NewEncryptedKeystore returns a new freshly initialized Keystore. The keystore
+// keeps a copy of the secret.
 func NewEncryptedKeystore(secret []byte) *EncryptedKeystore {
 	if len(secret) != 16 {
 		return nil
 	}
+	ownSecret := make([]byte, len(secret))
+	copy(ownSecret, secret)
+	return &EncryptedKeystore{
+		Keystore: &keystore.Keystore{},
+		secret:   ownSecret,
+	}
+}
+
+// NewLockedEncryptedKeystore returns a new freshly initialized Keystore, which is
+// locked until it is unlocked with the secret.
+func NewLockedEncryptedKeystore() *EncryptedKeystore {
 	return &EncryptedKeystore{
 		Keystore: &keystore.Keystore{},
-		Secret:   secret,
 	}
 }
 
-// GetKey returns a Key from the Keystore
+// Unlock unlocks the keystore with the secret for the given duration. A duration
+// <= 0 unlocks the keystore until Lock is called. If the keystore contains entries,
+// the secret is checked by decrypting one of them, the returned error wraps
+// ErrDecryptFailed for a wrong secret. Unlocking an unlocked keystore starts a new
+// session with the new secret and duration.
+func (enc *EncryptedKeystore) Unlock(secret []byte, timeout time.Duration) error {
+	if len(secret) != 16 {
+		return fmt.Errorf("can't unlock keystore: invalid secret length (%d), must be 16", len(secret))
+	}
+
+	enc.mutex.Lock()
+	defer enc.mutex.Unlock()
+
+	for keyname := range *enc.Keystore {
+		_, err := enc.Keystore.Get(keyname, secret)
+		if err != nil {
+			return fmt.Errorf("can't unlock keystore: %w: %v", ErrDecryptFailed, err)
+		}
+		break
+	}
+
+	zeroize(enc.secret)
+	enc.secret = make([]byte, len(secret))
+	copy(enc.secret, secret)
+
+	if enc.timer != nil {
+		enc.timer.Stop()
+		enc.timer = nil
+	}
+	enc.session++
+	if timeout > 0 {
+		session := enc.session
+		enc.timer = time.AfterFunc(timeout, func() { enc.lock(session) })
+	}
+	return nil
+}
+
+// Lock locks the keystore, wipes the secret from memory and purges the key caches
+// of the crypto contexts using the keystore.
+func (enc *EncryptedKeystore) Lock() {
+	enc.mutex.Lock()
+	session := enc.session
+	enc.mutex.Unlock()
+	enc.lock(session)
+}
+
+// lock locks the keystore, if the given session is still the current one
+func (enc *EncryptedKeystore) lock(session uint64) {
+	enc.mutex.Lock()
+	if session != enc.session {
+		enc.mutex.Unlock()
+		return
+	}
+	zeroize(enc.secret)
+	enc.secret = nil
+	if enc.timer != nil {
+		enc.timer.Stop()
+		enc.timer = nil
+	}
+	enc.session++
+	caches := make([]*KeyCache, 0, len(enc.caches))
+	for kc := range enc.caches {
+		caches = append(caches, kc)
+	}
+	enc.mutex.Unlock()
+
+	for _, kc := range caches {
+		kc.Purge()
+	}
+}
+
+// purgeOnLock registers a key cache holding decoded keys of the keystore, it is
+// purged whenever the keystore is locked
+func (enc *EncryptedKeystore) purgeOnLock(kc *KeyCache) {
+	if kc == nil {
+		return
+	}
+	enc.mutex.Lock()
+	defer enc.mutex.Unlock()
+	if enc.caches == nil {
+		enc.caches = map[*KeyCache]struct{}{}
+	}
+	enc.caches[kc] = struct{}{}
+}
+
+// IsLocked returns true, if the keystore is locked
+func (enc *EncryptedKeystore) IsLocked() bool {
+	enc.mutex.Lock()
+	defer enc.mutex.Unlock()
+	return enc.secret == nil
+}
+
+// zeroize overwrites the bytes with zeros
+func zeroize(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// GetKey returns a Key from the Keystore. The returned error wraps ErrKeyNotFound,
+// if there is no such key, ErrDecryptFailed, if the key can't be decrypted with the secret,
+// or ErrKeystoreLocked, if the keystore is locked.
 func (enc *EncryptedKeystore) GetKey(keyname string) ([]byte, error) {
-	return enc.Keystore.Get(keyname, enc.Secret)
+	enc.mutex.Lock()
+	defer enc.mutex.Unlock()
+	return enc.getKey(keyname)
 }
 
-// SetKey sets a key in the Keystore
+// getKey returns a Key from the Keystore, the caller has to hold the mutex
+func (enc *EncryptedKeystore) getKey(keyname string) ([]byte, error) {
+	if enc.secret == nil {
+		return nil, fmt.Errorf("%q: %w", keyname, ErrKeystoreLocked)
+	}
+	if keyname == "" {
+		return nil, fmt.Errorf("empty keyname")
+	}
+	if len(enc.secret) != 16 {
+		return nil, fmt.Errorf("invalid secret length (%d), must be 16", len(enc.secret))
+	}
+	if _, found := (*enc.Keystore)[keyname]; !found {
+		return nil, fmt.Errorf("%q: %w", keyname, ErrKeyNotFound)
+	}
+	// the entry exists and the secret is valid, so any error is caused by an entry
+	// which can't be decrypted with the secret
+	key, err := enc.Keystore.Get(keyname, enc.secret)
+	if err != nil {
+		return nil, fmt.Errorf("%q: %w: %v", keyname, ErrDecryptFailed, err)
+	}
+	return key, nil
+}
+
+// SetKey sets a key in the Keystore. The returned error wraps ErrKeystoreLocked,
+// if the keystore is locked.
 func (enc *EncryptedKeystore) SetKey(keyname string, keyvalue []byte) error {
-	return enc.Keystore.Set(keyname, keyvalue, enc.Secret)
+	enc.mutex.Lock()
+	defer enc.mutex.Unlock()
+	if enc.secret == nil {
+		return fmt.Errorf("%q: %w", keyname, ErrKeystoreLocked)
+	}
+	return enc.Keystore.Set(keyname, keyvalue, enc.secret)
+}
+
+// GetKeyNames returns the names of all entries in the Keystore, sorted alphabetically
+func (enc *EncryptedKeystore) GetKeyNames() ([]string, error) {
+	enc.mutex.Lock()
+	defer enc.mutex.Unlock()
+	keynames := make([]string, 0, len(*enc.Keystore))
+	for keyname := range *enc.Keystore {
+		keynames = append(keynames, keyname)
+	}
+	sort.Strings(keynames)
+	return keynames, nil
+}
+
+// DeleteKey removes a key from the Keystore. Deleting a key which does not
+// exist is not an error.
+func (enc *EncryptedKeystore) DeleteKey(keyname string) error {
+	if keyname == "" {
+		return fmt.Errorf("empty keyname")
+	}
+	enc.mutex.Lock()
+	defer enc.mutex.Unlock()
+	delete(*enc.Keystore, keyname)
+	return nil
+}
+
+// Rekey re-encrypts all entries of the Keystore with a new secret. The new
+// secret has to be 16 Bytes long. All entries are decrypted and re-encrypted
+// into a new keystore first, the keystore and the secret are only replaced
+// if this succeeded for every entry. If an error occurs, the keystore stays
+// unchanged and readable with the old secret. The keystore has to be unlocked.
+func (enc *EncryptedKeystore) Rekey(newSecret []byte) error {
+	if len(newSecret) != 16 {
+		return fmt.Errorf("can't rekey keystore: invalid secret length (%d), must be 16", len(newSecret))
+	}
+
+	enc.mutex.Lock()
+	defer enc.mutex.Unlock()
+	if enc.secret == nil {
+		return fmt.Errorf("can't rekey keystore: %w", ErrKeystoreLocked)
+	}
+
+	rekeyed := keystore.Keystore{}
+	for keyname := range *enc.Keystore {
+		keyvalue, err := enc.getKey(keyname)
+		if err != nil {
+			return fmt.Errorf("can't rekey keystore: decrypting entry %q failed: %w", keyname, err)
+		}
+		err = rekeyed.Set(keyname, keyvalue, newSecret)
+		if err != nil {
+			return fmt.Errorf("can't rekey keystore: encrypting entry %q failed: %v", keyname, err)
+		}
+	}
+
+	secret := make([]byte, len(newSecret))
+	copy(secret, newSecret)
+
+	*enc.Keystore = rekeyed
+	zeroize(enc.secret)
+	enc.secret = secret
+	return nil
 }
 
 // MarshalJSON implements the json.Marshaler interface. The Password will not be
 // marshaled.
 func (enc *EncryptedKeystore) MarshalJSON() ([]byte, error) {
+	enc.mutex.Lock()
+	defer enc.mutex.Unlock()
 	return json.Marshal(enc.Keystore)
 }
 
@@ -75,5 +295,7 @@ func (enc *EncryptedKeystore) MarshalJSON() ([]byte, error) {
 // null, and the password will not be read from the json, and needs to be set
 // seperately.
 func (enc *EncryptedKeystore) UnmarshalJSON(b []byte) error {
+	enc.mutex.Lock()
+	defer enc.mutex.Unlock()
 	return json.Unmarshal(b, enc.Keystore)
 }
@@ -20,7 +20,9 @@ package ubirch
 
 import (
 	"encoding/hex"
+	"errors"
 	"testing"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
@@ -37,7 +39,7 @@ func TestNewEncryptedKeystore(t *testing.T) {
 	testkeystore := NewEncryptedKeystore([]byte(defaultSecret))
 	asserter.NotNilf(testkeystore, "KeyStore not created")
 	asserter.IsTypef(testkeystore, &EncryptedKeystore{}, "Type is not correct")
-	asserter.Equalf(testkeystore.Secret, []byte(defaultSecret), "the secret is different, should be the same")
+	asserter.Equalf(testkeystore.secret, []byte(defaultSecret), "the secret is different, should be the same")
 
 	// try to create a KeyStore without secret
 	testkeystore2 := NewEncryptedKeystore([]byte(""))
@@ -207,7 +209,7 @@ func TestEncryptedKeystore_WrongSecret(t *testing.T) {
 	requirer.NoError(ks.SetKey(defaultUUID, privEncoded), "Setting private key failed")
 
 	//change the secret so decryption fails
-	ks.Secret = []byte("0000000000000000")
+	ks.secret = []byte("0000000000000000")
 
 	//try to retrive key (should fail)
 	_, err = ks.GetKey(defaultUUID)
@@ -250,3 +252,223 @@ func TestEncryptedKeystore_MarshalJSON(t *testing.T) {
 func TestEncryptedKeystore_UnmarshalJSON_NOTRDY(t *testing.T) {
 	t.Errorf("not yet implemented")
 }
+
+// TestEncryptedKeystore_Rekey tests re-encrypting all keystore entries with a new secret
+//		Load a protocol context from file and rekey the keystore
+//			the keys can be read with the new secret and are unchanged
+//			the keys can not be read with the old secret anymore
+//		Rekey with an invalid secret fails and leaves the keystore unchanged
+func TestEncryptedKeystore_Rekey(t *testing.T) {
+	asserter := assert.New(t)
+	requirer := require.New(t)
+	//Set up test objects and parameters
+	var testKeystore = NewEncryptedKeystore([]byte(defaultSecret))
+	var context = &CryptoContext{
+		Keystore: testKeystore,
+		Names:    map[string]uuid.UUID{},
+	}
+	p := Protocol{Crypto: context, Signatures: map[uuid.UUID][]byte{}}
+	requirer.NoErrorf(loadProtocolContext(&p, "test3.json"), "Failed loading protocol context")
+	id := uuid.MustParse(defaultUUID)
+
+	privKeyBefore, err := testKeystore.GetKey(privKeyEntryTitle(id))
+	requirer.NoErrorf(err, "failed to get the private key")
+	pubKeyBefore, err := testKeystore.GetKey(pubKeyEntryTitle(id))
+	requirer.NoErrorf(err, "failed to get the public key")
+
+	// rekey with invalid secret length
+	jsonBefore, err := testKeystore.MarshalJSON()
+	requirer.NoErrorf(err, "marshaling keystore failed")
+	asserter.Errorf(testKeystore.Rekey([]byte("tooshort")), "rekey with invalid secret did not fail")
+	jsonAfter, err := testKeystore.MarshalJSON()
+	requirer.NoErrorf(err, "marshaling keystore failed")
+	asserter.Equalf(jsonBefore, jsonAfter, "keystore was changed by failed rekey")
+	asserter.Equalf([]byte(defaultSecret), testKeystore.secret, "secret was changed by failed rekey")
+
+	// rekey with valid secret
+	newSecret := []byte("6543210987654321")
+	requirer.NoErrorf(testKeystore.Rekey(newSecret), "rekey failed")
+	asserter.Equalf(newSecret, testKeystore.secret, "secret was not changed")
+
+	privKeyAfter, err := testKeystore.GetKey(privKeyEntryTitle(id))
+	asserter.NoErrorf(err, "failed to get the private key with new secret")
+	asserter.Equalf(privKeyBefore, privKeyAfter, "private key changed by rekey")
+	pubKeyAfter, err := testKeystore.GetKey(pubKeyEntryTitle(id))
+	asserter.NoErrorf(err, "failed to get the public key with new secret")
+	asserter.Equalf(pubKeyBefore, pubKeyAfter, "public key changed by rekey")
+
+	// the old secret can not decrypt the keystore anymore
+	oldKeystore := &EncryptedKeystore{Keystore: testKeystore.Keystore, secret: []byte(defaultSecret)}
+	_, err = oldKeystore.GetKey(privKeyEntryTitle(id))
+	asserter.Errorf(err, "private key could be retrieved with old secret")
+}
+
+// TestEncryptedKeystore_RekeyFails tests that a rekey which fails midway leaves the keystore readable
+func TestEncryptedKeystore_RekeyFails(t *testing.T) {
+	asserter := assert.New(t)
+	requirer := require.New(t)
+
+	ks := NewEncryptedKeystore([]byte(defaultSecret))
+	requirer.NotNilf(ks, "Newly initialized keystore is nil")
+	id := uuid.MustParse(defaultUUID)
+
+	privBytes, err := hex.DecodeString(defaultPriv)
+	requirer.NoErrorf(err, "Decoding private key bytes failed")
+	privEncoded, err := encodePrivateKeyTestHelper(privBytes)
+	requirer.NoError(err, "Encoding private key failed")
+	requirer.NoError(ks.SetKey(privKeyEntryTitle(id), privEncoded), "Setting private key failed")
+
+	// add an entry which can't be decrypted with the keystore secret
+	requirer.NoError(ks.Keystore.Set("corrupt", []byte("value"), []byte("0000000000000000")), "Setting corrupt entry failed")
+
+	asserter.Errorf(ks.Rekey([]byte("6543210987654321")), "rekey with undecryptable entry did not fail")
+	asserter.Equalf([]byte(defaultSecret), ks.secret, "secret was changed by failed rekey")
+
+	retrievedKey, err := ks.GetKey(privKeyEntryTitle(id))
+	requirer.NoErrorf(err, "private key not readable after failed rekey")
+	asserter.Equal(privEncoded, retrievedKey, "private key changed by failed rekey")
+}
+
+// TestEncryptedKeystore_GetKeyNames_DeleteKey tests listing and deleting keystore entries
+func TestEncryptedKeystore_GetKeyNames_DeleteKey(t *testing.T) {
+	asserter := assert.New(t)
+	requirer := require.New(t)
+	//Set up test objects and parameters
+	var testKeystore = NewEncryptedKeystore([]byte(defaultSecret))
+	var context = &CryptoContext{
+		Keystore: testKeystore,
+		Names:    map[string]uuid.UUID{},
+	}
+	p := Protocol{Crypto: context, Signatures: map[uuid.UUID][]byte{}}
+
+	// empty keystore
+	keynames, err := testKeystore.GetKeyNames()
+	asserter.NoErrorf(err, "listing empty keystore failed")
+	asserter.Emptyf(keynames, "empty keystore has entries")
+
+	requirer.NoErrorf(loadProtocolContext(&p, "test3.json"), "Failed loading protocol context")
+	id := uuid.MustParse(defaultUUID)
+	keynames, err = testKeystore.GetKeyNames()
+	asserter.NoErrorf(err, "listing keystore failed")
+	asserter.Equalf([]string{pubKeyEntryTitle(id), privKeyEntryTitle(id)}, keynames, "unexpected keystore entries")
+
+	// delete the private key
+	asserter.NoErrorf(testKeystore.DeleteKey(privKeyEntryTitle(id)), "deleting private key failed")
+	_, err = testKeystore.GetKey(privKeyEntryTitle(id))
+	asserter.Errorf(err, "deleted private key could be retrieved")
+	keynames, err = testKeystore.GetKeyNames()
+	asserter.NoErrorf(err, "listing keystore failed")
+	asserter.Equalf([]string{pubKeyEntryTitle(id)}, keynames, "unexpected keystore entries")
+
+	// deleting a non existing key is not an error, deleting an empty keyname is
+	asserter.NoErrorf(testKeystore.DeleteKey(privKeyEntryTitle(id)), "deleting non existing key failed")
+	asserter.Errorf(testKeystore.DeleteKey(""), "deleting empty keyname did not fail")
+}
+
+// TestEncryptedKeystore_LockUnlock tests locking and unlocking the keystore
+func TestEncryptedKeystore_LockUnlock(t *testing.T) {
+	asserter := assert.New(t)
+	requirer := require.New(t)
+
+	ks := NewLockedEncryptedKeystore()
+	asserter.True(ks.IsLocked(), "new locked keystore is unlocked")
+	err := ks.SetKey("key", []byte("value"))
+	asserter.True(errors.Is(err, ErrKeystoreLocked), "unexpected error setting key in locked keystore: %v", err)
+
+	// an empty keystore can be unlocked with any valid secret
+	asserter.Error(ks.Unlock([]byte("tooshort"), 0), "unlock with invalid secret length did not fail")
+	secret := []byte(defaultSecret)
+	requirer.NoError(ks.Unlock(secret, 0))
+	asserter.False(ks.IsLocked(), "keystore locked after unlock")
+	requirer.NoError(ks.SetKey("key", []byte("value")))
+
+	// the secret is copied and wiped on lock
+	internalSecret := ks.secret
+	ks.Lock()
+	asserter.True(ks.IsLocked(), "keystore unlocked after lock")
+	asserter.Equal(make([]byte, 16), internalSecret, "secret not wiped")
+	asserter.Equal([]byte(defaultSecret), secret, "secret of caller wiped")
+	_, err = ks.GetKey("key")
+	asserter.True(errors.Is(err, ErrKeystoreLocked), "unexpected error getting key from locked keystore: %v", err)
+	err = ks.Rekey([]byte("6543210987654321"))
+	asserter.True(errors.Is(err, ErrKeystoreLocked), "unexpected error rekeying locked keystore: %v", err)
+
+	// the secret is checked against the entries of the keystore
+	err = ks.Unlock([]byte("0000000000000000"), 0)
+	asserter.True(errors.Is(err, ErrDecryptFailed), "unexpected error unlocking with wrong secret: %v", err)
+	asserter.True(ks.IsLocked(), "keystore unlocked with wrong secret")
+	requirer.NoError(ks.Unlock(secret, 0))
+	value, err := ks.GetKey("key")
+	requirer.NoError(err)
+	asserter.Equal([]byte("value"), value)
+
+	// the keystore is still readable when locked, so it can be persisted
+	ks.Lock()
+	_, err = ks.MarshalJSON()
+	asserter.NoError(err, "marshaling locked keystore failed")
+	_, err = ks.GetKeyNames()
+	asserter.NoError(err, "listing locked keystore failed")
+}
+
+// TestEncryptedKeystore_AutoLock tests that the keystore locks itself after the session timeout
+func TestEncryptedKeystore_AutoLock(t *testing.T) {
+	asserter := assert.New(t)
+	requirer := require.New(t)
+
+	ks := NewLockedEncryptedKeystore()
+	requirer.NoError(ks.Unlock([]byte(defaultSecret), 50*time.Millisecond))
+	asserter.False(ks.IsLocked(), "keystore locked before timeout")
+	deadline := time.Now().Add(5 * time.Second)
+	for !ks.IsLocked() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	asserter.True(ks.IsLocked(), "keystore unlocked after timeout")
+
+	// a new session is not locked by the timer of a previous session
+	requirer.NoError(ks.Unlock([]byte(defaultSecret), 50*time.Millisecond))
+	requirer.NoError(ks.Unlock([]byte(defaultSecret), 0))
+	time.Sleep(100 * time.Millisecond)
+	asserter.False(ks.IsLocked(), "keystore locked by timer of previous session")
+}
+
+// TestCryptoContext_SignLockedKeystore tests that signing fails distinctly while the keystore is locked,
+// also if the private key is cached
+func TestCryptoContext_SignLockedKeystore(t *testing.T) {
+	asserter := assert.New(t)
+	requirer := require.New(t)
+
+	secret := []byte(defaultSecret)
+	ks := NewEncryptedKeystore(secret)
+	context := &CryptoContext{Keystore: ks, Names: map[string]uuid.UUID{}, KeyCache: NewKeyCache(0)}
+	id := uuid.MustParse(defaultUUID)
+	privBytes, err := hex.DecodeString(defaultPriv)
+	requirer.NoError(err)
+	requirer.NoError(context.SetKey(defaultName, id, privBytes))
+
+	_, err = context.Sign(id, []byte(defaultInputData))
+	requirer.NoError(err)
+	asserter.Equal(1, context.KeyCache.Len())
+
+	ks.Lock()
+	asserter.Equal(0, context.KeyCache.Len(), "key cache not purged on lock")
+	asserter.Equal([]byte(defaultSecret), secret, "secret of caller wiped")
+	_, err = context.Sign(id, []byte(defaultInputData))
+	asserter.True(errors.Is(err, ErrKeystoreLocked), "unexpected error signing with locked keystore: %v", err)
+
+	// cached keys are not used while the keystore is locked, e.g. if it was locked while a key was cached
+	requirer.NoError(ks.Unlock([]byte(defaultSecret), 0))
+	_, err = context.Sign(id, []byte(defaultInputData))
+	requirer.NoError(err)
+	ks.Lock()
+	privEncoded, err := encodePrivateKeyTestHelper(privBytes)
+	requirer.NoError(err)
+	decoded, err := decodePrivateKey(privEncoded)
+	requirer.NoError(err)
+	context.KeyCache.putPrivateKey(id, decoded)
+	_, err = context.Sign(id, []byte(defaultInputData))
+	asserter.True(errors.Is(err, ErrKeystoreLocked), "signed with cached key while keystore is locked: %v", err)
+
+	requirer.NoError(ks.Unlock([]byte(defaultSecret), 0))
+	_, err = context.Sign(id, []byte(defaultInputData))
+	asserter.NoError(err, "signing failed after unlock")
+}
@@ -0,0 +1,225 @@
+/*
+ * Copyright (c) 2019 ubirch GmbH.
+ *
+ * ```
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * ```
+ */
+
+package ubirch
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"sync"
+)
+
+// Domain separation prefixes of the Merkle tree (RFC 6962), so a leaf can never be mistaken for an inner node
+const (
+	merkleLeafPrefix = 0x00
+	merkleNodePrefix = 0x01
+)
+
+// MerkleProofStep is one step of an inclusion proof: the sibling hash on the path from the leaf to the root
+type MerkleProofStep struct {
+	Hash []byte `json:"hash"`
+	Left bool   `json:"left"` // true, if the sibling is the left child
+}
+
+// MerkleProof is an inclusion proof, which ties a leaf (a data hash) to the root of a Merkle tree
+// and the UPP anchoring this root.
+type MerkleProof struct {
+	LeafIndex int               `json:"leafIndex"`
+	Leaf      []byte            `json:"leaf"` // the data hash
+	Path      []MerkleProofStep `json:"path"`
+	Root      []byte            `json:"root"`
+	UPP       []byte            `json:"upp"` // the UPP with the root as payload
+}
+
+// merkleLeafHash returns the hash of a leaf node: SHA256(0x00 || leaf)
+func merkleLeafHash(leaf []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{merkleLeafPrefix})
+	h.Write(leaf)
+	return h.Sum(nil)
+}
+
+// merkleNodeHash returns the hash of an inner node: SHA256(0x01 || left || right)
+func merkleNodeHash(left []byte, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{merkleNodePrefix})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// merkleTree builds a Merkle tree from the leaves and returns the root and an inclusion path for every leaf.
+// If a level has an odd number of nodes, the last node is promoted to the next level unchanged.
+func merkleTree(leaves [][]byte) ([]byte, [][]MerkleProofStep) {
+	level := make([][]byte, len(leaves))
+	positions := make([]int, len(leaves)) // position of the subtree of each leaf on the current level
+	for i, leaf := range leaves {
+		level[i] = merkleLeafHash(leaf)
+		positions[i] = i
+	}
+	paths := make([][]MerkleProofStep, len(leaves))
+
+	for len(level) > 1 {
+		for i, pos := range positions {
+			switch {
+			case pos%2 == 1:
+				paths[i] = append(paths[i], MerkleProofStep{Hash: level[pos-1], Left: true})
+			case pos+1 < len(level):
+				paths[i] = append(paths[i], MerkleProofStep{Hash: level[pos+1], Left: false})
+			}
+			positions[i] = pos / 2
+		}
+
+		next := make([][]byte, 0, (len(level)+1)/2)
+		for i := 0; i+1 < len(level); i += 2 {
+			next = append(next, merkleNodeHash(level[i], level[i+1]))
+		}
+		if len(level)%2 == 1 {
+			next = append(next, level[len(level)-1])
+		}
+		level = next
+	}
+
+	return level[0], paths
+}
+
+// MerkleRoot returns the root of the Merkle tree of the given data hashes
+func MerkleRoot(leaves [][]byte) ([]byte, error) {
+	if len(leaves) == 0 {
+		return nil, fmt.Errorf("no leaves")
+	}
+	root, _ := merkleTree(leaves)
+	return root, nil
+}
+
+// MerkleBatch collects data hashes of an identity in a Merkle tree. Signing the batch creates a
+// single UPP with the root of the tree as payload and an inclusion proof for every hash.
+// A MerkleBatch can be used concurrently.
+type MerkleBatch struct {
+	protocol *Protocol
+	name     string
+	version  ProtocolVersion
+	mutex    sync.Mutex
+	leaves   [][]byte
+}
+
+// NewMerkleBatch returns a new batch for the identity with the given name. The root is signed
+// with the given protocol version (Signed or Chained).
+func (p *Protocol) NewMerkleBatch(name string, protocol ProtocolVersion) *MerkleBatch {
+	return &MerkleBatch{protocol: p, name: name, version: protocol}
+}
+
+// Add adds a SHA256 hash to the batch and returns its leaf index
+func (b *MerkleBatch) Add(hash []byte) (int, error) {
+	if len(hash) != expectedHashSize {
+		return 0, &HashSizeError{Expected: expectedHashSize, Actual: len(hash)}
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.leaves = append(b.leaves, append([]byte{}, hash...))
+	return len(b.leaves) - 1, nil
+}
+
+// Len returns the number of hashes in the batch
+func (b *MerkleBatch) Len() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return len(b.leaves)
+}
+
+// Sign signs the root of the Merkle tree via SignHash and returns the UPP and an inclusion proof for
+// every hash, in the order the hashes were added. The batch is empty afterwards. If signing fails,
+// the hashes stay in the batch.
+func (b *MerkleBatch) Sign() ([]byte, []MerkleProof, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if len(b.leaves) == 0 {
+		return nil, nil, fmt.Errorf("can't sign empty batch")
+	}
+
+	root, paths := merkleTree(b.leaves)
+	upp, err := b.protocol.SignHash(b.name, root, b.version)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	proofs := make([]MerkleProof, len(b.leaves))
+	for i, leaf := range b.leaves {
+		proofs[i] = MerkleProof{
+			LeafIndex: i,
+			Leaf:      leaf,
+			Path:      paths[i],
+			Root:      root,
+			UPP:       upp,
+		}
+	}
+	b.leaves = nil
+
+	return upp, proofs, nil
+}
+
+// checkMerkleProof checks that the proof ties the leaf to the root and the root is the payload of the UPP
+func checkMerkleProof(proof MerkleProof) error {
+	node := merkleLeafHash(proof.Leaf)
+	for _, step := range proof.Path {
+		if len(step.Hash) != sha256.Size {
+			return fmt.Errorf("invalid hash length in proof path: %d", len(step.Hash))
+		}
+		if step.Left {
+			node = merkleNodeHash(step.Hash, node)
+		} else {
+			node = merkleNodeHash(node, step.Hash)
+		}
+	}
+	if !bytes.Equal(node, proof.Root) {
+		return fmt.Errorf("proof path does not lead to the root")
+	}
+
+	upp, err := Decode(proof.UPP)
+	if err != nil {
+		return fmt.Errorf("decoding UPP failed: %w", err)
+	}
+	if !bytes.Equal(upp.GetPayload(), proof.Root) {
+		return fmt.Errorf("UPP does not anchor the root")
+	}
+	return nil
+}
+
+// VerifyMerkleProof checks an inclusion proof: the leaf is part of the Merkle tree with the given root,
+// the root is the payload of the UPP and the UPP is signed by the identity with the given name.
+// Returns 'true' and 'nil' error if the proof is valid.
+func (p *Protocol) VerifyMerkleProof(name string, proof MerkleProof) (bool, error) {
+	err := checkMerkleProof(proof)
+	if err != nil {
+		return false, err
+	}
+	return p.Verify(name, proof.UPP)
+}
+
+// VerifyMerkleProofWithPublicKey checks an inclusion proof like Protocol.VerifyMerkleProof, but verifies
+// the UPP with the given public key (see VerifyUPPWithPublicKey) instead of a key from a keystore.
+func VerifyMerkleProofWithPublicKey(proof MerkleProof, pubKey []byte, format KeyFormat) (bool, error) {
+	err := checkMerkleProof(proof)
+	if err != nil {
+		return false, err
+	}
+	return VerifyUPPWithPublicKey(proof.UPP, pubKey, format)
+}
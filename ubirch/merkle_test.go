@@ -0,0 +1,174 @@
+/*
+ * Copyright (c) 2019 ubirch GmbH.
+ *
+ * ```
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * ```
+ */
+
+package ubirch
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMerkleRoot(t *testing.T) {
+	asserter := assert.New(t)
+	requirer := require.New(t)
+
+	var leaves [][]byte
+	for i := 0; i < 3; i++ {
+		hash := sha256.Sum256([]byte{byte(i)})
+		leaves = append(leaves, hash[:])
+	}
+
+	root, err := MerkleRoot(leaves[:1])
+	requirer.NoError(err)
+	asserter.Equal(merkleLeafHash(leaves[0]), root)
+
+	root, err = MerkleRoot(leaves[:2])
+	requirer.NoError(err)
+	asserter.Equal(merkleNodeHash(merkleLeafHash(leaves[0]), merkleLeafHash(leaves[1])), root)
+
+	//the last node of an odd level is promoted
+	root, err = MerkleRoot(leaves)
+	requirer.NoError(err)
+	asserter.Equal(merkleNodeHash(merkleNodeHash(merkleLeafHash(leaves[0]), merkleLeafHash(leaves[1])), merkleLeafHash(leaves[2])), root)
+
+	//a leaf is never mistaken for an inner node
+	asserter.NotEqual(merkleLeafHash(append(append([]byte{}, leaves[0]...), leaves[1]...)), merkleNodeHash(leaves[0], leaves[1]))
+
+	_, err = MerkleRoot(nil)
+	asserter.Error(err)
+}
+
+func TestMerkleBatch(t *testing.T) {
+	for _, size := range []int{1, 2, 3, 4, 5, 7, 8, 9, 16, 17, 100} {
+		for _, version := range []ProtocolVersion{Signed, Chained} {
+			t.Run(fmt.Sprintf("%d leaves, version 0x%02x", size, uint8(version)), func(t *testing.T) {
+				asserter := assert.New(t)
+				requirer := require.New(t)
+
+				p, err := newProtocolContextSigner(defaultName, defaultUUID, defaultPriv, defaultLastSig)
+				requirer.NoError(err)
+				batch := p.NewMerkleBatch(defaultName, version)
+
+				var leaves [][]byte
+				for i := 0; i < size; i++ {
+					hash := sha256.Sum256([]byte(fmt.Sprintf("%d", i)))
+					index, err := batch.Add(hash[:])
+					requirer.NoError(err)
+					asserter.Equal(i, index)
+					leaves = append(leaves, hash[:])
+				}
+				requirer.Equal(size, batch.Len())
+
+				upp, proofs, err := batch.Sign()
+				requirer.NoError(err)
+				asserter.Equal(0, batch.Len(), "batch not empty after signing")
+				requirer.Len(proofs, size)
+
+				decoded, err := Decode(upp)
+				requirer.NoError(err)
+				asserter.Equal(version, decoded.GetVersion())
+				root, err := MerkleRoot(leaves)
+				requirer.NoError(err)
+				asserter.Equal(root, decoded.GetPayload())
+
+				for i, proof := range proofs {
+					asserter.Equal(i, proof.LeafIndex)
+					asserter.Equal(leaves[i], proof.Leaf)
+					asserter.Equal(upp, proof.UPP)
+
+					verified, err := p.VerifyMerkleProof(defaultName, proof)
+					requirer.NoError(err)
+					asserter.True(verified, "proof of leaf %d not verifiable", i)
+					verified, err = VerifyMerkleProofWithPublicKey(proof, mustDecodeHex(t, defaultPub), FormatRaw)
+					requirer.NoError(err)
+					asserter.True(verified, "proof of leaf %d not verifiable with public key", i)
+				}
+			})
+		}
+	}
+}
+
+func TestMerkleBatch_Fails(t *testing.T) {
+	asserter := assert.New(t)
+	requirer := require.New(t)
+
+	p, err := newProtocolContextSigner(defaultName, defaultUUID, defaultPriv, defaultLastSig)
+	requirer.NoError(err)
+
+	batch := p.NewMerkleBatch(defaultName, Signed)
+	_, _, err = batch.Sign()
+	asserter.Error(err, "empty batch signed")
+	_, err = batch.Add([]byte{1, 2, 3})
+	asserter.Error(err, "invalid hash added")
+
+	//signing fails for an unknown name, the hashes stay in the batch
+	unknown := p.NewMerkleBatch("unknown", Signed)
+	_, err = unknown.Add(mustDecodeHex(t, defaultHash))
+	requirer.NoError(err)
+	_, _, err = unknown.Sign()
+	asserter.Error(err)
+	asserter.Equal(1, unknown.Len())
+
+	for i := 0; i < 5; i++ {
+		hash := sha256.Sum256([]byte{byte(i)})
+		_, err = batch.Add(hash[:])
+		requirer.NoError(err)
+	}
+	_, proofs, err := batch.Sign()
+	requirer.NoError(err)
+	otherUPP, err := p.SignHash(defaultName, mustDecodeHex(t, defaultHash), Signed)
+	requirer.NoError(err)
+
+	var tests = []struct {
+		testName string
+		modify   func(proof *MerkleProof)
+	}{
+		{"wrong leaf", func(proof *MerkleProof) { proof.Leaf = proofs[0].Leaf }},
+		{"wrong sibling", func(proof *MerkleProof) { proof.Path[0].Hash = proofs[4].Leaf }},
+		{"wrong direction", func(proof *MerkleProof) { proof.Path[0].Left = !proof.Path[0].Left }},
+		{"missing step", func(proof *MerkleProof) { proof.Path = proof.Path[1:] }},
+		{"invalid step", func(proof *MerkleProof) { proof.Path[0].Hash = proof.Path[0].Hash[1:] }},
+		{"wrong root", func(proof *MerkleProof) { proof.Root = proof.Leaf }},
+		{"UPP of other root", func(proof *MerkleProof) { proof.UPP = otherUPP }},
+		{"invalid UPP", func(proof *MerkleProof) { proof.UPP = proof.UPP[:10] }},
+	}
+
+	for _, currTest := range tests {
+		t.Run(currTest.testName, func(t *testing.T) {
+			proof := proofs[1]
+			proof.Path = append([]MerkleProofStep{}, proof.Path...)
+			currTest.modify(&proof)
+
+			verified, err := p.VerifyMerkleProof(defaultName, proof)
+			assert.Error(t, err)
+			assert.False(t, verified)
+		})
+	}
+
+	//manipulated signature
+	proof := proofs[1]
+	proof.UPP = append([]byte{}, proof.UPP...)
+	proof.UPP[len(proof.UPP)-1] ^= 0xff
+	verified, err := VerifyMerkleProofWithPublicKey(proof, mustDecodeHex(t, defaultPub), FormatRaw)
+	requirer.NoError(err)
+	asserter.False(verified, "proof with manipulated UPP signature verifiable")
+}
@@ -0,0 +1,139 @@
+/*
+ * Copyright (c) 2019 ubirch GmbH.
+ *
+ * ```
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * ```
+ */
+
+package ubirch
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// DefaultPendingTimeout is the time after which a prepared chained UPP expires, if Protocol.PendingTimeout is not set
+const DefaultPendingTimeout = time.Minute
+
+// PendingUPP is a chained UPP created by PrepareSignHash. The chain head of the UUID only advances
+// to the signature of the UPP, when it is committed. Until then, no other chained UPP can be created
+// for the UUID.
+type PendingUPP struct {
+	UUID      uuid.UUID
+	UPP       []byte
+	Signature []byte
+	Expires   time.Time
+
+	prevSignature []byte // the chain head the UPP was created from
+}
+
+// pendingUPP returns the pending UPP of the UUID, expired UPPs are dropped
+func (p *Protocol) pendingUPP(id uuid.UUID) *PendingUPP {
+	pending, found := p.pending[id]
+	if !found {
+		return nil
+	}
+	if time.Now().After(pending.Expires) {
+		delete(p.pending, id)
+		p.Instrumentation.info("pending UPP expired", "uuid", id.String())
+		return nil
+	}
+	return pending
+}
+
+// PrepareSignHash creates and signs a chained ubirch-protocol message using the given hash and hint like
+// SignHashExtended, but does not advance the chain head. The UPP is returned as pending and has to be
+// committed with Commit, once it was accepted (e.g. by the backend), or rolled back with Rollback.
+// If it is neither committed nor rolled back within the pending timeout, it expires and is rolled back.
+// Only one UPP per UUID can be pending, further chained UPPs can't be created until it is resolved.
+func (p *Protocol) PrepareSignHash(name string, hash []byte, hint Hint) (pending *PendingUPP, err error) {
+	span := p.Instrumentation.startSpan("ubirch.PrepareSignHash", name)
+	start := p.Instrumentation.startTime()
+	defer func() { p.Instrumentation.endSign(span, start, name, Chained, err) }()
+
+	if len(hash) != expectedHashSize {
+		return nil, &HashSizeError{Expected: expectedHashSize, Actual: len(hash)}
+	}
+
+	id, err := p.GetUUID(name)
+	if err != nil {
+		return nil, err
+	}
+	if p.pendingUPP(id) != nil {
+		return nil, fmt.Errorf("can't prepare chained UPP for %s: %w", id, ErrPendingUPP)
+	}
+
+	prevSignature, err := p.chainHead(id)
+	if err != nil {
+		return nil, err
+	}
+	upp, signature, err := p.signUPP(&ChainedUPP{Chained, id, prevSignature, hint, hash, nil})
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := p.PendingTimeout
+	if timeout == 0 {
+		timeout = DefaultPendingTimeout
+	}
+	pending = &PendingUPP{
+		UUID:          id,
+		UPP:           upp,
+		Signature:     signature,
+		Expires:       time.Now().Add(timeout),
+		prevSignature: append([]byte{}, prevSignature...),
+	}
+	if p.pending == nil {
+		p.pending = make(map[uuid.UUID]*PendingUPP, 1)
+	}
+	p.pending[id] = pending
+	return pending, nil
+}
+
+// Commit advances the chain head of the UUID to the signature of the pending UPP. Returns an error
+// wrapping ErrNoPendingUPP, if the UPP is not pending anymore, because it was rolled back or expired,
+// and an error wrapping ErrBrokenChainState, if the chain head was changed since the UPP was prepared.
+func (p *Protocol) Commit(pending *PendingUPP) error {
+	if pending == nil || p.pendingUPP(pending.UUID) != pending {
+		return fmt.Errorf("can't commit UPP: %w", ErrNoPendingUPP)
+	}
+	delete(p.pending, pending.UUID)
+
+	prevSignature, err := p.chainHead(pending.UUID)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(prevSignature, pending.prevSignature) {
+		return &ChainStateError{UUID: pending.UUID, Reason: "last signature changed since the UPP was prepared"}
+	}
+
+	if p.Signatures == nil {
+		p.Signatures = make(map[uuid.UUID][]byte, 1)
+	}
+	p.Signatures[pending.UUID] = pending.Signature
+	return nil
+}
+
+// Rollback discards the pending UPP, the chain head of the UUID stays unchanged. Returns an error
+// wrapping ErrNoPendingUPP, if the UPP is not pending anymore, because it was rolled back or expired.
+func (p *Protocol) Rollback(pending *PendingUPP) error {
+	if pending == nil || p.pendingUPP(pending.UUID) != pending {
+		return fmt.Errorf("can't roll back UPP: %w", ErrNoPendingUPP)
+	}
+	delete(p.pending, pending.UUID)
+	return nil
+}
@@ -0,0 +1,138 @@
+/*
+ * Copyright (c) 2019 ubirch GmbH.
+ *
+ * ```
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * ```
+ */
+
+package ubirch
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+//TestProtocol_PrepareCommit tests that the chain head only advances when a prepared UPP is committed
+func TestProtocol_PrepareCommit(t *testing.T) {
+	asserter := assert.New(t)
+	requirer := require.New(t)
+
+	protocol, err := newProtocolContextSigner(defaultName, defaultUUID, defaultPriv, defaultLastSig)
+	requirer.NoError(err)
+	id := uuid.MustParse(defaultUUID)
+
+	pending, err := protocol.PrepareSignHash(defaultName, mustDecodeHex(t, defaultHash), Binary)
+	requirer.NoError(err)
+	asserter.Equal(id, pending.UUID)
+	asserter.Equal(mustDecodeHex(t, defaultLastSig), protocol.Signatures[id], "chain head advanced before commit")
+
+	decoded, err := DecodeChained(pending.UPP)
+	requirer.NoError(err)
+	asserter.Equal(mustDecodeHex(t, defaultLastSig), decoded.PrevSignature)
+	asserter.Equal(pending.Signature, decoded.Signature)
+	verified, err := protocol.Verify(defaultName, pending.UPP)
+	requirer.NoError(err)
+	asserter.True(verified)
+
+	//no other chained UPP while a UPP is pending, signed UPPs are not affected
+	_, err = protocol.SignHash(defaultName, mustDecodeHex(t, defaultHash), Chained)
+	asserter.True(errors.Is(err, ErrPendingUPP))
+	_, err = protocol.PrepareSignHash(defaultName, mustDecodeHex(t, defaultHash), Binary)
+	asserter.True(errors.Is(err, ErrPendingUPP))
+	_, err = protocol.SignHash(defaultName, mustDecodeHex(t, defaultHash), Signed)
+	asserter.NoError(err)
+
+	requirer.NoError(protocol.Commit(pending))
+	asserter.Equal(pending.Signature, protocol.Signatures[id])
+	asserter.True(errors.Is(protocol.Commit(pending), ErrNoPendingUPP), "UPP committed twice")
+
+	//the next UPP is linked to the committed one
+	next, err := protocol.SignHash(defaultName, mustDecodeHex(t, defaultHash), Chained)
+	requirer.NoError(err)
+	nextDecoded, err := DecodeChained(next)
+	requirer.NoError(err)
+	linked, err := CheckChainLink(decoded, nextDecoded)
+	requirer.NoError(err)
+	asserter.True(linked)
+}
+
+//TestProtocol_PrepareRollback tests that rolled back and expired UPPs leave the chain head unchanged
+func TestProtocol_PrepareRollback(t *testing.T) {
+	asserter := assert.New(t)
+	requirer := require.New(t)
+
+	protocol, err := newProtocolContextSigner(defaultName, defaultUUID, defaultPriv, defaultLastSig)
+	requirer.NoError(err)
+	id := uuid.MustParse(defaultUUID)
+
+	pending, err := protocol.PrepareSignHash(defaultName, mustDecodeHex(t, defaultHash), Binary)
+	requirer.NoError(err)
+	requirer.NoError(protocol.Rollback(pending))
+	asserter.Equal(mustDecodeHex(t, defaultLastSig), protocol.Signatures[id])
+	asserter.True(errors.Is(protocol.Commit(pending), ErrNoPendingUPP), "rolled back UPP committed")
+	asserter.True(errors.Is(protocol.Rollback(pending), ErrNoPendingUPP), "UPP rolled back twice")
+
+	//timeout
+	protocol.PendingTimeout = 10 * time.Millisecond
+	pending, err = protocol.PrepareSignHash(defaultName, mustDecodeHex(t, defaultHash), Binary)
+	requirer.NoError(err)
+	time.Sleep(20 * time.Millisecond)
+	asserter.True(errors.Is(protocol.Commit(pending), ErrNoPendingUPP), "expired UPP committed")
+	asserter.Equal(mustDecodeHex(t, defaultLastSig), protocol.Signatures[id])
+	upp, err := protocol.SignHash(defaultName, mustDecodeHex(t, defaultHash), Chained)
+	requirer.NoError(err)
+	decoded, err := DecodeChained(upp)
+	requirer.NoError(err)
+	asserter.Equal(mustDecodeHex(t, defaultLastSig), decoded.PrevSignature)
+
+	//chain head changed while the UPP was pending
+	protocol.PendingTimeout = 0
+	pending, err = protocol.PrepareSignHash(defaultName, mustDecodeHex(t, defaultHash), Binary)
+	requirer.NoError(err)
+	requirer.NoError(protocol.ResetLastSignature(defaultName))
+	asserter.True(errors.Is(protocol.Commit(pending), ErrBrokenChainState))
+	asserter.Equal(make([]byte, nistp256SignatureLength), protocol.Signatures[id])
+
+	//deleting the identity drops the pending UPP
+	pending, err = protocol.PrepareSignHash(defaultName, mustDecodeHex(t, defaultHash), Binary)
+	requirer.NoError(err)
+	requirer.NoError(protocol.DeleteIdentity(defaultName))
+	asserter.True(errors.Is(protocol.Commit(pending), ErrNoPendingUPP))
+
+	asserter.True(errors.Is(protocol.Commit(nil), ErrNoPendingUPP))
+	asserter.True(errors.Is(protocol.Rollback(nil), ErrNoPendingUPP))
+}
+
+//TestProtocol_PrepareSignHash_Fails tests the cases where PrepareSignHash must return an error
+func TestProtocol_PrepareSignHash_Fails(t *testing.T) {
+	asserter := assert.New(t)
+	requirer := require.New(t)
+
+	protocol, err := newProtocolContextSigner(defaultName, defaultUUID, defaultPriv, defaultLastSig)
+	requirer.NoError(err)
+
+	_, err = protocol.PrepareSignHash("unknown", mustDecodeHex(t, defaultHash), Binary)
+	asserter.True(errors.Is(err, ErrUnknownName))
+	_, err = protocol.PrepareSignHash(defaultName, []byte{1, 2, 3}, Binary)
+	asserter.True(errors.Is(err, ErrInvalidHashSize))
+
+	protocol.Signatures[uuid.MustParse(defaultUUID)] = []byte{1, 2, 3}
+	_, err = protocol.PrepareSignHash(defaultName, mustDecodeHex(t, defaultHash), Binary)
+	asserter.True(errors.Is(err, ErrBrokenChainState))
+}
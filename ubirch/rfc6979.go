@@ -0,0 +1,171 @@
+/*
+ * Copyright (c) 2019 ubirch GmbH.
+ *
+ * ```
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * ```
+ */
+
+package ubirch
+
+import (
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"math/big"
+)
+
+// bits2int converts a bit string into an integer with the bit length of the curve order (RFC 6979, section 2.3.2)
+func bits2int(b []byte, q *big.Int) *big.Int {
+	v := new(big.Int).SetBytes(b)
+	if excess := len(b)*8 - q.BitLen(); excess > 0 {
+		v.Rsh(v, uint(excess))
+	}
+	return v
+}
+
+// int2octets converts an integer into a byte string with the byte length of the curve order (RFC 6979, section 2.3.3)
+func int2octets(v *big.Int, q *big.Int) []byte {
+	rolen := (q.BitLen() + 7) / 8
+	out := make([]byte, rolen)
+	vBytes := v.Bytes()
+	if len(vBytes) > rolen {
+		vBytes = vBytes[len(vBytes)-rolen:]
+	}
+	copy(out[rolen-len(vBytes):], vBytes)
+	return out
+}
+
+// bits2octets converts a hash into a byte string with the byte length of the curve order (RFC 6979, section 2.3.4)
+func bits2octets(b []byte, q *big.Int) []byte {
+	z1 := bits2int(b, q)
+	z2 := new(big.Int).Sub(z1, q)
+	if z2.Sign() < 0 {
+		return int2octets(z1, q)
+	}
+	return int2octets(z2, q)
+}
+
+// rfc6979 is the HMAC-SHA256 based generator of deterministic nonces (RFC 6979, section 3.2)
+type rfc6979 struct {
+	q    *big.Int
+	k, v []byte
+}
+
+// newRFC6979 initializes the nonce generator for the private key and the SHA256 hash of the message
+func newRFC6979(priv *ecdsa.PrivateKey, hash []byte) *rfc6979 {
+	q := priv.Curve.Params().N
+	g := &rfc6979{
+		q: q,
+		k: make([]byte, sha256.Size),
+		v: make([]byte, sha256.Size),
+	}
+	for i := range g.v {
+		g.v[i] = 0x01
+	}
+
+	x := int2octets(priv.D, q)
+	h := bits2octets(hash, q)
+	g.k = g.mac(g.k, g.v, []byte{0x00}, x, h)
+	g.v = g.mac(g.k, g.v)
+	g.k = g.mac(g.k, g.v, []byte{0x01}, x, h)
+	g.v = g.mac(g.k, g.v)
+	return g
+}
+
+// mac returns the HMAC-SHA256 of the concatenated data with the given key
+func (g *rfc6979) mac(key []byte, data ...[]byte) []byte {
+	m := hmac.New(sha256.New, key)
+	for _, d := range data {
+		m.Write(d)
+	}
+	return m.Sum(nil)
+}
+
+// next returns the next nonce candidate in the range [1, q-1]
+func (g *rfc6979) next() *big.Int {
+	qlen := g.q.BitLen()
+	for {
+		var t []byte
+		for len(t)*8 < qlen {
+			g.v = g.mac(g.k, g.v)
+			t = append(t, g.v...)
+		}
+		nonce := bits2int(t, g.q)
+		// prepare the state for the next candidate, in case this one is rejected
+		g.k = g.mac(g.k, g.v, []byte{0x00})
+		g.v = g.mac(g.k, g.v)
+		if nonce.Sign() > 0 && nonce.Cmp(g.q) < 0 {
+			return nonce
+		}
+	}
+}
+
+// blindedInverse returns the inverse of k modulo n. The inversion of math/big is not constant time, so
+// it is computed for k multiplied with a random blinding factor, which is independent of k. The result
+// does not depend on the blinding factor.
+func blindedInverse(k, n *big.Int) (*big.Int, error) {
+	b, err := rand.Int(rand.Reader, new(big.Int).Sub(n, big.NewInt(1)))
+	if err != nil {
+		return nil, err
+	}
+	b.Add(b, big.NewInt(1)) // b in [1, n-1]
+
+	kb := new(big.Int).Mul(k, b)
+	kb.Mod(kb, n)
+	kbInv := new(big.Int).ModInverse(kb, n)
+	if kbInv == nil {
+		return nil, fmt.Errorf("nonce not invertible")
+	}
+	kbInv.Mul(kbInv, b)
+	return kbInv.Mod(kbInv, n), nil
+}
+
+// signDeterministic creates an ECDSA signature of the hash with a deterministic nonce (RFC 6979).
+// Unlike crypto/ecdsa, the scalar arithmetic uses math/big, which is not constant time. The inversion
+// of the nonce is blinded, the remaining arithmetic may still leak timing information about the key.
+func signDeterministic(priv *ecdsa.PrivateKey, hash []byte) (r, s *big.Int, err error) {
+	if priv.D == nil || priv.D.Sign() <= 0 {
+		return nil, nil, fmt.Errorf("invalid private key")
+	}
+
+	curve := priv.Curve
+	n := curve.Params().N
+	e := bits2int(hash, n)
+	generator := newRFC6979(priv, hash)
+
+	for {
+		k := generator.next()
+
+		x, _ := curve.ScalarBaseMult(int2octets(k, n))
+		r = new(big.Int).Mod(x, n)
+		if r.Sign() == 0 {
+			continue
+		}
+
+		kInv, err := blindedInverse(k, n)
+		if err != nil {
+			return nil, nil, err
+		}
+		s = new(big.Int).Mul(r, priv.D)
+		s.Add(s, e)
+		s.Mul(s, kInv)
+		s.Mod(s, n)
+		if s.Sign() == 0 {
+			continue
+		}
+		return r, s, nil
+	}
+}
@@ -0,0 +1,122 @@
+/*
+ * Copyright (c) 2019 ubirch GmbH.
+ *
+ * ```
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * ```
+ */
+
+package ubirch
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"math/big"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestSignDeterministic checks the deterministic signatures against the test vectors
+// for ECDSA with P-256 and SHA-256 from RFC 6979, appendix A.2.5
+func TestSignDeterministic(t *testing.T) {
+	const rfcPrivKey = "c9afa9d845ba75166b5c215767b1d6934e50c3db36e89b127b8a622b120f6721"
+	var tests = []struct {
+		message   string
+		expectedK string
+		expectedR string
+		expectedS string
+	}{
+		{
+			message:   "sample",
+			expectedK: "a6e3c57dd01abe90086538398355dd4c3b17aa873382b0f24d6129493d8aad60",
+			expectedR: "efd48b2aacb6a8fd1140dd9cd45e81d69d2c877b56aaf991c34d0ea84eaf3716",
+			expectedS: "f7cb1c942d657c41d436c7a1b6e29f65f3e900dbb9aff4064dc4ab2f843acda8",
+		},
+		{
+			message:   "test",
+			expectedK: "d16b6ae827f17175e040871a1c7ec3500192c4c92677336ec2537acaee0008e0",
+			expectedR: "f1abb023518351cd71d881567b1ea663ed3efcf6c5132b354f28d3b0b7d38367",
+			expectedS: "019f4113742a2b14bd25926b49c649155f267e60d3814b4c0cc84250e46f0083",
+		},
+	}
+	privKey, err := privateKeyFromBytes(mustDecodeHex(t, rfcPrivKey))
+	require.NoError(t, err, "creating private key failed")
+
+	for _, currTest := range tests {
+		t.Run(currTest.message, func(t *testing.T) {
+			asserter := assert.New(t)
+			hash := sha256.Sum256([]byte(currTest.message))
+
+			k := newRFC6979(privKey, hash[:]).next()
+			asserter.Equal(currTest.expectedK, hex.EncodeToString(int2octets(k, privKey.Curve.Params().N)), "nonce does not match")
+
+			r, s, err := signDeterministic(privKey, hash[:])
+			require.NoError(t, err, "signing failed")
+			asserter.Equal(currTest.expectedR, hex.EncodeToString(r.Bytes()), "r does not match")
+			asserter.Equal(currTest.expectedS, hex.EncodeToString(s.Bytes()), "s does not match")
+		})
+	}
+}
+
+// TestBlindedInverse checks that the blinded inversion results in the inverse regardless of the blinding factor
+func TestBlindedInverse(t *testing.T) {
+	privKey, err := privateKeyFromBytes(mustDecodeHex(t, defaultPriv))
+	require.NoError(t, err, "creating private key failed")
+	n := privKey.Curve.Params().N
+	k := newRFC6979(privKey, mustDecodeHex(t, defaultHash)).next()
+
+	for i := 0; i < 10; i++ {
+		kInv, err := blindedInverse(k, n)
+		require.NoError(t, err, "inversion failed")
+		product := new(big.Int).Mul(k, kInv)
+		assert.Equal(t, 0, product.Mod(product, n).Cmp(big.NewInt(1)), "not the inverse of k")
+	}
+}
+
+// TestCryptoContext_DeterministicSignatures tests that signing the same data in deterministic mode
+// results in the same signature, which is verifiable with the existing Verify
+func TestCryptoContext_DeterministicSignatures(t *testing.T) {
+	asserter := assert.New(t)
+	requirer := require.New(t)
+	p, err := newProtocolContextSigner(defaultName, defaultUUID, defaultPriv, "")
+	requirer.NoError(err, "creating protocol context failed")
+	p.Crypto.(*CryptoContext).DeterministicSignatures = true
+	id := uuid.MustParse(defaultUUID)
+	data := mustDecodeHex(t, defaultInputData)
+
+	signature, err := p.Crypto.Sign(id, data)
+	requirer.NoError(err, "signing failed")
+	requirer.Len(signature, nistp256SignatureLength, "signature has invalid length")
+	for i := 0; i < 10; i++ {
+		repeated, err := p.Crypto.Sign(id, data)
+		requirer.NoError(err, "signing failed")
+		asserter.Equal(signature, repeated, "deterministic signature changed")
+	}
+	verified, err := p.Crypto.Verify(id, data, signature)
+	requirer.NoError(err, "verifying failed")
+	asserter.True(verified, "deterministic signature not verifiable")
+
+	// signed UPPs of the same hash are identical
+	hash := mustDecodeHex(t, defaultHash)
+	upp, err := p.SignHash(defaultName, hash, Signed)
+	requirer.NoError(err, "creating UPP failed")
+	repeatedUPP, err := p.SignHash(defaultName, hash, Signed)
+	requirer.NoError(err, "creating UPP failed")
+	asserter.Equal(upp, repeatedUPP, "deterministic UPP changed")
+	verified, err = p.Verify(defaultName, upp)
+	requirer.NoError(err, "verifying UPP failed")
+	asserter.True(verified, "deterministic UPP not verifiable")
+}
@@ -236,6 +236,16 @@ func setProtocolContext(p *Protocol, Name string, UUID string, PrivKey string, P
 	return nil
 }
 
+//mustDecodeHex decodes a hex string from the test configuration and fails the test if this is not possible
+func mustDecodeHex(t *testing.T, hexString string) []byte {
+	t.Helper()
+	decoded, err := hex.DecodeString(hexString)
+	if err != nil {
+		t.Fatalf("Test configuration string can't be decoded: %v, string was: %v", err, hexString)
+	}
+	return decoded
+}
+
 //Generates reproducible pseudorandom data using a simple linear congruental generator.
 //NEVER us this for something other than generating bogus input data.
 func deterministicPseudoRandomBytes(seed int32, size int) []byte {
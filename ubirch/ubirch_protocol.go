@@ -22,6 +22,7 @@ import (
 	"bytes"
 	"crypto/sha256"
 	"fmt"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/ugorji/go/codec"
@@ -32,14 +33,13 @@ type ProtocolVersion uint8
 type Hint uint8
 
 const (
-	Signed                     ProtocolVersion = 0x22 // Signed protocol, the Ubirch Protocol Package is signed
-	Chained                    ProtocolVersion = 0x23 // Chained protocol, the Ubirch Protocol Package contains the previous signature and is signed
-	Binary                     Hint            = 0x00
-	Disable                    Hint            = 0xFA
-	Enable                     Hint            = 0xFB
-	Delete                     Hint            = 0xFC
-	expectedHashSize                           = 32                          // length of a SHA256 hash
-	lenMsgpackSignatureElement                 = 2 + nistp256SignatureLength // length of a signature plus msgpack header for byte array (0xc4XX)
+	Signed           ProtocolVersion = 0x22 // Signed protocol, the Ubirch Protocol Package is signed
+	Chained          ProtocolVersion = 0x23 // Chained protocol, the Ubirch Protocol Package contains the previous signature and is signed
+	Binary           Hint            = 0x00
+	Disable          Hint            = 0xFA
+	Enable           Hint            = 0xFB
+	Delete           Hint            = 0xFC
+	expectedHashSize                 = 32 // length of a SHA256 hash
 )
 
 // Crypto Interface for exported functionality
@@ -47,19 +47,45 @@ type Crypto interface {
 	GetUUID(name string) (uuid.UUID, error)
 	GenerateKey(name string, id uuid.UUID) error
 	GetCSR(name string, subjectCountry string, subjectOrganization string) ([]byte, error)
+	GetCSRWithOptions(name string, opts CertificateOptions) ([]byte, error)
+	CreateSelfSignedCertificate(name string, opts CertificateOptions) ([]byte, error)
+	SetCertificate(name string, cert []byte) error
+	GetCertificate(name string) ([]byte, error)
 	GetPublicKey(name string) ([]byte, error)
 	PrivateKeyExists(name string) bool
 	SetPublicKey(name string, id uuid.UUID, pubKeyBytes []byte) error
 	SetKey(name string, id uuid.UUID, privKeyBytes []byte) error
+	ImportPublicKey(name string, id uuid.UUID, data []byte, format KeyFormat) error
+	ExportPublicKey(name string, format KeyFormat) ([]byte, error)
+	GenerateExportableKey(name string, id uuid.UUID) error
+	ImportPrivateKey(name string, id uuid.UUID, data []byte, format KeyFormat, exportable bool) error
+	ExportPrivateKey(name string, format KeyFormat) ([]byte, error)
+
+	ListIdentities() ([]Identity, error)
+	GetKeyType(id uuid.UUID) (KeyType, error)
+	DeleteIdentity(name string) error
+	AddPublicKey(name string, id uuid.UUID, pubKeyBytes []byte, notBefore time.Time, notAfter time.Time) error
+	GetPublicKeyHistory(name string) ([]PublicKeyRecord, error)
 
 	Sign(id uuid.UUID, value []byte) ([]byte, error)
 	Verify(id uuid.UUID, value []byte, signature []byte) (bool, error)
+	VerifyAnyEncoding(id uuid.UUID, value []byte, signature []byte) (bool, error)
+	VerifyAt(id uuid.UUID, value []byte, signature []byte, t time.Time) (bool, error)
+	VerifyWithHistory(id uuid.UUID, value []byte, signature []byte) (bool, PublicKeyRecord, error)
 }
 
 // Protocol structure
 type Protocol struct {
 	Crypto
 	Signatures map[uuid.UUID][]byte
+
+	// PendingTimeout is the time after which a prepared chained UPP, which has been neither committed nor
+	// rolled back, expires. If zero, DefaultPendingTimeout is used.
+	PendingTimeout time.Duration `json:"-"`
+	pending        map[uuid.UUID]*PendingUPP
+
+	// Instrumentation optionally reports logs, metrics and traces of signing and verification
+	Instrumentation *Instrumentation `json:"-"`
 }
 
 // interface for Ubirch Protocol Packages
@@ -180,7 +206,7 @@ func Decode(upp []byte) (UPP, error) {
 		}
 		return chainedUPP, nil
 	default:
-		return nil, fmt.Errorf("invalid protocol version: 0x%02x", upp[1])
+		return nil, &ProtocolVersionError{Version: ProtocolVersion(upp[1])}
 	}
 }
 
@@ -224,37 +250,47 @@ func appendSignature(data []byte, signature []byte) []byte {
 // sign encodes, signs and appends the signature to a UPP
 // also saves the signature for chained UPPs
 func (p *Protocol) sign(upp UPP) ([]byte, error) {
-	encoded, err := Encode(upp)
+	uppWithSig, signature, err := p.signUPP(upp)
 	if err != nil {
 		return nil, err
 	}
 
+	// save the signature for chained UPPs
+	if upp.GetVersion() == Chained {
+		p.Signatures[upp.GetUuid()] = signature
+	}
+
+	return uppWithSig, nil
+}
+
+// signUPP encodes, signs and appends the signature to a UPP, returns the signed UPP and the signature
+func (p *Protocol) signUPP(upp UPP) ([]byte, []byte, error) {
+	encoded, err := Encode(upp)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	uppWithoutSig := encoded[:len(encoded)-1]
 
 	signature, err := p.Crypto.Sign(upp.GetUuid(), uppWithoutSig)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	if len(signature) != nistp256SignatureLength {
-		return nil, fmt.Errorf("generated signature has invalid length")
+		return nil, nil, fmt.Errorf("generated signature has invalid length")
 	}
 
 	uppWithSig := appendSignature(uppWithoutSig, signature)
 	if uppWithSig == nil {
-		return nil, fmt.Errorf("appending signature to UPP data failed")
-	}
-
-	// save the signature for chained UPPs
-	if upp.GetVersion() == Chained {
-		p.Signatures[upp.GetUuid()] = signature
+		return nil, nil, fmt.Errorf("appending signature to UPP data failed")
 	}
 
-	return uppWithSig, nil
+	return uppWithSig, signature, nil
 }
 
 //Sign is a wrapper for backwards compatibility with Sign() calls, will be removed in the future
 func (p *Protocol) Sign(name string, hash []byte, protocol ProtocolVersion) ([]byte, error) {
-	fmt.Println("Warning: Sign() is deprecated, please use SignHash() or SignData() as appropriate")
+	p.Instrumentation.warn("Sign() is deprecated, please use SignHash() or SignData() as appropriate")
 	return p.SignHash(name, hash, protocol)
 }
 
@@ -274,7 +310,7 @@ func (p *Protocol) SignHash(name string, hash []byte, protocol ProtocolVersion)
 func (p *Protocol) SignData(name string, userData []byte, protocol ProtocolVersion) ([]byte, error) {
 	//Catch errors
 	if userData == nil || len(userData) < 1 {
-		return nil, fmt.Errorf("input data is nil or empty")
+		return nil, fmt.Errorf("%w: can't be signed", ErrEmptyData)
 	}
 	//Calculate hash
 	//TODO: Make this dependent on the used crypto if we implement more than one
@@ -286,9 +322,13 @@ func (p *Protocol) SignData(name string, userData []byte, protocol ProtocolVersi
 // SignHashExtended creates and signs a ubirch-protocol message using the given hash, hint and protocol version.
 // The method expects a SHA256 hash as input data.
 // Returns a standard ubirch-protocol packet (UPP)
-func (p *Protocol) SignHashExtended(name string, hash []byte, protocol ProtocolVersion, hint Hint) ([]byte, error) {
+func (p *Protocol) SignHashExtended(name string, hash []byte, protocol ProtocolVersion, hint Hint) (upp []byte, err error) {
+	span := p.Instrumentation.startSpan("ubirch.SignHash", name)
+	start := p.Instrumentation.startTime()
+	defer func() { p.Instrumentation.endSign(span, start, name, protocol, err) }()
+
 	if len(hash) != expectedHashSize {
-		return nil, fmt.Errorf("invalid hash size, expected %v, got %v bytes", expectedHashSize, len(hash))
+		return nil, &HashSizeError{Expected: expectedHashSize, Actual: len(hash)}
 	}
 
 	id, err := p.GetUUID(name)
@@ -300,34 +340,265 @@ func (p *Protocol) SignHashExtended(name string, hash []byte, protocol ProtocolV
 	case Signed:
 		return p.sign(&SignedUPP{Signed, id, hint, hash, nil})
 	case Chained:
-		prevSignature, found := p.Signatures[id] // load signature of last UPP
-		if !found {
-			prevSignature = make([]byte, nistp256SignatureLength) // not found: make new chain start (all zeroes signature)
-		} else if len(prevSignature) != nistp256SignatureLength { // found: check that loaded signature has valid length
-			return nil, fmt.Errorf("invalid last signature, can't create chained UPP")
+		if p.pendingUPP(id) != nil {
+			return nil, fmt.Errorf("can't create chained UPP for %s: %w", id, ErrPendingUPP)
+		}
+		prevSignature, err := p.chainHead(id)
+		if err != nil {
+			return nil, err
 		}
 		return p.sign(&ChainedUPP{Chained, id, prevSignature, hint, hash, nil})
 	default:
-		return nil, fmt.Errorf("invalid protocol version: 0x%02x", protocol)
+		return nil, &ProtocolVersionError{Version: protocol}
 	}
 }
 
-// Verify verifies the signature of a ubirch-protocol message.
-func (p *Protocol) Verify(name string, upp []byte) (bool, error) {
-	if len(upp) <= lenMsgpackSignatureElement {
-		return false, fmt.Errorf("input not verifiable, not enough data: len %d <= %d bytes", len(upp), lenMsgpackSignatureElement)
+// chainHead returns the signature of the last chained UPP of the UUID, or a zero signature for a new chain
+func (p *Protocol) chainHead(id uuid.UUID) ([]byte, error) {
+	prevSignature, found := p.Signatures[id] // load signature of last UPP
+	if !found {
+		return make([]byte, nistp256SignatureLength), nil // not found: make new chain start (all zeroes signature)
 	}
+	if len(prevSignature) != nistp256SignatureLength { // found: check that loaded signature has valid length
+		return nil, &ChainStateError{UUID: id, Reason: fmt.Sprintf("signature length %d != %d", len(prevSignature), nistp256SignatureLength)}
+	}
+	return prevSignature, nil
+}
+
+// splitUPP locates the signed part and the signature of an encoded UPP by walking its msgpack structure.
+// The signature can have any length, so UPPs of all signature schemes can be split. The payload can be of
+// any type and non-canonical encodings are accepted, use DecodeStrict to enforce the canonical encoding.
+func splitUPP(upp []byte) (signedPart []byte, signature []byte, err error) {
+	signature, signatureStart, err := locateSignature(upp)
+	if err != nil {
+		return nil, nil, fmt.Errorf("input not verifiable: %w", err)
+	}
+	return upp[:signatureStart], signature, nil
+}
+
+// Verify verifies the signature of a ubirch-protocol message. The signed part of the message and the
+// signature are located by parsing the message, the signature is verified with the scheme of the key type
+// of the identity.
+func (p *Protocol) Verify(name string, upp []byte) (verified bool, err error) {
+	span := p.Instrumentation.startSpan("ubirch.Verify", name)
+	start := p.Instrumentation.startTime()
+	defer func() { p.Instrumentation.endVerify(span, start, name, verified, err) }()
 
 	id, err := p.GetUUID(name)
 	if err != nil {
 		return false, err
 	}
 
-	data := upp[:len(upp)-lenMsgpackSignatureElement]
-	signature := upp[len(upp)-nistp256SignatureLength:]
+	data, signature, err := splitUPP(upp)
+	if err != nil {
+		return false, err
+	}
 	return p.Crypto.Verify(id, data, signature)
 }
 
+// VerifyUPPWithPublicKey verifies the signature of a ubirch-protocol message with the given public key.
+// No keystore or name mapping is needed. The public key can be given in any format supported by
+// ParsePublicKey, e.g. raw (64 bytes, X||Y), PEM or JWK; Ed25519 keys are supported in raw (32 bytes), PEM
+// and DER format. With FormatAuto the format is detected from the data.
+// Returns 'true' and 'nil' error if the signature was verifiable.
+func VerifyUPPWithPublicKey(upp []byte, pubKey []byte, format KeyFormat) (bool, error) {
+	pub, err := parseVerificationKey(pubKey, format)
+	if err != nil {
+		return false, fmt.Errorf("invalid public key: %w", err)
+	}
+
+	data, signature, err := splitUPP(upp)
+	if err != nil {
+		return false, err
+	}
+	return verifySignature(pub, data, signature)
+}
+
+// VerifyAt verifies the signature of a ubirch-protocol message using the public keys
+// of the identity which were valid at the given time.
+func (p *Protocol) VerifyAt(name string, upp []byte, t time.Time) (bool, error) {
+	id, err := p.GetUUID(name)
+	if err != nil {
+		return false, err
+	}
+
+	data, signature, err := splitUPP(upp)
+	if err != nil {
+		return false, err
+	}
+	return p.Crypto.VerifyAt(id, data, signature, t)
+}
+
+// VerifyWithHistory verifies the signature of a ubirch-protocol message using all known public keys
+// of the identity and returns the record of the key which matched.
+func (p *Protocol) VerifyWithHistory(name string, upp []byte) (bool, PublicKeyRecord, error) {
+	id, err := p.GetUUID(name)
+	if err != nil {
+		return false, PublicKeyRecord{}, err
+	}
+
+	data, signature, err := splitUPP(upp)
+	if err != nil {
+		return false, PublicKeyRecord{}, err
+	}
+	return p.Crypto.VerifyWithHistory(id, data, signature)
+}
+
+// VerifyChain verifies the signatures of a sequence of chained ubirch-protocol messages using all known
+// public keys of the identity, so chains continuing across a key rotation can be verified, and checks
+// that each message is linked to its predecessor. Returns an error indicating the first failing message.
+func (p *Protocol) VerifyChain(name string, upps [][]byte) error {
+	if len(upps) == 0 {
+		return fmt.Errorf("no UPPs to verify")
+	}
+
+	var previous UPP
+	var previousKey PublicKeyRecord
+	for i, uppBytes := range upps {
+		verified, key, err := p.VerifyWithHistory(name, uppBytes)
+		if err != nil {
+			return fmt.Errorf("verifying UPP at index %d failed: %w", i, err)
+		}
+		if !verified {
+			return fmt.Errorf("signature of UPP at index %d not verifiable", i)
+		}
+		if previous != nil && key.NotBefore.Before(previousKey.NotBefore) {
+			return fmt.Errorf("UPP at index %d signed with a key older than its predecessor's key", i)
+		}
+
+		current, err := DecodeChained(uppBytes)
+		if err != nil {
+			return fmt.Errorf("decoding UPP at index %d failed: %w", i, err)
+		}
+		if previous != nil {
+			linked, err := CheckChainLink(previous, current)
+			if err != nil {
+				return fmt.Errorf("checking chain link of UPP at index %d failed: %w", i, err)
+			}
+			if !linked {
+				return fmt.Errorf("UPP at index %d is not linked to its predecessor", i)
+			}
+		}
+		previous, previousKey = current, key
+	}
+	return nil
+}
+
+// DeleteIdentity deletes the identity with the given name from the crypto context. If no other name
+// refers to the same UUID, the chain state (last signature and pending UPP) of the UUID is dropped as well.
+func (p *Protocol) DeleteIdentity(name string) error {
+	id, err := p.GetUUID(name)
+	if err != nil {
+		return err
+	}
+
+	// decide about the chain state before the keys are deleted
+	identities, err := p.ListIdentities()
+	if err != nil {
+		return err
+	}
+	shared := false
+	for _, identity := range identities {
+		if identity.UUID == id && identity.Name != name {
+			shared = true
+		}
+	}
+
+	err = p.Crypto.DeleteIdentity(name)
+	if err != nil {
+		return err
+	}
+	if shared {
+		return nil
+	}
+
+	delete(p.Signatures, id)
+	delete(p.pending, id)
+	return nil
+}
+
+// checkChainIdentity checks that the UUID belongs to an identity whose key can be used for chained UPPs.
+// Chained UPPs are only supported for ECDSA NIST P-256 keys, as the length of the previous signature
+// field is fixed to the length of their signatures.
+func (p *Protocol) checkChainIdentity(id uuid.UUID) error {
+	keyType, err := p.GetKeyType(id)
+	if err != nil {
+		return err
+	}
+	if keyType != ECDSAP256 {
+		return fmt.Errorf("chained UPPs not supported for key type %s of UUID %s", keyType, id)
+	}
+	return nil
+}
+
+// GetLastSignature returns the signature of the last chained UPP of the given name, which will be the
+// previous signature of the next chained UPP. If no chained UPP has been created yet, the returned
+// signature consists of zeroes, as a new chain starts with it.
+func (p *Protocol) GetLastSignature(name string) ([]byte, error) {
+	id, err := p.GetUUID(name)
+	if err != nil {
+		return nil, err
+	}
+	return p.GetLastSignatureByUUID(id)
+}
+
+// GetLastSignatureByUUID returns the signature of the last chained UPP of the given UUID,
+// see GetLastSignature.
+func (p *Protocol) GetLastSignatureByUUID(id uuid.UUID) ([]byte, error) {
+	err := p.checkChainIdentity(id)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := p.chainHead(id)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{}, signature...), nil
+}
+
+// SetLastSignature sets the signature of the last chained UPP of the given name, so the chain is
+// resumed from this signature, e.g. one recovered from the backend. The next chained UPP of the name
+// will contain it as previous signature.
+func (p *Protocol) SetLastSignature(name string, signature []byte) error {
+	id, err := p.GetUUID(name)
+	if err != nil {
+		return err
+	}
+	return p.SetLastSignatureByUUID(id, signature)
+}
+
+// SetLastSignatureByUUID sets the signature of the last chained UPP of the given UUID,
+// see SetLastSignature.
+func (p *Protocol) SetLastSignatureByUUID(id uuid.UUID, signature []byte) error {
+	if len(signature) != nistp256SignatureLength {
+		return fmt.Errorf("can't set last signature: invalid signature length (%d), must be %d", len(signature), nistp256SignatureLength)
+	}
+	err := p.checkChainIdentity(id)
+	if err != nil {
+		return fmt.Errorf("can't set last signature: %w", err)
+	}
+	if p.Signatures == nil {
+		p.Signatures = make(map[uuid.UUID][]byte, 1)
+	}
+	p.Signatures[id] = append([]byte{}, signature...)
+	return nil
+}
+
+// ResetLastSignature starts a new chain for the given name. The next chained UPP of the name
+// will contain a previous signature consisting of zeroes.
+func (p *Protocol) ResetLastSignature(name string) error {
+	id, err := p.GetUUID(name)
+	if err != nil {
+		return err
+	}
+	return p.ResetLastSignatureByUUID(id)
+}
+
+// ResetLastSignatureByUUID starts a new chain for the given UUID, see ResetLastSignature.
+func (p *Protocol) ResetLastSignatureByUUID(id uuid.UUID) error {
+	return p.SetLastSignatureByUUID(id, make([]byte, nistp256SignatureLength))
+}
+
 // CheckChainLink compares the signature bytes of a previous ubirch protocol package with the previous signature bytes of
 // a subsequent chained ubirch protocol package and returns true if they match.
 // Returns an error if one of the UPPs is invalid.
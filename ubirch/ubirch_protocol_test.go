@@ -29,11 +29,14 @@ package ubirch
 import (
 	"bytes"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"math"
@@ -100,16 +103,119 @@ func TestDecodeArrayToStruct(t *testing.T) {
 	}
 }
 
-func TestGetLastSignatureNOTRDY(t *testing.T) {
-	t.Error("GetLastSignature() not implemented")
+func TestGetLastSignature(t *testing.T) {
+	asserter := assert.New(t)
+	requirer := require.New(t)
+
+	protocol, err := newProtocolContextSigner(defaultName, defaultUUID, defaultPriv, "")
+	requirer.NoError(err)
+
+	//no chained UPP yet: a new chain starts with a zero signature
+	lastSignature, err := protocol.GetLastSignature(defaultName)
+	requirer.NoError(err)
+	asserter.Equal(make([]byte, nistp256SignatureLength), lastSignature)
+
+	upp, err := protocol.SignHash(defaultName, mustDecodeHex(t, defaultHash), Chained)
+	requirer.NoError(err)
+	lastSignature, err = protocol.GetLastSignature(defaultName)
+	requirer.NoError(err)
+	asserter.Equal(upp[len(upp)-nistp256SignatureLength:], lastSignature)
+	lastSignatureByUUID, err := protocol.GetLastSignatureByUUID(uuid.MustParse(defaultUUID))
+	requirer.NoError(err)
+	asserter.Equal(lastSignature, lastSignatureByUUID)
+
+	//the returned signature is a copy
+	lastSignature[0] ^= 0xff
+	asserter.Equal(upp[len(upp)-nistp256SignatureLength:], protocol.Signatures[uuid.MustParse(defaultUUID)])
+
+	_, err = protocol.GetLastSignature("unknown")
+	asserter.True(errors.Is(err, ErrUnknownName))
+	_, err = protocol.GetLastSignatureByUUID(uuid.New())
+	asserter.True(errors.Is(err, ErrUnknownName))
+
+	//an undecodable key of another identity does not affect the chain state of the UUID
+	other := uuid.New()
+	protocol.Crypto.(*CryptoContext).Names["other"] = other
+	requirer.NoError(protocol.Crypto.(*CryptoContext).Keystore.SetKey(pubKeyEntryTitle(other), []byte("not a public key")))
+	_, err = protocol.GetLastSignature(defaultName)
+	asserter.NoError(err, "undecodable key of another identity failed getting the last signature")
+
+	protocol.Signatures[uuid.MustParse(defaultUUID)] = []byte{1, 2, 3}
+	_, err = protocol.GetLastSignature(defaultName)
+	asserter.True(errors.Is(err, ErrBrokenChainState))
 }
 
-func TestSetLastSignatureNOTRDY(t *testing.T) {
-	t.Error("SetLastSignature() not implemented")
+func TestSetLastSignature(t *testing.T) {
+	asserter := assert.New(t)
+	requirer := require.New(t)
+
+	protocol, err := newProtocolContextSigner(defaultName, defaultUUID, defaultPriv, "")
+	requirer.NoError(err)
+	protocol.Signatures = nil
+
+	//resume the chain from a known signature
+	requirer.NoError(protocol.SetLastSignature(defaultName, mustDecodeHex(t, defaultLastSig)))
+	upp, err := protocol.SignHash(defaultName, mustDecodeHex(t, defaultHash), Chained)
+	requirer.NoError(err)
+	decoded, err := DecodeChained(upp)
+	requirer.NoError(err)
+	asserter.Equal(mustDecodeHex(t, defaultLastSig), decoded.PrevSignature)
+
+	requirer.NoError(protocol.SetLastSignatureByUUID(uuid.MustParse(defaultUUID), mustDecodeHex(t, defaultLastSig)))
+	lastSignature, err := protocol.GetLastSignature(defaultName)
+	requirer.NoError(err)
+	asserter.Equal(mustDecodeHex(t, defaultLastSig), lastSignature)
+
+	var tests = []struct {
+		testName  string
+		name      string
+		signature []byte
+	}{
+		{"unknown name", "unknown", mustDecodeHex(t, defaultLastSig)},
+		{"nil signature", defaultName, nil},
+		{"short signature", defaultName, make([]byte, nistp256SignatureLength-1)},
+		{"long signature", defaultName, make([]byte, nistp256SignatureLength+1)},
+		{"Ed25519 key", "ed", mustDecodeHex(t, defaultLastSig)},
+	}
+
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	requirer.NoError(err)
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	requirer.NoError(err)
+	requirer.NoError(protocol.ImportPublicKey("ed", uuid.New(), der, FormatDER))
+
+	for _, currTest := range tests {
+		t.Run(currTest.testName, func(t *testing.T) {
+			err := protocol.SetLastSignature(currTest.name, currTest.signature)
+			assert.Error(t, err)
+			lastSignature, err := protocol.GetLastSignature(defaultName)
+			require.NoError(t, err)
+			assert.Equal(t, mustDecodeHex(t, defaultLastSig), lastSignature, "last signature changed")
+		})
+	}
 }
 
-func TestResetLastSignatureNOTRDY(t *testing.T) {
-	t.Error("ResetLastSignature() not implemented")
+func TestResetLastSignature(t *testing.T) {
+	asserter := assert.New(t)
+	requirer := require.New(t)
+
+	protocol, err := newProtocolContextSigner(defaultName, defaultUUID, defaultPriv, defaultLastSig)
+	requirer.NoError(err)
+
+	requirer.NoError(protocol.ResetLastSignature(defaultName))
+	upp, err := protocol.SignHash(defaultName, mustDecodeHex(t, defaultHash), Chained)
+	requirer.NoError(err)
+	decoded, err := DecodeChained(upp)
+	requirer.NoError(err)
+	asserter.Equal(make([]byte, nistp256SignatureLength), decoded.PrevSignature)
+
+	requirer.NoError(protocol.ResetLastSignatureByUUID(uuid.MustParse(defaultUUID)))
+	lastSignature, err := protocol.GetLastSignature(defaultName)
+	requirer.NoError(err)
+	asserter.Equal(make([]byte, nistp256SignatureLength), lastSignature)
+
+	asserter.True(errors.Is(protocol.ResetLastSignature("unknown"), ErrUnknownName))
+	asserter.True(errors.Is(protocol.ResetLastSignatureByUUID(uuid.New()), ErrUnknownName))
 }
 
 //TestSignHashFails tests the cases where the SignHash function must return an error
@@ -957,6 +1063,26 @@ func TestProtocol_Verify(t *testing.T) {
 			signatureVerifiable: false,
 			throwsError:         true,
 		},
+		{
+			testName:            "signed UPP with trailing data",
+			nameForProtocol:     defaultName,
+			nameForVerify:       defaultName,
+			UUID:                defaultUUID,
+			pubKey:              defaultPub,
+			input:               "9522c4106eac4d0b16e645088c4622e7451ea5a100c4206b86b273ff34fce19d6b804eff5a3f5747ada4eaa22f1d49c01e52ddb7875b4bc440bc2a01322c679b9648a9391704e992c041053404aafcdab08fc4ce54a57eb16876d741918d01219abf2dc7913f2d9d49439d350f11d05cdb3f85972ac95c45fc00",
+			signatureVerifiable: false,
+			throwsError:         true,
+		},
+		{
+			testName:            "signed UPP with signature as string (legacy encoding)",
+			nameForProtocol:     defaultName,
+			nameForVerify:       defaultName,
+			UUID:                defaultUUID,
+			pubKey:              defaultPub,
+			input:               "9522c4106eac4d0b16e645088c4622e7451ea5a100c4206b86b273ff34fce19d6b804eff5a3f5747ada4eaa22f1d49c01e52ddb7875b4bd940bc2a01322c679b9648a9391704e992c041053404aafcdab08fc4ce54a57eb16876d741918d01219abf2dc7913f2d9d49439d350f11d05cdb3f85972ac95c45fc",
+			signatureVerifiable: true,
+			throwsError:         false,
+		},
 	}
 
 	//Iterate over all tests
@@ -989,6 +1115,159 @@ func TestProtocol_Verify(t *testing.T) {
 	}
 }
 
+//TestProtocol_VerifyEd25519 tests that Verify locates the signature by parsing the UPP and
+//verifies it with the signature scheme of the identity's key type (here: Ed25519)
+func TestProtocol_VerifyEd25519(t *testing.T) {
+	asserter := assert.New(t)
+	requirer := require.New(t)
+
+	protocol, err := newProtocolContextVerifier(defaultName, defaultUUID, defaultPub)
+	requirer.NoError(err)
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	requirer.NoError(err)
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	requirer.NoError(err)
+	requirer.NoError(protocol.ImportPublicKey("ed", uuid.MustParse(defaultUUID), der, FormatDER))
+
+	for _, version := range []ProtocolVersion{Signed, Chained} {
+		var upp UPP = &SignedUPP{Signed, uuid.MustParse(defaultUUID), Binary, mustDecodeHex(t, defaultHash), nil}
+		if version == Chained {
+			upp = &ChainedUPP{Chained, uuid.MustParse(defaultUUID), make([]byte, 64), Binary, mustDecodeHex(t, defaultHash), nil}
+		}
+		encoded, err := Encode(upp)
+		requirer.NoError(err)
+		signedPart := encoded[:len(encoded)-1]
+		signedUPP := appendSignature(signedPart, ed25519.Sign(priv, signedPart))
+
+		verified, err := protocol.Verify("ed", signedUPP)
+		requirer.NoError(err)
+		asserter.True(verified, "Ed25519 signed UPP not verifiable")
+		verified, err = VerifyUPPWithPublicKey(signedUPP, der, FormatAuto)
+		requirer.NoError(err)
+		asserter.True(verified, "Ed25519 signed UPP not verifiable with public key")
+
+		signedUPP[len(signedUPP)-1] ^= 0xff
+		verified, err = protocol.Verify("ed", signedUPP)
+		requirer.NoError(err)
+		asserter.False(verified, "manipulated Ed25519 signed UPP verifiable")
+	}
+}
+
+//TestProtocol_VerifyLenientEncoding tests that validly signed UPPs, which are not canonically encoded,
+//can be verified, but are rejected by DecodeStrict
+//		key registration UPP with map payload
+//		UPP with non-minimal encodings of the version and the UUID header
+func TestProtocol_VerifyLenientEncoding(t *testing.T) {
+	requirer := require.New(t)
+
+	protocol, err := newProtocolContextSigner(defaultName, defaultUUID, defaultPriv, "")
+	requirer.NoError(err)
+	id := uuid.MustParse(defaultUUID)
+
+	var tests = []struct {
+		testName   string
+		signedPart []byte
+	}{
+		{
+			testName: "map payload",
+			// [0x22, uuid, 0x01, {"pubKey": <64 bytes>}, signature]
+			signedPart: bytes.Join([][]byte{
+				{0x95, 0x22, 0xc4, 0x10}, id[:],
+				{0x01, 0x81, 0xa6, 'p', 'u', 'b', 'K', 'e', 'y', 0xc4, 0x40}, mustDecodeHex(t, defaultPub),
+			}, nil),
+		},
+		{
+			testName: "non-minimal encodings",
+			// [uint8 0x22, bin16 uuid, 0x00, array16 [hash], signature]
+			signedPart: bytes.Join([][]byte{
+				{0x95, 0xcc, 0x22, 0xc5, 0x00, 0x10}, id[:],
+				{0x00, 0xdc, 0x00, 0x01, 0xc4, 0x20}, mustDecodeHex(t, defaultHash),
+			}, nil),
+		},
+	}
+
+	for _, currTest := range tests {
+		t.Run(currTest.testName, func(t *testing.T) {
+			asserter := assert.New(t)
+			requirer := require.New(t)
+
+			signature, err := protocol.Crypto.Sign(id, currTest.signedPart)
+			requirer.NoError(err)
+			upp := appendSignature(currTest.signedPart, signature)
+
+			verified, err := protocol.Verify(defaultName, upp)
+			requirer.NoError(err)
+			asserter.True(verified, "validly signed UPP not verifiable")
+			verified, err = VerifyUPPWithPublicKey(upp, mustDecodeHex(t, defaultPub), FormatRaw)
+			requirer.NoError(err)
+			asserter.True(verified, "validly signed UPP not verifiable with public key")
+			verified, _, err = protocol.VerifyWithHistory(defaultName, upp)
+			requirer.NoError(err)
+			asserter.True(verified, "validly signed UPP not verifiable with key history")
+
+			_, err = DecodeStrict(upp)
+			asserter.Error(err, "non-canonical UPP accepted by DecodeStrict")
+
+			upp[len(upp)-1] ^= 0xff
+			verified, err = protocol.Verify(defaultName, upp)
+			requirer.NoError(err)
+			asserter.False(verified, "manipulated UPP verifiable")
+		})
+	}
+}
+
+//TestVerifyUPPWithPublicKey tests the verification of UPPs with a public key in different formats,
+//without keystore and name mapping
+func TestVerifyUPPWithPublicKey(t *testing.T) {
+	const signedUPP = "9522c4106eac4d0b16e645088c4622e7451ea5a100c4206b86b273ff34fce19d6b804eff5a3f5747ada4eaa22f1d49c01e52ddb7875b4bc440bc2a01322c679b9648a9391704e992c041053404aafcdab08fc4ce54a57eb16876d741918d01219abf2dc7913f2d9d49439d350f11d05cdb3f85972ac95c45fc"
+	const chainedUPP = "9623c4106eac4d0b16e645088c4622e7451ea5a1c4400000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000c4204bf5122f344554c53bde2ebb8cd2b7e3d1600ad631c385a5d7cce23c7785459ac440395aac8124d4253347779c883c93ad0c614681d794e789aa2b66b2bdfc2092fabd95c67ca04212741462e4263df3f4db12f9c4cf345fde342edcbb4e2483bb4a"
+
+	requirer := require.New(t)
+	pubKeyBytes := mustDecodeHex(t, defaultPub)
+	pemKey, err := MarshalPublicKey(pubKeyBytes, FormatPEM)
+	requirer.NoError(err)
+	jwkKey, err := MarshalPublicKey(pubKeyBytes, FormatJWK)
+	requirer.NoError(err)
+	otherKey := make([]byte, len(pubKeyBytes))
+	copy(otherKey, pubKeyBytes)
+	otherKey[nistp256XLength-1] ^= 0x01
+
+	var tests = []struct {
+		testName    string
+		UPP         string
+		pubKey      []byte
+		format      KeyFormat
+		verifiable  bool
+		throwsError bool
+	}{
+		{"raw key", signedUPP, pubKeyBytes, FormatRaw, true, false},
+		{"PEM key", signedUPP, pemKey, FormatPEM, true, false},
+		{"JWK key", chainedUPP, jwkKey, FormatJWK, true, false},
+		{"detected PEM key", chainedUPP, pemKey, FormatAuto, true, false},
+		{"detected JWK key", signedUPP, jwkKey, FormatAuto, true, false},
+		{"wrong format", signedUPP, pemKey, FormatJWK, false, true},
+		{"invalid key", signedUPP, otherKey, FormatRaw, false, true},
+		{"wrong key", signedUPP, mustDecodeHex(t, "92bbd65d59aecbdf7b497fb4dcbdffa22833613868ddf35b44f5bd672496664a2cc1d228550ae36a1d0210a3b42620b634dc5d22ecde9e12f37d66eeedee3e6a"), FormatRaw, false, false},
+		{"manipulated UPP", signedUPP[:len(signedUPP)-2] + "00", pubKeyBytes, FormatRaw, false, false},
+		{"UPP with trailing data", signedUPP + "00", pubKeyBytes, FormatRaw, false, true},
+		{"empty UPP", "", pubKeyBytes, FormatRaw, false, true},
+	}
+
+	for _, currTest := range tests {
+		t.Run(currTest.testName, func(t *testing.T) {
+			asserter := assert.New(t)
+
+			verified, err := VerifyUPPWithPublicKey(mustDecodeHex(t, currTest.UPP), currTest.pubKey, currTest.format)
+			asserter.Equal(currTest.verifiable, verified)
+			if currTest.throwsError {
+				asserter.Error(err)
+			} else {
+				asserter.NoError(err)
+			}
+		})
+	}
+}
+
 //TestProtocol_SignVerifyLoop tests if a loop of creating and verifying an UPP with the lib
 //functions works as expected (SignData and Verify). This mainly tests if packet creation and
 //verification/unpacking is consistent within the library. This is tested with random data